@@ -0,0 +1,128 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// ErrUnauthorized is the error to reject a request with 401 Unauthorized.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// ErrForbidden is the error to reject a request with 403 Forbidden.
+var ErrForbidden = errors.New("forbidden")
+
+// AuthError is the error of an Authenticator which rejects a request with the headers
+// of the response, such as the WWW-Authenticate challenge of 401 Unauthorized.
+type AuthError struct {
+	// Err is ErrForbidden to reject the request with 403 Forbidden, or else the request
+	// is rejected with 401 Unauthorized.
+	Err error
+	// Header is the headers written in the response.
+	Header http.Header
+}
+
+// Error implements the error interface.
+func (e *AuthError) Error() string {
+	if e.Err == nil {
+		return ErrUnauthorized.Error()
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// Identity represents the identity of an authenticated peer.
+type Identity interface{}
+
+// Authenticator authenticates the HTTP CONNECT requests and the WebSocket upgrade requests
+// before the connections become Conns.
+type Authenticator interface {
+	// Authenticate returns the identity of the request's peer. The request is rejected
+	// with 403 Forbidden if the error is ErrForbidden, or with 401 Unauthorized otherwise.
+	// The headers of an *AuthError are written in the response.
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// AuthenticatorFunc is an adapter to allow the use of ordinary functions as Authenticators.
+type AuthenticatorFunc func(r *http.Request) (Identity, error)
+
+// Authenticate calls f(r).
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (Identity, error) {
+	return f(r)
+}
+
+func authenticate(a Authenticator, w http.ResponseWriter, r *http.Request) (Identity, error) {
+	if a == nil {
+		return nil, nil
+	}
+	identity, err := a.Authenticate(r)
+	if err != nil {
+		if e, ok := err.(*AuthError); ok {
+			for key, values := range e.Header {
+				for _, value := range values {
+					w.Header().Add(key, value)
+				}
+			}
+		}
+		if errors.Is(err, ErrForbidden) {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, "403 forbidden\n")
+		} else {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, "401 unauthorized\n")
+		}
+		return nil, err
+	}
+	return identity, nil
+}
+
+// IdentityOf returns the identity attached by an Authenticator to the Conn,
+// the net.Conn passed to the opened func of ServeConn or the Messages passed
+// to the opened func of ServeMessages. It returns nil if there is none.
+func IdentityOf(v interface{}) Identity {
+	for v != nil {
+		if c, ok := v.(interface{ Identity() Identity }); ok {
+			return c.Identity()
+		}
+		v = unwrap(v)
+	}
+	return nil
+}
+
+// unwrap returns the underlying connection of v, or nil.
+func unwrap(v interface{}) interface{} {
+	switch c := v.(type) {
+	case *messages:
+		return c.rwc
+	case *envelopeMessages:
+		return c.Messages
+	case *captureMessages:
+		return c.Messages
+	case *bufferedConn:
+		return c.Conn
+	case *observedConn:
+		return c.Conn
+	case *WSConn:
+		return c.stream.conn
+	case *TCPConn:
+		return c.Conn
+	case *UNIXConn:
+		return c.Conn
+	case *HTTPConn:
+		return c.Conn
+	case *INPROConn:
+		return c.Conn
+	case *SIMConn:
+		return c.Conn
+	case Conn:
+		return c.Connection()
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var testAuthenticator = AuthenticatorFunc(func(r *http.Request) (Identity, error) {
+	switch r.Header.Get("Authorization") {
+	case "Bearer token":
+		return "user", nil
+	case "":
+		return nil, ErrUnauthorized
+	}
+	return nil, ErrForbidden
+})
+
+func TestAuthenticator(t *testing.T) {
+	testAuthenticatorServeMessages(&HTTP{Authenticator: testAuthenticator}, t)
+	testAuthenticatorServeConn(&HTTP{Authenticator: testAuthenticator}, t)
+	testAuthenticatorServeMessages(&HTTP{Config: DefalutServerTLSConfig(), Authenticator: testAuthenticator}, t)
+}
+
+func testAuthenticatorDial(t *testing.T, tls bool) Conn {
+	var addr = ":9999"
+	clientSock := &HTTP{Header: http.Header{}}
+	if tls {
+		clientSock.Config = SkipVerifyTLSConfig()
+	}
+	if _, err := clientSock.Dial(addr); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Error("should be unexpected HTTP response: 401 Unauthorized")
+	}
+	clientSock.Header.Set("Authorization", "Bearer bad")
+	if _, err := clientSock.Dial(addr); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Error("should be unexpected HTTP response: 403 Forbidden")
+	}
+	clientSock.Header.Set("Authorization", "Bearer token")
+	conn, err := clientSock.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func testAuthenticatorServeMessages(serverSock *HTTP, t *testing.T) {
+	var addr = ":9999"
+	l, err := serverSock.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		l.ServeMessages(func(messages Messages) (Context, error) {
+			if identity := IdentityOf(messages); identity != "user" {
+				t.Error(identity)
+			}
+			return messages, nil
+		}, func(context Context) error {
+			messages := context.(Messages)
+			msg, err := messages.ReadMessage(nil)
+			if err != nil {
+				return err
+			}
+			return messages.WriteMessage(msg)
+		})
+	}()
+	conn := testAuthenticatorDial(t, serverSock.Config != nil)
+	messages := conn.Messages()
+	str := "Hello World"
+	messages.WriteMessage([]byte(str))
+	if msg, err := messages.ReadMessage(nil); err != nil {
+		t.Error(err)
+	} else if string(msg) != str {
+		t.Errorf("error %s != %s", string(msg), str)
+	}
+	messages.Close()
+	l.Close()
+	wg.Wait()
+}
+
+func testAuthenticatorServeConn(serverSock *HTTP, t *testing.T) {
+	var addr = ":9999"
+	l, err := serverSock.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		l.ServeConn(func(conn net.Conn) (Context, error) {
+			if identity := IdentityOf(conn); identity != "user" {
+				t.Error(identity)
+			}
+			return conn, nil
+		}, func(context Context) error {
+			conn := context.(net.Conn)
+			buf := make([]byte, 64)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return err
+			}
+			_, err = conn.Write(buf[:n])
+			return err
+		})
+	}()
+	conn := testAuthenticatorDial(t, false)
+	str := "Hello World"
+	conn.Write([]byte(str))
+	buf := make([]byte, 64)
+	if n, err := conn.Read(buf); err != nil {
+		t.Error(err)
+	} else if string(buf[:n]) != str {
+		t.Errorf("error %s != %s", string(buf[:n]), str)
+	}
+	conn.Close()
+	l.Close()
+	wg.Wait()
+}
+
+func TestAuthenticatorWS(t *testing.T) {
+	var addr = ":9999"
+	serverSock := &WS{Authenticator: AuthenticatorFunc(func(r *http.Request) (Identity, error) {
+		if r.Host != addr {
+			return nil, ErrForbidden
+		}
+		return r.Host, nil
+	})}
+	l, err := serverSock.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if identity := IdentityOf(conn); identity != addr {
+			t.Error(identity)
+		}
+		messages := conn.Messages()
+		if identity := IdentityOf(messages); identity != addr {
+			t.Error(identity)
+		}
+		msg, err := messages.ReadMessage(nil)
+		if err == nil {
+			messages.WriteMessage(msg)
+		}
+		messages.Close()
+	}()
+	conn, err := NewWSSocket(nil).Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := conn.Messages()
+	str := "Hello World"
+	messages.WriteMessage([]byte(str))
+	if msg, err := messages.ReadMessage(nil); err != nil {
+		t.Error(err)
+	} else if string(msg) != str {
+		t.Errorf("error %s != %s", string(msg), str)
+	}
+	messages.Close()
+	wg.Wait()
+	l.Close()
+
+	serverSock.Authenticator = AuthenticatorFunc(func(r *http.Request) (Identity, error) {
+		return nil, ErrUnauthorized
+	})
+	l, err = serverSock.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		l.ServeData(func(conn net.Conn) error {
+			return nil
+		}, func(req []byte) (res []byte) {
+			return req
+		})
+	}()
+	if _, err := NewWSSocket(nil).Dial(addr); err == nil {
+		t.Error("should be unexpected HTTP response: 401 Unauthorized")
+	}
+	l.Close()
+	wg.Wait()
+}
+
+func TestAuthenticatorHandler(t *testing.T) {
+	handler := HTTPHandler("/socket")
+	handler.SetAuthenticator(testAuthenticator)
+	var addr = ":9999"
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(lis)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := handler.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if identity := IdentityOf(conn); identity != "user" {
+			t.Error(identity)
+		}
+		conn.Close()
+	}()
+	clientSock := &HTTP{Path: "/socket", Header: http.Header{}}
+	if _, err := clientSock.Dial(addr); err == nil {
+		t.Error("should be unexpected HTTP response: 401 Unauthorized")
+	}
+	clientSock.Header.Set("Authorization", "Bearer token")
+	conn, err := clientSock.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	handler.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestAuthenticatorChallenge(t *testing.T) {
+	var addr = ":9999"
+	authenticator := AuthenticatorFunc(func(r *http.Request) (Identity, error) {
+		return nil, &AuthError{Err: ErrUnauthorized, Header: http.Header{"Www-Authenticate": {`Bearer realm="socket"`}}}
+	})
+	requests := map[Socket]string{
+		&HTTP{Authenticator: authenticator}: "CONNECT " + HTTPPath + " HTTP/1.1\r\nHost: " + addr + "\r\n\r\n",
+		&WS{Authenticator: authenticator}: "GET / HTTP/1.1\r\nHost: " + addr + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n",
+	}
+	for serverSock, request := range requests {
+		l, err := serverSock.Listen(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Accept()
+		}()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(request))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Error(err)
+		} else if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") != `Bearer realm="socket"` {
+			t.Error(resp.Status, resp.Header)
+		}
+		conn.Close()
+		l.Close()
+		wg.Wait()
+	}
+	if err := (&AuthError{Err: ErrForbidden}); !errors.Is(err, ErrForbidden) || err.Error() != ErrForbidden.Error() {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/url"
+	"time"
+)
+
+// DefaultCertificateValidity is the default validity of the generated certificates.
+const DefaultCertificateValidity = time.Hour * 24
+
+// ErrKeyType is the error when the key type is not supported.
+var ErrKeyType = errors.New("key type is not supported")
+
+// KeyType is the type of a generated private key.
+type KeyType int
+
+const (
+	// ECDSAP256 is the ECDSA key on the P-256 curve.
+	ECDSAP256 KeyType = iota
+	// Ed25519 is the Ed25519 key.
+	Ed25519
+)
+
+// CertificateOptions are the options of a generated certificate.
+type CertificateOptions struct {
+	// CommonName is the common name of the subject.
+	CommonName string
+	// DNSNames are the DNS names of the subject alternative names.
+	DNSNames []string
+	// IPAddresses are the IP addresses of the subject alternative names.
+	IPAddresses []net.IP
+	// URIs are the URIs of the subject alternative names, such as SPIFFE IDs.
+	URIs []*url.URL
+	// NotBefore is the start of the validity. Zero means an hour ago.
+	NotBefore time.Time
+	// Validity is the duration of the validity. Zero means DefaultCertificateValidity.
+	Validity time.Duration
+	// KeyType is the type of the private key. Default is ECDSAP256.
+	KeyType KeyType
+}
+
+// CA is an in-memory certificate authority that issues the certificates
+// for development and tests.
+type CA struct {
+	// Certificate is the root certificate.
+	Certificate *x509.Certificate
+	// CertPEM is the root certificate data.
+	CertPEM []byte
+	key     crypto.Signer
+}
+
+// NewCA returns a new CA with a self-signed root certificate.
+// A nil opts means the default options with the common name "socket ca".
+func NewCA(opts *CertificateOptions) (*CA, error) {
+	if opts == nil {
+		opts = &CertificateOptions{CommonName: "socket ca"}
+	}
+	key, err := generateKey(opts.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	template, err := certificateTemplate(opts)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	template.BasicConstraintsValid = true
+	template.IsCA = true
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{
+		Certificate: cert,
+		CertPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:         key,
+	}, nil
+}
+
+// IssueServerCertificate returns the data of a server certificate signed by the CA and its key.
+func (ca *CA) IssueServerCertificate(opts *CertificateOptions) (certPEM, keyPEM []byte, err error) {
+	return ca.issue(opts, x509.ExtKeyUsageServerAuth)
+}
+
+// IssueClientCertificate returns the data of a client certificate signed by the CA and its key.
+func (ca *CA) IssueClientCertificate(opts *CertificateOptions) (certPEM, keyPEM []byte, err error) {
+	return ca.issue(opts, x509.ExtKeyUsageClientAuth)
+}
+
+func (ca *CA) issue(opts *CertificateOptions, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte, err error) {
+	if opts == nil {
+		opts = &CertificateOptions{}
+	}
+	key, err := generateKey(opts.KeyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := certificateTemplate(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, key.Public(), ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// ServerTLSConfig returns a server TLS config with a new server certificate.
+func (ca *CA) ServerTLSConfig(opts *CertificateOptions) (*tls.Config, error) {
+	certPEM, keyPEM, err := ca.IssueServerCertificate(opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewServerTLSConfig(certPEM, keyPEM)
+}
+
+// ClientTLSConfig returns a client TLS config which trusts the CA.
+func (ca *CA) ClientTLSConfig(serverName string) (*tls.Config, error) {
+	return NewClientTLSConfig(ca.CertPEM, serverName)
+}
+
+// MutualServerTLSConfig returns a server TLS config with a new server certificate,
+// which requires the client certificates signed by the CA.
+func (ca *CA) MutualServerTLSConfig(opts *CertificateOptions) (*tls.Config, error) {
+	certPEM, keyPEM, err := ca.IssueServerCertificate(opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewMutualServerTLSConfig(certPEM, keyPEM, ca.CertPEM, tls.RequireAndVerifyClientCert)
+}
+
+// MutualClientTLSConfig returns a client TLS config with a new client certificate,
+// which trusts the CA.
+func (ca *CA) MutualClientTLSConfig(serverName string, opts *CertificateOptions) (*tls.Config, error) {
+	certPEM, keyPEM, err := ca.IssueClientCertificate(opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewMutualClientTLSConfig(ca.CertPEM, certPEM, keyPEM, serverName)
+}
+
+func generateKey(keyType KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, ErrKeyType
+}
+
+func certificateTemplate(opts *CertificateOptions) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notBefore := opts.NotBefore
+	if notBefore.IsZero() {
+		notBefore = time.Now().Add(-time.Hour)
+	}
+	validity := opts.Validity
+	if validity <= 0 {
+		validity = DefaultCertificateValidity
+	}
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: opts.CommonName},
+		DNSNames:     opts.DNSNames,
+		IPAddresses:  opts.IPAddresses,
+		URIs:         opts.URIs,
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(validity),
+	}, nil
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"crypto/ed25519"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCA(t *testing.T) {
+	for _, keyType := range []KeyType{ECDSAP256, Ed25519} {
+		testCA(keyType, t)
+	}
+}
+
+func testCA(keyType KeyType, t *testing.T) {
+	ca, err := NewCA(&CertificateOptions{CommonName: "test ca", KeyType: keyType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.Certificate.IsCA || ca.Certificate.Subject.CommonName != "test ca" {
+		t.Error(ca.Certificate)
+	}
+	serverConfig, err := ca.MutualServerTLSConfig(&CertificateOptions{
+		CommonName:  "server",
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyType:     keyType,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spiffeID, _ := url.Parse("spiffe://hslam.com/client")
+	clientConfig, err := ca.MutualClientTLSConfig("", &CertificateOptions{
+		CommonName: "client",
+		URIs:       []*url.URL{spiffeID},
+		Validity:   time.Hour * 2,
+		KeyType:    keyType,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addr = "127.0.0.1:9999"
+	l, err := NewTCPSocket(serverConfig).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if identity := PeerIdentityOf(conn); identity == nil || identity.SPIFFEID.String() != "spiffe://hslam.com/client" {
+			t.Error(identity)
+		} else if _, ok := identity.Certificate.PublicKey.(ed25519.PublicKey); ok != (keyType == Ed25519) {
+			t.Error(identity.Certificate.PublicKeyAlgorithm)
+		}
+		conn.Write([]byte{0})
+		conn.Close()
+	}()
+	conn, err := NewTCPSocket(clientConfig).Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain := VerifiedChainOf(conn); len(chain) != 2 || chain[0].Subject.CommonName != "server" {
+		t.Error(chain)
+	} else if leaf := chain[0]; leaf.NotAfter.Sub(leaf.NotBefore) != DefaultCertificateValidity {
+		t.Error(leaf.NotBefore, leaf.NotAfter)
+	}
+	conn.Read(make([]byte, 1))
+	conn.Close()
+	<-done
+	l.Close()
+}
+
+func TestCAOptions(t *testing.T) {
+	ca, err := NewCA(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ca.IssueServerCertificate(&CertificateOptions{KeyType: KeyType(-1)}); err != ErrKeyType {
+		t.Error(err)
+	}
+	certPEM, keyPEM, err := ca.IssueServerCertificate(&CertificateOptions{
+		NotBefore: time.Now().Add(-time.Hour * 2),
+		Validity:  time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCertificateManager(certPEM, keyPEM); err != ErrCertificateExpired {
+		t.Error(err)
+	}
+	if config, err := ca.ServerTLSConfig(nil); err != nil || len(config.Certificates) != 1 {
+		t.Error(err)
+	}
+	if config, err := ca.ClientTLSConfig("localhost"); err != nil || config.RootCAs == nil || config.ServerName != "localhost" {
+		t.Error(config, err)
+	}
+	if _, err := (&CA{}).ClientTLSConfig("localhost"); err == nil {
+		t.Error("should be failed to append the certificates")
+	}
+}
@@ -0,0 +1,405 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/hslam/netpoll"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CaptureMagic is the magic at the beginning of a capture in the native format.
+const CaptureMagic = "SKTCAP01"
+
+// ErrCaptureFormat is the error returned when a capture is not in the native format.
+var ErrCaptureFormat = errors.New("capture format is not supported")
+
+// ErrCaptureRecordTooBig is the error returned when the payload of a record is longer
+// than the maximum record size of the CaptureReader.
+var ErrCaptureRecordTooBig = errors.New("capture record is too big")
+
+// DefaultMaxCaptureRecordSize is the default maximum size of the payload of a record
+// read by a CaptureReader.
+const DefaultMaxCaptureRecordSize = 64 << 20
+
+// CaptureDirection is the direction of a captured frame.
+type CaptureDirection uint8
+
+const (
+	// CaptureRead is the direction of the frames read by the captured side.
+	CaptureRead CaptureDirection = iota
+	// CaptureWrite is the direction of the frames written by the captured side.
+	CaptureWrite
+)
+
+// String returns the name of the direction.
+func (d CaptureDirection) String() string {
+	if d == CaptureRead {
+		return "read"
+	}
+	return "write"
+}
+
+// CaptureRecord is a frame of a capture.
+type CaptureRecord struct {
+	// Direction is the direction of the frame.
+	Direction CaptureDirection
+	// ConnID is the id of the connection, starting at 1 for each Capture.
+	ConnID uint64
+	// Time is the time when the frame has been read or written.
+	Time time.Time
+	// Data is the payload of the frame.
+	Data []byte
+}
+
+// Capture records every message frame of the connections to a writer.
+//
+// The native format starts with the CaptureMagic, followed by the records.
+// A record is the direction byte, which is 0 for read and 1 for write, the
+// connection id as uint64, the timestamp as int64 unix nanoseconds, the length of
+// the payload as uint32, all in big endian, and the payload.
+//
+// The frames are the messages read and written by Messages, and the requests
+// and the responses of ServeData. The raw connections of Serve and ServeConn
+// are not captured.
+type Capture struct {
+	mu     sync.Mutex
+	w      io.Writer
+	pcapng bool
+	conns  uint64
+	seqs   map[uint64]*[2]uint32
+	err    error
+}
+
+// NewCapture returns a new Capture which writes the records to w in the native format.
+func NewCapture(w io.Writer) *Capture {
+	c := &Capture{w: w}
+	_, c.err = io.WriteString(w, CaptureMagic)
+	return c
+}
+
+// Err returns the first error of writing the records.
+func (c *Capture) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Capture) nextConnID() uint64 {
+	return atomic.AddUint64(&c.conns, 1)
+}
+
+func (c *Capture) record(id uint64, direction CaptureDirection, data []byte) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	if c.pcapng {
+		c.err = c.writePacket(id, direction, now, data)
+		return
+	}
+	var header [21]byte
+	header[0] = byte(direction)
+	binary.BigEndian.PutUint64(header[1:], id)
+	binary.BigEndian.PutUint64(header[9:], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint32(header[17:], uint32(len(data)))
+	if _, c.err = c.w.Write(header[:]); c.err == nil {
+		_, c.err = c.w.Write(data)
+	}
+}
+
+// closeConn forgets the sequence numbers of the closed connection.
+func (c *Capture) closeConn(id uint64) {
+	c.mu.Lock()
+	delete(c.seqs, id)
+	c.mu.Unlock()
+}
+
+// Messages returns a Messages which records the frames of the messages as a new connection.
+func (c *Capture) Messages(messages Messages) Messages {
+	return &captureMessages{Messages: messages, capture: c, id: c.nextConnID()}
+}
+
+// Conn returns a Conn whose Messages record the frames as a new connection.
+func (c *Capture) Conn(conn Conn) Conn {
+	return &captureConn{Conn: conn, capture: c, id: c.nextConnID()}
+}
+
+// Listener returns a Listener which records the frames of the connections.
+func (c *Capture) Listener(l Listener) Listener {
+	return &captureListener{l: l, capture: c}
+}
+
+type captureMessages struct {
+	Messages
+	capture *Capture
+	id      uint64
+}
+
+// SetBufferedOutput sets the buffered writer with the buffer size.
+func (m *captureMessages) SetBufferedOutput(writeBufferSize int) {
+	if b, ok := m.Messages.(BufferedOutput); ok {
+		b.SetBufferedOutput(writeBufferSize)
+	}
+}
+
+// SetBufferedInput sets the read buffer size.
+func (m *captureMessages) SetBufferedInput(readBufferSize int) {
+	if b, ok := m.Messages.(BufferedInput); ok {
+		b.SetBufferedInput(readBufferSize)
+	}
+}
+
+func (m *captureMessages) ReadMessage(buf []byte) ([]byte, error) {
+	p, err := m.Messages.ReadMessage(buf)
+	if err == nil {
+		m.capture.record(m.id, CaptureRead, p)
+	} else if err == io.EOF {
+		m.capture.closeConn(m.id)
+	}
+	return p, err
+}
+
+func (m *captureMessages) WriteMessage(b []byte) error {
+	err := m.Messages.WriteMessage(b)
+	if err == nil {
+		m.capture.record(m.id, CaptureWrite, b)
+	}
+	return err
+}
+
+func (m *captureMessages) Close() error {
+	m.capture.closeConn(m.id)
+	return m.Messages.Close()
+}
+
+type captureConn struct {
+	Conn
+	capture *Capture
+	id      uint64
+}
+
+// Messages returns a new Messages.
+func (c *captureConn) Messages() Messages {
+	return &captureMessages{Messages: c.Conn.Messages(), capture: c.capture, id: c.id}
+}
+
+// Close closes the connection.
+func (c *captureConn) Close() error {
+	c.capture.closeConn(c.id)
+	return c.Conn.Close()
+}
+
+type captureListener struct {
+	l       Listener
+	capture *Capture
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *captureListener) Accept() (Conn, error) {
+	conn, err := l.l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.capture.Conn(conn), nil
+}
+
+// Serve serves the netpoll.Handler by the netpoll.
+func (l *captureListener) Serve(handler netpoll.Handler) error {
+	return l.l.Serve(handler)
+}
+
+// ServeData serves the opened func and the serve func by the netpoll.
+func (l *captureListener) ServeData(opened func(net.Conn) error, serve func(req []byte) (res []byte)) error {
+	if serve == nil {
+		return ErrServe
+	}
+	type dataContext struct {
+		Conn net.Conn
+		id   uint64
+		buf  []byte
+	}
+	Upgrade := func(conn net.Conn) (Context, error) {
+		if opened != nil {
+			if err := opened(conn); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		ctx := &dataContext{
+			Conn: conn,
+			id:   l.capture.nextConnID(),
+			buf:  make([]byte, 1024*64),
+		}
+		return ctx, nil
+	}
+	Serve := func(context Context) error {
+		c := context.(*dataContext)
+		n, err := c.Conn.Read(c.buf)
+		if err != nil {
+			if err != netpoll.EAGAIN {
+				l.capture.closeConn(c.id)
+			}
+			return err
+		}
+		l.capture.record(c.id, CaptureRead, c.buf[:n])
+		res := serve(c.buf[:n])
+		if len(res) == 0 {
+			return nil
+		}
+		if _, err = c.Conn.Write(res); err == nil {
+			l.capture.record(c.id, CaptureWrite, res)
+		}
+		return err
+	}
+	return l.l.ServeConn(Upgrade, Serve)
+}
+
+// ServeConn serves the opened func and the serve func by the netpoll.
+func (l *captureListener) ServeConn(opened func(net.Conn) (Context, error), serve func(Context) error) error {
+	return l.l.ServeConn(opened, serve)
+}
+
+// ServeMessages serves the opened func and the serve func by the netpoll.
+func (l *captureListener) ServeMessages(opened func(Messages) (Context, error), serve func(Context) error) error {
+	if opened == nil {
+		return ErrOpened
+	} else if serve == nil {
+		return ErrServe
+	}
+	type messagesContext struct {
+		Context
+		id uint64
+	}
+	return l.l.ServeMessages(func(messages Messages) (Context, error) {
+		m := l.capture.Messages(messages).(*captureMessages)
+		ctx, err := opened(m)
+		if err != nil {
+			l.capture.closeConn(m.id)
+			return nil, err
+		}
+		return &messagesContext{Context: ctx, id: m.id}, nil
+	}, func(context Context) error {
+		c := context.(*messagesContext)
+		err := serve(c.Context)
+		if err != nil && err != netpoll.EAGAIN {
+			// The netpoll closes the connection after the error.
+			l.capture.closeConn(c.id)
+		}
+		return err
+	})
+}
+
+// Close closes the listener.
+func (l *captureListener) Close() error {
+	return l.l.Close()
+}
+
+// Addr returns the listener's network address.
+func (l *captureListener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
+// CaptureReader reads the records of a capture in the native format.
+type CaptureReader struct {
+	// MaxRecordSize is the maximum size of the payload of a record, which is checked
+	// before the payload is allocated. Zero means DefaultMaxCaptureRecordSize.
+	MaxRecordSize int
+
+	r     io.Reader
+	magic bool
+}
+
+// NewCaptureReader returns a new CaptureReader.
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{r: r}
+}
+
+// Next returns the next record, or io.EOF at the end of the capture.
+func (r *CaptureReader) Next() (*CaptureRecord, error) {
+	if !r.magic {
+		magic := make([]byte, len(CaptureMagic))
+		if _, err := io.ReadFull(r.r, magic); err != nil || string(magic) != CaptureMagic {
+			return nil, ErrCaptureFormat
+		}
+		r.magic = true
+	}
+	var header [21]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrCaptureFormat
+		}
+		return nil, err
+	}
+	if header[0] > byte(CaptureWrite) {
+		return nil, ErrCaptureFormat
+	}
+	maxRecordSize := r.MaxRecordSize
+	if maxRecordSize <= 0 {
+		maxRecordSize = DefaultMaxCaptureRecordSize
+	}
+	length := binary.BigEndian.Uint32(header[17:])
+	if uint64(length) > uint64(maxRecordSize) {
+		return nil, ErrCaptureRecordTooBig
+	}
+	record := &CaptureRecord{
+		Direction: CaptureDirection(header[0]),
+		ConnID:    binary.BigEndian.Uint64(header[1:]),
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header[9:]))),
+		Data:      make([]byte, length),
+	}
+	if _, err := io.ReadFull(r.r, record.Data); err != nil {
+		return nil, ErrCaptureFormat
+	}
+	return record, nil
+}
+
+// Replayer feeds the frames of a capture in the native format back through a Messages peer.
+type Replayer struct {
+	// ConnID selects the connection of the capture. Zero selects the connection
+	// of the first record.
+	ConnID uint64
+	// Direction selects the frames written to the peer. It is CaptureRead by default,
+	// which replays the frames the captured side has read from its peer.
+	Direction CaptureDirection
+	// Timing keeps the intervals between the frames if it is true.
+	Timing bool
+}
+
+// Replay writes the selected frames of the capture to the messages.
+// It returns the number of the frames written.
+func (r *Replayer) Replay(capture io.Reader, messages Messages) (n int, err error) {
+	reader := NewCaptureReader(capture)
+	id := r.ConnID
+	var last time.Time
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		if id == 0 {
+			id = record.ConnID
+		}
+		if record.ConnID != id || record.Direction != r.Direction {
+			continue
+		}
+		if r.Timing && !last.IsZero() {
+			time.Sleep(record.Time.Sub(last))
+		}
+		last = record.Time
+		if err := messages.WriteMessage(record.Data); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
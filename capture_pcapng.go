@@ -0,0 +1,131 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	pcapngSectionHeader     = 0x0A0D0D0A
+	pcapngInterface         = 0x00000001
+	pcapngEnhancedPacket    = 0x00000006
+	pcapngByteOrderMagic    = 0x1A2B3C4D
+	pcapngLinkTypeIPv4      = 228
+	pcapngOptionTSResol     = 9
+	pcapngMaxSegmentPayload = 65535 - 40
+)
+
+// NewPcapngCapture returns a new Capture which writes the frames to w in the pcapng format,
+// so that the captures can be analyzed by the tools like Wireshark.
+//
+// The frames are the payloads of the synthetic IPv4 and TCP packets. The captured side
+// is 10.0.0.1:1 and the peer of the connection with the id n is the IPv4 address
+// 10.0.0.1 plus n at the port 2. The frames larger than a packet are split into segments.
+func NewPcapngCapture(w io.Writer) *Capture {
+	c := &Capture{w: w, pcapng: true, seqs: make(map[uint64]*[2]uint32)}
+	// The section header block with an unspecified section length.
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngSectionHeader)
+	binary.LittleEndian.PutUint32(shb[4:], 28)
+	binary.LittleEndian.PutUint32(shb[8:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[12:], 1)
+	binary.LittleEndian.PutUint64(shb[16:], ^uint64(0))
+	binary.LittleEndian.PutUint32(shb[24:], 28)
+	// The interface description block with the nanosecond timestamps.
+	idb := make([]byte, 32)
+	binary.LittleEndian.PutUint32(idb[0:], pcapngInterface)
+	binary.LittleEndian.PutUint32(idb[4:], 32)
+	binary.LittleEndian.PutUint16(idb[8:], pcapngLinkTypeIPv4)
+	binary.LittleEndian.PutUint16(idb[16:], pcapngOptionTSResol)
+	binary.LittleEndian.PutUint16(idb[18:], 1)
+	idb[20] = 9
+	binary.LittleEndian.PutUint32(idb[28:], 32)
+	_, c.err = w.Write(append(shb, idb...))
+	return c
+}
+
+// writePacket writes the data as the enhanced packet blocks of the synthetic packets.
+func (c *Capture) writePacket(id uint64, direction CaptureDirection, now time.Time, data []byte) error {
+	seqs, ok := c.seqs[id]
+	if !ok {
+		seqs = &[2]uint32{}
+		c.seqs[id] = seqs
+	}
+	for {
+		segment := data
+		if len(segment) > pcapngMaxSegmentPayload {
+			segment = segment[:pcapngMaxSegmentPayload]
+		}
+		packet := syntheticPacket(id, direction, seqs, segment)
+		padded := (len(packet) + 3) &^ 3
+		length := 32 + padded
+		block := make([]byte, length)
+		binary.LittleEndian.PutUint32(block[0:], pcapngEnhancedPacket)
+		binary.LittleEndian.PutUint32(block[4:], uint32(length))
+		ts := uint64(now.UnixNano())
+		binary.LittleEndian.PutUint32(block[12:], uint32(ts>>32))
+		binary.LittleEndian.PutUint32(block[16:], uint32(ts))
+		binary.LittleEndian.PutUint32(block[20:], uint32(len(packet)))
+		binary.LittleEndian.PutUint32(block[24:], uint32(len(packet)))
+		copy(block[28:], packet)
+		binary.LittleEndian.PutUint32(block[length-4:], uint32(length))
+		if _, err := c.w.Write(block); err != nil {
+			return err
+		}
+		data = data[len(segment):]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// syntheticPacket returns an IPv4 packet with a TCP segment carrying the payload,
+// and advances the sequence number of the direction.
+func syntheticPacket(id uint64, direction CaptureDirection, seqs *[2]uint32, payload []byte) []byte {
+	local := [4]byte{10, 0, 0, 1}
+	var peer [4]byte
+	binary.BigEndian.PutUint32(peer[:], binary.BigEndian.Uint32(local[:])+uint32(id))
+	src, dst := local, peer
+	srcPort, dstPort := uint16(1), uint16(2)
+	if direction == CaptureRead {
+		src, dst = peer, local
+		srcPort, dstPort = dstPort, srcPort
+	}
+	packet := make([]byte, 40+len(payload))
+	ip := packet[:20]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(packet)))
+	binary.BigEndian.PutUint16(ip[6:], 0x4000)
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:16], src[:])
+	copy(ip[16:20], dst[:])
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+	tcp := packet[20:40]
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seqs[direction])
+	binary.BigEndian.PutUint32(tcp[8:], seqs[1-direction])
+	tcp[12] = 5 << 4
+	tcp[13] = 0x18
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(packet[40:], payload)
+	seqs[direction] += uint32(len(payload))
+	return packet
+}
+
+// checksum returns the internet checksum of the header.
+func checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,241 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	var addr = ":9999"
+	serverCapture, clientCapture := &bytes.Buffer{}, &bytes.Buffer{}
+	server, client := NewCapture(serverCapture), NewCapture(clientCapture)
+	l, err := NewTCPSocket(nil).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = server.Listener(l)
+	go testCaptureEcho(l)
+	conn, err := NewTCPSocket(nil).Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := client.Conn(conn).Messages()
+	for _, msg := range []string{"Hello", "World", ""} {
+		messages.WriteMessage([]byte(msg))
+		if p, err := messages.ReadMessage(nil); err != nil || string(p) != msg {
+			t.Error(string(p), err)
+		}
+	}
+	messages.Close()
+	l.Close()
+	if server.Err() != nil || client.Err() != nil {
+		t.Error(server.Err(), client.Err())
+	}
+	capture := append([]byte{}, serverCapture.Bytes()...)
+	reader := NewCaptureReader(serverCapture)
+	for i := 0; i < 6; i++ {
+		record, err := reader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		direction := CaptureDirection(i % 2)
+		if record.Direction != direction || record.ConnID != 1 || record.Time.IsZero() ||
+			string(record.Data) != []string{"Hello", "World", ""}[i/2] {
+			t.Error(record)
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Error(err)
+	}
+	reader = NewCaptureReader(clientCapture)
+	for i := 0; i < 6; i++ {
+		// The client writes what the server reads.
+		if record, err := reader.Next(); err != nil || record.Direction != CaptureDirection(1-i%2) {
+			t.Error(record, err)
+		}
+	}
+
+	l, err = NewTCPSocket(nil).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go testCaptureEcho(l)
+	conn, err = NewTCPSocket(nil).Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages = conn.Messages()
+	replayer := &Replayer{Timing: true}
+	if n, err := replayer.Replay(bytes.NewReader(capture), messages); err != nil || n != 3 {
+		t.Error(n, err)
+	}
+	for _, msg := range []string{"Hello", "World", ""} {
+		if p, err := messages.ReadMessage(nil); err != nil || string(p) != msg {
+			t.Error(string(p), err)
+		}
+	}
+	replayer = &Replayer{ConnID: 2}
+	if n, err := replayer.Replay(bytes.NewReader(capture), messages); err != nil || n != 0 {
+		t.Error(n, err)
+	}
+	messages.Close()
+	l.Close()
+	if _, err := replayer.Replay(strings.NewReader("SKTCAP00"), messages); err != ErrCaptureFormat {
+		t.Error(err)
+	}
+	if _, err := replayer.Replay(bytes.NewReader(capture[:len(capture)-1]), messages); err != ErrCaptureFormat {
+		t.Error(err)
+	}
+	if _, err := replayer.Replay(bytes.NewReader(capture[:len(CaptureMagic)+1]), messages); err != ErrCaptureFormat {
+		t.Error(err)
+	}
+	reader = NewCaptureReader(bytes.NewReader(capture))
+	reader.MaxRecordSize = 4
+	if _, err := reader.Next(); err != ErrCaptureRecordTooBig {
+		t.Error(err)
+	}
+	tooBig := append([]byte{}, capture[:len(CaptureMagic)+21]...)
+	binary.BigEndian.PutUint32(tooBig[len(CaptureMagic)+17:], DefaultMaxCaptureRecordSize+1)
+	if _, err := NewCaptureReader(bytes.NewReader(tooBig)).Next(); err != ErrCaptureRecordTooBig {
+		t.Error(err)
+	}
+}
+
+func testCaptureEcho(l Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn Conn) {
+			messages := conn.Messages()
+			for {
+				msg, err := messages.ReadMessage(nil)
+				if err != nil {
+					break
+				}
+				messages.WriteMessage(msg)
+			}
+			messages.Close()
+		}(conn)
+	}
+}
+
+func TestCaptureServe(t *testing.T) {
+	buf := &bytes.Buffer{}
+	capture := NewCapture(buf)
+	testSocketServeMessages(&captureSocket{NewTCPSocket(nil), capture}, NewTCPSocket(nil), t)
+	testSocketServeData(&captureSocket{NewTCPSocket(nil), capture}, NewTCPSocket(nil), t)
+	testSocketServeConn(&captureSocket{NewTCPSocket(nil), capture}, NewTCPSocket(nil), t)
+	// The netpoll may still record the frames of the closed listeners.
+	capture.mu.Lock()
+	p := append([]byte{}, buf.Bytes()...)
+	capture.mu.Unlock()
+	reader := NewCaptureReader(bytes.NewReader(p))
+	var ids = make(map[uint64]bool)
+	var n int
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		ids[record.ConnID] = true
+		n++
+	}
+	if len(ids) != 2 || n < 4 {
+		t.Error(ids, n)
+	}
+}
+
+type captureSocket struct {
+	Socket
+	capture *Capture
+}
+
+func (s *captureSocket) Listen(address string) (Listener, error) {
+	l, err := s.Socket.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return s.capture.Listener(l), nil
+}
+
+func TestPcapngCapture(t *testing.T) {
+	buf := &bytes.Buffer{}
+	capture := NewPcapngCapture(buf)
+	server, client := net.Pipe()
+	messages := capture.Messages(NewMessages(server, false))
+	peer := NewMessages(client, false)
+	large := bytes.Repeat([]byte("Hello World"), 7000)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		peer.ReadMessage(nil)
+		peer.WriteMessage([]byte("Hello World"))
+	}()
+	messages.WriteMessage(large)
+	messages.ReadMessage(nil)
+	wg.Wait()
+	if len(capture.seqs) != 1 {
+		t.Error(len(capture.seqs))
+	}
+	messages.Close()
+	peer.Close()
+	if len(capture.seqs) != 0 {
+		t.Error("the sequence numbers of the closed connection are kept")
+	}
+	if capture.Err() != nil {
+		t.Fatal(capture.Err())
+	}
+	p := buf.Bytes()
+	var blocks []uint32
+	var payloads [][]byte
+	for len(p) > 0 {
+		if len(p) < 12 {
+			t.Fatal(len(p))
+		}
+		kind, length := binary.LittleEndian.Uint32(p), binary.LittleEndian.Uint32(p[4:])
+		if length%4 != 0 || int(length) > len(p) || binary.LittleEndian.Uint32(p[length-4:]) != length {
+			t.Fatal(length)
+		}
+		blocks = append(blocks, kind)
+		if kind == pcapngEnhancedPacket {
+			packet := p[28 : 28+binary.LittleEndian.Uint32(p[20:])]
+			if checksum(packet[:20]) != 0 || int(binary.BigEndian.Uint16(packet[2:])) != len(packet) {
+				t.Error("invalid IPv4 header")
+			}
+			payloads = append(payloads, packet[40:])
+		}
+		p = p[length:]
+	}
+	if len(blocks) != 5 || blocks[0] != pcapngSectionHeader || blocks[1] != pcapngInterface {
+		t.Fatal(blocks)
+	}
+	if !bytes.Equal(append(append([]byte{}, payloads[0]...), payloads[1]...), large) || string(payloads[2]) != "Hello World" {
+		t.Error(len(payloads[0]), len(payloads[1]), string(payloads[2]))
+	}
+	if _, err := NewPcapngCapture(errorWriter{}).Messages(peer).ReadMessage(nil); err == nil {
+		t.Error("should be closed")
+	}
+	if NewPcapngCapture(errorWriter{}).Err() == nil {
+		t.Error("should be failed")
+	}
+}
+
+type errorWriter struct{}
+
+func (errorWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write error")
+}
@@ -0,0 +1,301 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultReloadInterval is the default interval to check the certificate files.
+const DefaultReloadInterval = time.Second * 10
+
+// ErrCertificateExpired is the error when a certificate is not valid at the current time.
+var ErrCertificateExpired = errors.New("certificate is expired or not yet valid")
+
+// ErrNoClientCAs is the error when the client CA data has no certificates.
+var ErrNoClientCAs = errors.New("no client CA certificates")
+
+// CertificateManager holds a certificate and swaps it atomically when it is updated
+// or when its files change. The certificate is served by GetCertificate and
+// GetClientCertificate, so the TLS config of any Socket can use a CertificateManager.
+// The client CAs of a server can be reloaded too, and are served by the
+// GetConfigForClient of the config returned by TLSConfig.
+type CertificateManager struct {
+	certificate  atomic.Value
+	clientCAs    atomic.Value
+	updating     sync.Mutex
+	mu           sync.Mutex
+	certFile     string
+	keyFile      string
+	caFile       string
+	certPEM      []byte
+	keyPEM       []byte
+	caPEM        []byte
+	certErr      error
+	caErr        error
+	errorHandler func(err error)
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewCertificateManager returns a new CertificateManager by the certificate data and the key data.
+func NewCertificateManager(certPEM, keyPEM []byte) (*CertificateManager, error) {
+	m := &CertificateManager{done: make(chan struct{})}
+	if err := m.Update(certPEM, keyPEM); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LoadCertificateManager returns a new CertificateManager by loading the certificate file
+// and the key file, which are checked for changes every interval. Zero interval means
+// DefaultReloadInterval, and a negative interval disables the checks.
+func LoadCertificateManager(certFile, keyFile string, interval time.Duration) (*CertificateManager, error) {
+	m := &CertificateManager{certFile: certFile, keyFile: keyFile, done: make(chan struct{})}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	if interval == 0 {
+		interval = DefaultReloadInterval
+	}
+	if interval > 0 {
+		go m.watch(interval)
+	}
+	return m, nil
+}
+
+func (m *CertificateManager) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.Reload()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// Reload loads the certificate file, the key file and the client CA file, and applies
+// them if they have changed.
+func (m *CertificateManager) Reload() error {
+	m.mu.Lock()
+	certFile, keyFile, caFile := m.certFile, m.keyFile, m.caFile
+	m.mu.Unlock()
+	if certFile != "" {
+		certPEM, err := ioutil.ReadFile(certFile)
+		if err == nil {
+			var keyPEM []byte
+			keyPEM, err = ioutil.ReadFile(keyFile)
+			if err == nil {
+				err = m.Update(certPEM, keyPEM)
+			}
+		}
+		if err != nil {
+			m.report(&m.certErr, err)
+			return err
+		}
+	}
+	if caFile != "" {
+		caPEM, err := ioutil.ReadFile(caFile)
+		if err == nil {
+			err = m.UpdateClientCAs(caPEM)
+		}
+		if err != nil {
+			m.report(&m.caErr, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Update validates the certificate data and the key data, and applies them if they are valid.
+// Otherwise the current certificate is kept and the error is reported.
+// The certificate and its key are swapped together as one *tls.Certificate.
+func (m *CertificateManager) Update(certPEM, keyPEM []byte) error {
+	m.updating.Lock()
+	defer m.updating.Unlock()
+	m.mu.Lock()
+	unchanged := bytes.Equal(certPEM, m.certPEM) && bytes.Equal(keyPEM, m.keyPEM) && m.certErr == nil
+	m.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+	cert, err := parseCertificate(certPEM, keyPEM)
+	if err != nil {
+		m.report(&m.certErr, err)
+		return err
+	}
+	m.certificate.Store(cert)
+	m.mu.Lock()
+	m.certPEM, m.keyPEM, m.certErr = certPEM, keyPEM, nil
+	m.mu.Unlock()
+	return nil
+}
+
+// LoadClientCAs loads the client CA file, which is checked for changes with the
+// certificate files.
+func (m *CertificateManager) LoadClientCAs(caFile string) error {
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		m.report(&m.caErr, err)
+		return err
+	}
+	if err := m.UpdateClientCAs(caPEM); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.caFile = caFile
+	m.mu.Unlock()
+	return nil
+}
+
+// UpdateClientCAs validates the client CA data, and applies it if it is valid.
+// Otherwise the current client CAs are kept and the error is reported.
+func (m *CertificateManager) UpdateClientCAs(caPEM []byte) error {
+	m.updating.Lock()
+	defer m.updating.Unlock()
+	m.mu.Lock()
+	unchanged := bytes.Equal(caPEM, m.caPEM) && m.caErr == nil
+	m.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		m.report(&m.caErr, ErrNoClientCAs)
+		return ErrNoClientCAs
+	}
+	m.clientCAs.Store(pool)
+	m.mu.Lock()
+	m.caPEM, m.caErr = caPEM, nil
+	m.mu.Unlock()
+	return nil
+}
+
+// parseCertificate parses a certificate and checks that it matches the key and is valid now.
+func parseCertificate(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return nil, ErrCertificateExpired
+	}
+	cert.Leaf = leaf
+	return &cert, nil
+}
+
+// report records the error of the certificate or of the client CAs, and passes it
+// to the error handler.
+func (m *CertificateManager) report(target *error, err error) {
+	m.mu.Lock()
+	*target = err
+	handler := m.errorHandler
+	m.mu.Unlock()
+	if handler != nil {
+		handler(err)
+	}
+}
+
+// SetErrorHandler sets the handler of the errors of the reloads and the updates.
+func (m *CertificateManager) SetErrorHandler(handler func(err error)) {
+	m.mu.Lock()
+	m.errorHandler = handler
+	m.mu.Unlock()
+}
+
+// Err returns the error of the last reload or update of the certificate, or else
+// the error of the last reload or update of the client CAs, or nil if both succeeded.
+// The errors are kept apart, so that a successful update of one of them does not
+// clear the error of the other.
+func (m *CertificateManager) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.certErr != nil {
+		return m.certErr
+	}
+	return m.caErr
+}
+
+// Certificate returns the current certificate.
+func (m *CertificateManager) Certificate() *tls.Certificate {
+	return m.certificate.Load().(*tls.Certificate)
+}
+
+// ClientCAs returns the current client CAs, or nil if they have not been loaded.
+func (m *CertificateManager) ClientCAs() *x509.CertPool {
+	pool, _ := m.clientCAs.Load().(*x509.CertPool)
+	return pool
+}
+
+// GetCertificate returns the current certificate for the tls.Config GetCertificate field.
+func (m *CertificateManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.Certificate(), nil
+}
+
+// GetClientCertificate returns the current certificate for the tls.Config GetClientCertificate field.
+func (m *CertificateManager) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return m.Certificate(), nil
+}
+
+// TLSConfig returns a copy of the base config which presents the current certificate
+// as a server and as a client. A nil base means an empty config. If the client CAs
+// have been loaded, the server verifies the client certificates by the current client CAs.
+// The configs for the clients are copied from the base, so the fields are set on the base
+// rather than on the returned config, except for the NextProtos option of a socket.
+func (m *CertificateManager) TLSConfig(base *tls.Config) *tls.Config {
+	var config *tls.Config
+	if base == nil {
+		config = &tls.Config{}
+	} else {
+		config = base.Clone()
+	}
+	config.Certificates = nil
+	config.GetCertificate = m.GetCertificate
+	config.GetClientCertificate = m.GetClientCertificate
+	config.GetConfigForClient = nil
+	config.GetConfigForClient = m.getConfigForClient(config.Clone())
+	return config
+}
+
+// getConfigForClient returns the GetConfigForClient function which serves the config
+// with the current client CAs. The config is cloned once per update of the client CAs.
+func (m *CertificateManager) getConfigForClient(config *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	var mu sync.Mutex
+	var current *tls.Config
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pool := m.ClientCAs()
+		if pool == nil {
+			return nil, nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if current == nil || current.ClientCAs != pool {
+			current = config.Clone()
+			current.ClientCAs = pool
+		}
+		return current, nil
+	}
+}
+
+// Close stops checking the files.
+func (m *CertificateManager) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+	return nil
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCertificateManager(t *testing.T) {
+	var certFileName = "tmpTestReloadCertFile"
+	var keyFileName = "tmpTestReloadKeyFile"
+	defer os.Remove(certFileName)
+	defer os.Remove(keyFileName)
+	ioutil.WriteFile(certFileName, DefaultServerCertPEM, 0600)
+	ioutil.WriteFile(keyFileName, DefaultServerKeyPEM, 0600)
+	if _, err := LoadCertificateManager(certFileName, "", -1); err == nil {
+		t.Error("should be no such file or directory")
+	}
+	m, err := LoadCertificateManager(certFileName, keyFileName, time.Millisecond*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	errs := make(chan error, 64)
+	m.SetErrorHandler(func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	var addr = ":9999"
+	l, err := NewTCPSocket(m.TLSConfig(nil)).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte{0})
+			conn.Close()
+		}
+	}()
+	commonName := func() string {
+		conn, err := NewTCPSocket(SkipVerifyTLSConfig()).Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return TLSConnOf(conn).ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if cn := commonName(); cn != "servername" {
+		t.Error(cn)
+	}
+	wait := func(ok func() bool) {
+		for i := 0; i < 500 && !ok(); i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	ioutil.WriteFile(keyFileName, []byte("invalid"), 0600)
+	select {
+	case <-errs:
+	case <-time.After(time.Second * 5):
+		t.Error("should report the reload error")
+	}
+	if m.Err() == nil {
+		t.Error("should be failed to find any PEM data in key input")
+	}
+	if cn := commonName(); cn != "servername" {
+		t.Error(cn)
+	}
+	_, certPEM, keyPEM := testClientCertificate(t)
+	ioutil.WriteFile(certFileName, certPEM, 0600)
+	ioutil.WriteFile(keyFileName, keyPEM, 0600)
+	wait(func() bool { return m.Err() == nil })
+	if cn := commonName(); cn != "client" {
+		t.Error(cn)
+	}
+	if err := m.Update(DefaultServerCertPEM, keyPEM); err == nil {
+		t.Error("should be private key does not match public key")
+	}
+	if err := m.Update(DefaultServerCertPEM, DefaultServerKeyPEM); err != nil {
+		t.Error(err)
+	}
+	if cn := m.Certificate().Leaf.Subject.CommonName; cn != "servername" {
+		t.Error(cn)
+	}
+	l.Close()
+}
+
+func TestNewCertificateManager(t *testing.T) {
+	if _, err := NewCertificateManager(DefaultServerCertPEM, nil); err == nil {
+		t.Error("should be failed to find any PEM data in key input")
+	}
+	m, err := NewCertificateManager(DefaultServerCertPEM, DefaultServerKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	base := DefalutClientTLSConfig()
+	config := m.TLSConfig(base)
+	if config == base || config.RootCAs != base.RootCAs || config.GetClientCertificate == nil {
+		t.Error(config)
+	}
+	if cert, _ := config.GetCertificate(nil); cert != m.Certificate() {
+		t.Error(cert)
+	}
+}
+
+func TestCertificateManagerClientCAs(t *testing.T) {
+	var caFileName = "tmpTestReloadCAFile"
+	os.Remove(caFileName)
+	defer os.Remove(caFileName)
+	caPEM, certPEM, keyPEM := testClientCertificate(t)
+	otherCAPEM, _, _ := testClientCertificate(t)
+	m, err := NewCertificateManager(DefaultServerCertPEM, DefaultServerKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.ClientCAs() != nil {
+		t.Error("should be no client CAs")
+	}
+	if err := m.LoadClientCAs(caFileName); err == nil {
+		t.Error("should be no such file or directory")
+	}
+	ioutil.WriteFile(caFileName, caPEM, 0600)
+	if err := m.LoadClientCAs(caFileName); err != nil {
+		t.Fatal(err)
+	}
+	var addr = ":9999"
+	serverSock := &TCP{
+		Config:  m.TLSConfig(&tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}),
+		Options: Options{NextProtos: []string{"h2"}},
+	}
+	l, err := serverSock.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if e, ok := err.(*net.OpError); ok && e.Op == "accept" {
+					return
+				}
+				// The client certificate is rejected.
+				continue
+			}
+			conn.Write([]byte{0})
+			conn.Close()
+		}
+	}()
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig := SkipVerifyTLSConfig()
+	clientConfig.Certificates = []tls.Certificate{cert}
+	clientConfig.NextProtos = []string{"h2"}
+	verified := func() bool {
+		conn, err := NewTCPSocket(clientConfig).Dial(addr)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		_, err = conn.Read(make([]byte, 1))
+		if err == nil && NegotiatedProtocolOf(conn) != "h2" {
+			// The config for the client keeps the NextProtos of the listener.
+			t.Error("ALPN is dropped with the client CAs")
+		}
+		return err == nil
+	}
+	if !verified() {
+		t.Error("should be verified by the client CA")
+	}
+	if err := m.UpdateClientCAs([]byte("invalid")); err != ErrNoClientCAs {
+		t.Error(err)
+	}
+	if !verified() {
+		t.Error("should keep the client CA")
+	}
+	ioutil.WriteFile(caFileName, otherCAPEM, 0600)
+	if err := m.Reload(); err != nil {
+		t.Error(err)
+	}
+	if verified() {
+		t.Error("should be signed by unknown authority")
+	}
+	if err := m.UpdateClientCAs(caPEM); err != nil {
+		t.Error(err)
+	}
+	if !verified() {
+		t.Error("should be verified by the client CA")
+	}
+	l.Close()
+}
+
+func TestCertificateManagerErrors(t *testing.T) {
+	m, err := NewCertificateManager(DefaultServerCertPEM, DefaultServerKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	cert := m.Certificate()
+	if err := m.UpdateClientCAs([]byte("invalid")); err != ErrNoClientCAs {
+		t.Error(err)
+	}
+	if err := m.Update(DefaultServerCertPEM, DefaultServerKeyPEM); err != nil {
+		t.Error(err)
+	}
+	if m.Certificate() != cert {
+		// The error of the client CAs does not force a re-parse of the certificate.
+		t.Error("should skip the unchanged certificate")
+	}
+	if m.Err() != ErrNoClientCAs {
+		t.Errorf("%v != %v", m.Err(), ErrNoClientCAs)
+	}
+	if err := m.Update([]byte("invalid"), DefaultServerKeyPEM); err == nil {
+		t.Error("should fail to parse the certificate")
+	}
+	if err := m.Update(DefaultServerCertPEM, DefaultServerKeyPEM); err != nil {
+		t.Error(err)
+	}
+	if m.Err() != ErrNoClientCAs {
+		t.Errorf("%v != %v", m.Err(), ErrNoClientCAs)
+	}
+	if m.Certificate() == cert {
+		t.Error("should re-parse the certificate after its error")
+	}
+	if err := m.UpdateClientCAs(DefaultServerCertPEM); err != nil {
+		t.Error(err)
+	}
+	if m.Err() != nil {
+		t.Error(m.Err())
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/hslam/buffer"
+	"sort"
+)
+
+// ErrEnvelope is the error returned when the envelope of a message is malformed.
+var ErrEnvelope = errors.New("malformed message envelope")
+
+// Metadata is the key/value metadata carried by the envelope of a message.
+// It implements the TextMapCarrier interface of OpenTelemetry.
+type Metadata map[string]string
+
+// Get returns the value of the key.
+func (md Metadata) Get(key string) string {
+	return md[key]
+}
+
+// Set sets the value of the key.
+func (md Metadata) Set(key, value string) {
+	md[key] = value
+}
+
+// Keys returns the sorted keys.
+func (md Metadata) Keys() []string {
+	keys := make([]string, 0, len(md))
+	for key := range md {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Propagator injects a context into the metadata of the messages written and
+// extracts it from the metadata of the messages read, such as a trace context.
+type Propagator interface {
+	// Inject sets the values of the context into the metadata.
+	Inject(ctx context.Context, md Metadata)
+	// Extract returns a copy of ctx with the values of the metadata.
+	Extract(ctx context.Context, md Metadata) context.Context
+}
+
+type outgoingMetadataKey struct{}
+
+type incomingMetadataKey struct{}
+
+// WithMetadata returns a copy of ctx with the metadata, which is written with the
+// message by WriteMessageContext.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, outgoingMetadataKey{}, md)
+}
+
+// MetadataOf returns the metadata of the message read by ReadMessageContext,
+// or nil if there is none.
+func MetadataOf(ctx context.Context) Metadata {
+	md, _ := ctx.Value(incomingMetadataKey{}).(Metadata)
+	return md
+}
+
+// EnvelopeMessages reads and writes messages in envelopes, which carry the headers
+// and the metadata before the payload of a message.
+type EnvelopeMessages interface {
+	Messages
+	// ReadMessageContext reads single message frame and returns a copy of ctx with
+	// the metadata of the message and the context extracted by the propagator.
+	ReadMessageContext(ctx context.Context, buf []byte) (context.Context, []byte, error)
+	// WriteMessageContext writes data as a message frame with the metadata of ctx
+	// and the context injected by the propagator.
+	WriteMessageContext(ctx context.Context, b []byte) error
+	// ReadMessageWithHeaders reads single message frame and returns its headers.
+	ReadMessageWithHeaders(buf []byte) (Headers, []byte, error)
+	// WriteMessageWithHeaders writes data as a message frame with the headers.
+	WriteMessageWithHeaders(headers Headers, b []byte) error
+}
+
+// NewEnvelopeMessages returns a new EnvelopeMessages which reads and writes the messages
+// in envelopes by the messages. The propagator may be nil.
+//
+// The payload of every message frame starts with a flag byte written by the envelope,
+// so the envelope mode is chosen per connection and both peers of a connection use
+// NewEnvelopeMessages, while the connections of the peers of NewMessages keep the plain
+// messages. The flag of a message without headers is 0 and is followed by the message.
+// The flag of a message with headers is 1 and is followed by the varint length of the
+// headers, which are encoded compactly as the keys, the types and the values, then by
+// the message. The metadata are the headers of the string values.
+func NewEnvelopeMessages(messages Messages, propagator Propagator) EnvelopeMessages {
+	return &envelopeMessages{Messages: messages, propagator: propagator}
+}
+
+// The flags which start the payload of a message frame in an envelope.
+const (
+	envelopeNoHeaders byte = 0
+	envelopeHeaders   byte = 1
+)
+
+type envelopeMessages struct {
+	Messages
+	propagator Propagator
+}
+
+// SetBufferedOutput sets the buffered writer with the buffer size.
+func (m *envelopeMessages) SetBufferedOutput(writeBufferSize int) {
+	if b, ok := m.Messages.(BufferedOutput); ok {
+		b.SetBufferedOutput(writeBufferSize)
+	}
+}
+
+// SetBufferedInput sets the read buffer size.
+func (m *envelopeMessages) SetBufferedInput(readBufferSize int) {
+	if b, ok := m.Messages.(BufferedInput); ok {
+		b.SetBufferedInput(readBufferSize)
+	}
+}
+
+func (m *envelopeMessages) ReadMessage(buf []byte) ([]byte, error) {
+	_, p, err := m.read(buf)
+	return p, err
+}
+
+func (m *envelopeMessages) ReadMessageWithHeaders(buf []byte) (Headers, []byte, error) {
+	return m.read(buf)
+}
+
+func (m *envelopeMessages) ReadMessageContext(ctx context.Context, buf []byte) (context.Context, []byte, error) {
+	h, p, err := m.read(buf)
+	if err != nil {
+		return ctx, nil, err
+	}
+	var md Metadata
+	for key, value := range h {
+		if s, ok := value.(string); ok {
+			if md == nil {
+				md = make(Metadata)
+			}
+			md[key] = s
+		}
+	}
+	if md != nil {
+		ctx = context.WithValue(ctx, incomingMetadataKey{}, md)
+		if m.propagator != nil {
+			ctx = m.propagator.Extract(ctx, md)
+		}
+	}
+	return ctx, p, nil
+}
+
+func (m *envelopeMessages) read(buf []byte) (Headers, []byte, error) {
+	p, err := m.Messages.ReadMessage(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(p) == 0 {
+		return nil, nil, ErrEnvelope
+	}
+	switch p[0] {
+	case envelopeNoHeaders:
+		return nil, p[1:], nil
+	case envelopeHeaders:
+	default:
+		return nil, nil, ErrEnvelope
+	}
+	header, body, ok := readField(p[1:])
+	if !ok {
+		return nil, nil, ErrEnvelope
+	}
+	if len(header) == 0 {
+		return nil, body, nil
+	}
+	h, err := parseHeaders(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, body, nil
+}
+
+func (m *envelopeMessages) WriteMessage(b []byte) error {
+	return m.write(nil, b)
+}
+
+func (m *envelopeMessages) WriteMessageWithHeaders(headers Headers, b []byte) error {
+	return m.write(headers, b)
+}
+
+func (m *envelopeMessages) WriteMessageContext(ctx context.Context, b []byte) error {
+	md, _ := ctx.Value(outgoingMetadataKey{}).(Metadata)
+	if m.propagator != nil {
+		injected := make(Metadata, len(md))
+		for key, value := range md {
+			injected[key] = value
+		}
+		m.propagator.Inject(ctx, injected)
+		md = injected
+	}
+	var h Headers
+	if len(md) > 0 {
+		h = make(Headers, len(md))
+		for key, value := range md {
+			h[key] = value
+		}
+	}
+	return m.write(h, b)
+}
+
+func (m *envelopeMessages) write(h Headers, b []byte) error {
+	var header []byte
+	if len(h) > 0 {
+		var err error
+		if header, err = appendHeaders(nil, h); err != nil {
+			return err
+		}
+	}
+	size := 1 + binary.MaxVarintLen64 + len(header) + len(b)
+	buf := buffer.GetBuffer(size)
+	defer buffer.PutBuffer(buf)
+	p := append(buf[:0], envelopeNoHeaders)
+	if len(header) > 0 {
+		p[0] = envelopeHeaders
+		p = appendUvarint(p, uint64(len(header)))
+		p = append(p, header...)
+	}
+	p = append(p, b...)
+	return m.Messages.WriteMessage(p)
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestEnvelopeMessages(t *testing.T) {
+	server, client := net.Pipe()
+	serverMessages := NewEnvelopeMessages(NewMessages(server, false), TraceContextPropagator{})
+	clientMessages := NewEnvelopeMessages(NewMessages(client, true), TraceContextPropagator{})
+	ctx := WithTraceContext(context.Background(), TraceContext{TraceParent: testTraceParent, Baggage: "user=1"})
+	ctx = WithMetadata(ctx, Metadata{"content-type": "text/plain", "": "empty"})
+	go func() {
+		clientMessages.WriteMessageContext(ctx, []byte("Hello World"))
+		clientMessages.WriteMessage([]byte("Hello World"))
+		clientMessages.WriteMessageContext(context.Background(), nil)
+		clientMessages.WriteMessage([]byte("\x01\x02\x03k"))
+		for _, p := range []string{"", "\x02Hello World", "\x01\x05\x01", "\x01\x02\x03k"} {
+			clientMessages.(*envelopeMessages).Messages.WriteMessage([]byte(p))
+		}
+	}()
+	readCtx, msg, err := serverMessages.ReadMessageContext(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(msg) != "Hello World" {
+		t.Error(string(msg))
+	}
+	if md := MetadataOf(readCtx); !reflect.DeepEqual(md, Metadata{"content-type": "text/plain", "": "empty",
+		TraceParentKey: testTraceParent, BaggageKey: "user=1"}) {
+		t.Error(md)
+	}
+	if tc, ok := TraceContextOf(readCtx); !ok || tc.TraceParent != testTraceParent || tc.Baggage != "user=1" || tc.TraceState != "" {
+		t.Error(tc)
+	}
+	readCtx, msg, err = serverMessages.ReadMessageContext(context.Background(), make([]byte, 64))
+	if err != nil {
+		t.Error(err)
+	} else if string(msg) != "Hello World" || MetadataOf(readCtx) != nil {
+		t.Error(string(msg), MetadataOf(readCtx))
+	}
+	if msg, err := serverMessages.ReadMessage(nil); err != nil || len(msg) != 0 {
+		t.Error(msg, err)
+	}
+	if msg, err := serverMessages.ReadMessage(nil); err != nil || string(msg) != "\x01\x02\x03k" {
+		t.Error(msg, err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := serverMessages.ReadMessage(nil); err != ErrEnvelope {
+			t.Error(err)
+		}
+	}
+	serverMessages.Close()
+	clientMessages.Close()
+}
+
+func TestEnvelopeMessagesFrames(t *testing.T) {
+	server, client := net.Pipe()
+	plainPeer := NewMessages(server, false)
+	envelopePeer := NewEnvelopeMessages(NewMessages(client, false), TraceContextPropagator{})
+	go func() {
+		envelopePeer.WriteMessage([]byte("Hello World"))
+		envelopePeer.WriteMessageContext(context.Background(), []byte("\x01Hello World"))
+		envelopePeer.WriteMessageWithHeaders(Headers{"type": int64(1)}, []byte("Hello World"))
+	}()
+	// The flag byte is written by the envelope, whatever the message starts with.
+	for _, expect := range []string{"\x00Hello World", "\x00\x01Hello World", "\x01\x07\x04type\x03\x02Hello World"} {
+		if msg, err := plainPeer.ReadMessage(nil); err != nil {
+			t.Fatal(err)
+		} else if string(msg) != expect {
+			t.Errorf("%q", msg)
+		}
+	}
+	go func() {
+		plainPeer.WriteMessage([]byte("\x00\xffENVHello World"))
+		plainPeer.WriteMessage([]byte("\x00\x01\x05\x01"))
+	}()
+	for _, expect := range []string{"\xffENVHello World", "\x01\x05\x01"} {
+		h, msg, err := envelopePeer.ReadMessageWithHeaders(nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(msg) != expect || h != nil {
+			t.Errorf("%q %v", msg, h)
+		}
+	}
+	plainPeer.Close()
+	envelopePeer.Close()
+}
+
+func TestTraceContextPropagator(t *testing.T) {
+	for traceParent, valid := range map[string]bool{
+		testTraceParent: true,
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01": false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01": false,
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01": false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7":    false,
+		"": false,
+	} {
+		md := Metadata{}
+		TraceContextPropagator{}.Inject(WithTraceContext(context.Background(), TraceContext{TraceParent: traceParent, TraceState: "a=b"}), md)
+		if _, ok := md[TraceParentKey]; ok != valid {
+			t.Error(traceParent, md)
+		}
+		_, ok := TraceContextOf(TraceContextPropagator{}.Extract(context.Background(), Metadata{TraceParentKey: traceParent}))
+		if ok != valid {
+			t.Error(traceParent)
+		}
+	}
+	md := Metadata{}
+	TraceContextPropagator{}.Inject(context.Background(), md)
+	if len(md) != 0 {
+		t.Error(md)
+	}
+	md = Metadata{"b": "2", "a": "1"}
+	if keys := md.Keys(); !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Error(keys)
+	}
+}
+
+func TestEnvelopeServeMessages(t *testing.T) {
+	var addr = ":9999"
+	l, err := NewTCPSocket(nil).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		l.ServeMessages(func(messages Messages) (Context, error) {
+			return NewEnvelopeMessages(messages, TraceContextPropagator{}), nil
+		}, func(c Context) error {
+			messages := c.(EnvelopeMessages)
+			ctx, msg, err := messages.ReadMessageContext(context.Background(), nil)
+			if err != nil {
+				return err
+			}
+			tc, _ := TraceContextOf(ctx)
+			return messages.WriteMessageContext(WithMetadata(ctx, Metadata{"parent": tc.TraceParent}), msg)
+		})
+	}()
+	conn, err := NewTCPSocket(nil).Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := NewEnvelopeMessages(conn.Messages(), TraceContextPropagator{})
+	messages.(BufferedOutput).SetBufferedOutput(bufferSize)
+	messages.(BufferedInput).SetBufferedInput(bufferSize)
+	if TLSConnOf(messages) != nil {
+		t.Error("should be nil")
+	}
+	out := WithTraceContext(context.Background(), TraceContext{TraceParent: testTraceParent})
+	if err := messages.WriteMessageContext(out, []byte("Hello World")); err != nil {
+		t.Error(err)
+	}
+	in, msg, err := messages.ReadMessageContext(context.Background(), nil)
+	if err != nil {
+		t.Error(err)
+	} else if string(msg) != "Hello World" {
+		t.Error(string(msg))
+	}
+	if md := MetadataOf(in); md.Get("parent") != testTraceParent {
+		t.Error(md)
+	}
+	messages.Close()
+	l.Close()
+	wg.Wait()
+}
@@ -6,6 +6,5 @@ require (
 	github.com/hslam/buffer v0.0.0-20230217202846-e7b1b6ebf283
 	github.com/hslam/inproc v0.0.0-20210912032833-46957e53529f
 	github.com/hslam/netpoll v0.0.4-0.20230514092318-c286d2b379aa
-	github.com/hslam/websocket v0.1.1-0.20230517135840-2d09ff61bbdb
 	github.com/hslam/writer v1.0.1-0.20230517134517-171bf4321917
 )
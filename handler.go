@@ -0,0 +1,111 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"net/http"
+)
+
+// Handler is an http.Handler that hijacks the matching requests into Conns,
+// which are delivered through its Listener methods. It allows the HTTP and WS
+// sockets to be mounted on an existing net/http server.
+type Handler interface {
+	http.Handler
+	Listener
+	// SetAuthenticator sets the Authenticator of the requests.
+	SetAuthenticator(a Authenticator)
+}
+
+// HTTPHandler returns a Handler that hijacks the CONNECT requests to the path.
+// An empty path matches any.
+func HTTPHandler(path string) Handler {
+	return &httpHandler{
+		queueListener: newQueueListener(&handlerAddr{network: "http", path: path}, false),
+		path:          path,
+	}
+}
+
+type httpHandler struct {
+	*queueListener
+	path          string
+	authenticator Authenticator
+}
+
+// SetAuthenticator sets the Authenticator of the requests.
+func (h *httpHandler) SetAuthenticator(a Authenticator) {
+	h.authenticator = a
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !matchHTTPRoute("", h.path, r) {
+		http.NotFound(w, r)
+		return
+	}
+	if h.q.closed() {
+		http.Error(w, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	conn := upgradeHTTP(w, r, h.authenticator)
+	if conn == nil {
+		return
+	}
+	if !h.q.deliver(conn) {
+		conn.Close()
+	}
+}
+
+// WSHandler returns a Handler that upgrades the WebSocket requests to the path.
+// An empty path matches any.
+func WSHandler(path string) Handler {
+	return &wsHandler{
+		queueListener: newQueueListener(&handlerAddr{network: "ws", path: path}, true),
+		upgrader:      &wsUpgrader{path: path},
+	}
+}
+
+type wsHandler struct {
+	*queueListener
+	upgrader *wsUpgrader
+}
+
+// SetAuthenticator sets the Authenticator of the requests.
+func (h *wsHandler) SetAuthenticator(a Authenticator) {
+	h.upgrader.authenticator = a
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h *wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !matchHTTPRoute("", h.upgrader.path, r) {
+		http.NotFound(w, r)
+		return
+	}
+	if h.q.closed() {
+		http.Error(w, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	conn, err := h.upgrader.upgrade(w, r)
+	if err != nil {
+		return
+	}
+	if !h.q.deliver(conn) {
+		conn.Close()
+	}
+}
+
+// handlerAddr is the net.Addr of a Handler, which has no address of its own.
+type handlerAddr struct {
+	network string
+	path    string
+}
+
+// Network returns the address's network name.
+func (a *handlerAddr) Network() string {
+	return a.network
+}
+
+// String returns the path of the handler.
+func (a *handlerAddr) String() string {
+	return a.path
+}
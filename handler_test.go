@@ -0,0 +1,159 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	testHandler(HTTPHandler("/socket"), &HTTP{Path: "/socket"}, "/socket", t)
+	testHandler(WSHandler(WSPath), NewWSSocket(nil), WSPath, t)
+}
+
+func testHandler(handler Handler, clientSock Socket, path string, t *testing.T) {
+	var addr = ":9999"
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, handler)
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	server := &http.Server{Handler: mux}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(lis)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		handler.ServeMessages(func(messages Messages) (Context, error) {
+			return messages, nil
+		}, func(context Context) error {
+			messages := context.(Messages)
+			msg, err := messages.ReadMessage(nil)
+			if err != nil {
+				return err
+			}
+			return messages.WriteMessage(msg)
+		})
+	}()
+	resp, err := http.Get("http://127.0.0.1" + addr + "/health")
+	if err != nil {
+		t.Error(err)
+	} else {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "ok" {
+			t.Error(string(body))
+		}
+	}
+	conn, err := clientSock.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := conn.Messages()
+	str := strings.Repeat("Hello World", 50)
+	messages.WriteMessage([]byte(str))
+	if msg, err := messages.ReadMessage(nil); err != nil {
+		t.Error(err)
+	} else if string(msg) != str {
+		t.Errorf("error %s != %s", string(msg), str)
+	}
+	messages.Close()
+	handler.Addr()
+	handler.Close()
+	if _, err := clientSock.Dial(addr); err == nil {
+		t.Error("should be unexpected HTTP response: 503 Service Unavailable")
+	}
+	server.Close()
+	wg.Wait()
+}
+
+func TestHandlerAccept(t *testing.T) {
+	handler := HTTPHandler("/socket")
+	var addr = ":9999"
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Serve(lis)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := handler.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn Conn) {
+				messages := conn.Messages()
+				for {
+					msg, err := messages.ReadMessage(nil)
+					if err != nil {
+						break
+					}
+					messages.WriteMessage(msg)
+				}
+				messages.Close()
+			}(conn)
+		}
+	}()
+	if _, err := (&HTTP{Path: "/other"}).Dial(addr); err == nil {
+		t.Error("should be unexpected HTTP response: 404 Not Found")
+	}
+	conn, err := (&HTTP{Path: "/socket"}).Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := conn.Messages()
+	str := "Hello World"
+	messages.WriteMessage([]byte(str))
+	if msg, err := messages.ReadMessage(nil); err != nil {
+		t.Error(err)
+	} else if string(msg) != str {
+		t.Errorf("error %s != %s", string(msg), str)
+	}
+	messages.Close()
+	handler.Close()
+	server.Close()
+	wg.Wait()
+}
+
+func TestHandlerNotHijacker(t *testing.T) {
+	r := httptest.NewRequest("CONNECT", "/socket", nil)
+	w := httptest.NewRecorder()
+	HTTPHandler("/socket").ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Error(w.Code)
+	}
+	r = httptest.NewRequest("GET", WSPath, nil)
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	w = httptest.NewRecorder()
+	WSHandler(WSPath).ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Error(w.Code)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultHandshakeTimeout is the default timeout of the handshakes of the accepted connections.
+	DefaultHandshakeTimeout = time.Second * 10
+	// DefaultMaxConcurrentHandshakes is the default maximum number of the concurrent handshakes of a listener.
+	DefaultMaxConcurrentHandshakes = 1024
+)
+
+// ErrHandshakeTimeout is the error when a handshake does not complete within the handshake timeout.
+var ErrHandshakeTimeout = errors.New("handshake timeout")
+
+// handshaker bounds the duration and the concurrency of the handshakes of the accepted
+// connections, such as the TLS handshakes and the HTTP and WebSocket upgrades.
+type handshaker struct {
+	timeout  time.Duration
+	slots    chan struct{}
+	stats    *HandshakeStats
+	observer *observer
+}
+
+func newHandshaker(timeout time.Duration, maxConcurrent int, stats *HandshakeStats, observer *observer) *handshaker {
+	if timeout == 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	if maxConcurrent == 0 {
+		maxConcurrent = DefaultMaxConcurrentHandshakes
+	}
+	h := &handshaker{timeout: timeout, stats: stats, observer: observer}
+	if maxConcurrent > 0 {
+		h.slots = make(chan struct{}, maxConcurrent)
+	}
+	return h
+}
+
+// do runs the handshake on the conn. The time waiting for a free slot counts towards
+// the timeout. The conn is aborted if the handshake does not complete in time.
+func (h *handshaker) do(conn net.Conn, handshake func() error) error {
+	if h == nil {
+		return handshake()
+	}
+	var deadline time.Time
+	if h.timeout > 0 {
+		deadline = time.Now().Add(h.timeout)
+	}
+	if h.slots != nil {
+		if h.timeout > 0 {
+			timer := time.NewTimer(h.timeout)
+			select {
+			case h.slots <- struct{}{}:
+				timer.Stop()
+			case <-timer.C:
+				return ErrHandshakeTimeout
+			}
+		} else {
+			h.slots <- struct{}{}
+		}
+		defer func() { <-h.slots }()
+	}
+	if h.timeout <= 0 {
+		return handshake()
+	}
+	if conn.SetDeadline(deadline) == nil {
+		err := handshake()
+		conn.SetDeadline(time.Time{})
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return ErrHandshakeTimeout
+		}
+		return err
+	}
+	// The conns served by the netpoll support no deadlines,
+	// so they are shut down by a timer instead.
+	var state int32
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		if atomic.CompareAndSwapInt32(&state, 0, 1) {
+			abort(conn)
+		}
+	})
+	err := handshake()
+	timer.Stop()
+	if !atomic.CompareAndSwapInt32(&state, 0, 2) {
+		return ErrHandshakeTimeout
+	}
+	return err
+}
+
+// handshakeTLS runs the TLS handshake of the tlsConn on the conn and counts it.
+func (h *handshaker) handshakeTLS(conn net.Conn, tlsConn *tls.Conn) error {
+	if err := h.do(conn, tlsConn.Handshake); err != nil {
+		return err
+	}
+	h.observe(tlsConn)
+	return nil
+}
+
+// observe counts the completed TLS handshake of the tlsConn.
+func (h *handshaker) observe(tlsConn *tls.Conn) {
+	if h != nil {
+		h.stats.observe(tlsConn)
+		h.observer.handshake("server", tlsConn)
+	}
+}
+
+// HandshakeStats counts the completed TLS handshakes by whether they resumed a session.
+// It is safe for concurrent use.
+type HandshakeStats struct {
+	full    uint64
+	resumed uint64
+}
+
+// Full returns the number of the full handshakes.
+func (s *HandshakeStats) Full() uint64 {
+	return atomic.LoadUint64(&s.full)
+}
+
+// Resumed returns the number of the handshakes which resumed a session.
+func (s *HandshakeStats) Resumed() uint64 {
+	return atomic.LoadUint64(&s.resumed)
+}
+
+func (s *HandshakeStats) observe(tlsConn *tls.Conn) {
+	if s == nil {
+		return
+	}
+	if tlsConn.ConnectionState().DidResume {
+		atomic.AddUint64(&s.resumed, 1)
+	} else {
+		atomic.AddUint64(&s.full, 1)
+	}
+}
+
+// abort unblocks the pending reads and writes of the conn.
+func abort(conn net.Conn) {
+	if sc, ok := conn.(syscall.Conn); ok {
+		if raw, err := sc.SyscallConn(); err == nil {
+			var err error
+			raw.Control(func(fd uintptr) {
+				err = shutdown(fd)
+			})
+			if err == nil {
+				return
+			}
+		}
+	}
+	conn.Close()
+}
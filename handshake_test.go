@@ -0,0 +1,107 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshakeTimeout(t *testing.T) {
+	testHandshakeTimeout(&TCP{Config: DefalutServerTLSConfig(), Options: Options{HandshakeTimeout: time.Millisecond * 100}}, false, t)
+	testHandshakeTimeout(&TCP{Config: DefalutServerTLSConfig(), Options: Options{HandshakeTimeout: time.Millisecond * 100}}, true, t)
+	testHandshakeTimeout(&HTTP{Options: Options{HandshakeTimeout: time.Millisecond * 100}}, true, t)
+	testHandshakeTimeout(&WS{Options: Options{HandshakeTimeout: time.Millisecond * 100}}, true, t)
+}
+
+func testHandshakeTimeout(serverSock Socket, serve bool, t *testing.T) {
+	var addr = ":9999"
+	l, err := serverSock.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serve {
+		go l.ServeConn(func(conn net.Conn) (Context, error) {
+			return conn, nil
+		}, func(context Context) error {
+			conn := context.(net.Conn)
+			buf := make([]byte, 64)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return err
+			}
+			_, err = conn.Write(buf[:n])
+			return err
+		})
+	} else {
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					if e, ok := err.(*net.OpError); ok && e.Op == "accept" {
+						return
+					}
+					continue
+				}
+				conn.Close()
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 10)
+	conn, err := net.Dial("tcp", "127.0.0.1"+addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("should be closed")
+	} else if e, ok := err.(net.Error); ok && e.Timeout() {
+		t.Error("the stalled handshake should be aborted")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error(d)
+	}
+	conn.Close()
+	l.Close()
+}
+
+func TestHandshaker(t *testing.T) {
+	var h *handshaker
+	if err := h.do(nil, func() error { return nil }); err != nil {
+		t.Error(err)
+	}
+	h = newHandshaker(time.Millisecond*50, 1, nil, nil)
+	server, client := net.Pipe()
+	defer client.Close()
+	if err := h.do(server, func() error {
+		_, err := server.Read(make([]byte, 1))
+		return err
+	}); err != ErrHandshakeTimeout {
+		t.Error(err)
+	}
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		h.do(server, func() error {
+			<-release
+			return nil
+		})
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 10)
+	if err := h.do(server, func() error { return nil }); err != ErrHandshakeTimeout {
+		t.Error("should wait for the slot until the timeout", err)
+	}
+	close(release)
+	<-done
+	if err := h.do(server, func() error { return nil }); err != nil {
+		t.Error(err)
+	}
+	h = newHandshaker(-1, -1, nil, nil)
+	if h.slots != nil || h.timeout > 0 {
+		t.Error(h.slots, h.timeout)
+	}
+}
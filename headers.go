@@ -0,0 +1,160 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// ErrHeaderType is the error returned when the type of a header value is not supported.
+var ErrHeaderType = errors.New("header value type is not supported")
+
+// Headers are the typed headers of a message, such as a message type, a content type
+// or a correlation id. The values are string, []byte, bool, int64, uint64 or float64.
+// The other integers are written as int64 or uint64, and float32 is written as float64.
+type Headers map[string]interface{}
+
+// The types of the header values.
+const (
+	headerString byte = iota
+	headerBytes
+	headerBool
+	headerInt
+	headerUint
+	headerFloat
+)
+
+// appendHeaders appends the headers sorted by the keys. A header is encoded as
+// the varint length prefixed key, the type of the value and the value. The string
+// and []byte values are varint length prefixed, the integers are varints, the bools
+// are a byte and the floats are 8 bytes in little endian.
+func appendHeaders(p []byte, h Headers) ([]byte, error) {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		p = appendUvarint(p, uint64(len(key)))
+		p = append(p, key...)
+		switch v := h[key].(type) {
+		case string:
+			p = append(appendUvarint(append(p, headerString), uint64(len(v))), v...)
+		case []byte:
+			p = append(appendUvarint(append(p, headerBytes), uint64(len(v))), v...)
+		case bool:
+			p = append(p, headerBool, 0)
+			if v {
+				p[len(p)-1] = 1
+			}
+		case int:
+			p = appendVarint(append(p, headerInt), int64(v))
+		case int8:
+			p = appendVarint(append(p, headerInt), int64(v))
+		case int16:
+			p = appendVarint(append(p, headerInt), int64(v))
+		case int32:
+			p = appendVarint(append(p, headerInt), int64(v))
+		case int64:
+			p = appendVarint(append(p, headerInt), v)
+		case uint:
+			p = appendUvarint(append(p, headerUint), uint64(v))
+		case uint8:
+			p = appendUvarint(append(p, headerUint), uint64(v))
+		case uint16:
+			p = appendUvarint(append(p, headerUint), uint64(v))
+		case uint32:
+			p = appendUvarint(append(p, headerUint), uint64(v))
+		case uint64:
+			p = appendUvarint(append(p, headerUint), v)
+		case float32:
+			p = appendFloat(append(p, headerFloat), float64(v))
+		case float64:
+			p = appendFloat(append(p, headerFloat), v)
+		default:
+			return nil, ErrHeaderType
+		}
+	}
+	return p, nil
+}
+
+// parseHeaders parses the headers appended by appendHeaders.
+func parseHeaders(p []byte) (Headers, error) {
+	h := make(Headers)
+	for len(p) > 0 {
+		key, rest, ok := readField(p)
+		if !ok || len(rest) == 0 {
+			return nil, ErrEnvelope
+		}
+		kind := rest[0]
+		p = rest[1:]
+		switch kind {
+		case headerString, headerBytes:
+			var value []byte
+			if value, p, ok = readField(p); !ok {
+				return nil, ErrEnvelope
+			}
+			if kind == headerString {
+				h[string(key)] = string(value)
+			} else {
+				h[string(key)] = append([]byte{}, value...)
+			}
+		case headerBool:
+			if len(p) == 0 || p[0] > 1 {
+				return nil, ErrEnvelope
+			}
+			h[string(key)], p = p[0] == 1, p[1:]
+		case headerInt:
+			v, n := binary.Varint(p)
+			if n <= 0 {
+				return nil, ErrEnvelope
+			}
+			h[string(key)], p = v, p[n:]
+		case headerUint:
+			v, n := binary.Uvarint(p)
+			if n <= 0 {
+				return nil, ErrEnvelope
+			}
+			h[string(key)], p = v, p[n:]
+		case headerFloat:
+			if len(p) < 8 {
+				return nil, ErrEnvelope
+			}
+			h[string(key)], p = math.Float64frombits(binary.LittleEndian.Uint64(p)), p[8:]
+		default:
+			return nil, ErrEnvelope
+		}
+	}
+	return h, nil
+}
+
+// readField reads a varint length prefixed field.
+func readField(p []byte) (field, rest []byte, ok bool) {
+	length, n := binary.Uvarint(p)
+	if n <= 0 || length > uint64(len(p)-n) {
+		return nil, nil, false
+	}
+	return p[n : n+int(length)], p[n+int(length):], true
+}
+
+func appendUvarint(p []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(p, buf[:n]...)
+}
+
+func appendVarint(p []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	return append(p, buf[:n]...)
+}
+
+func appendFloat(p []byte, v float64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	return append(p, buf[:]...)
+}
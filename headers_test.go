@@ -0,0 +1,118 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"context"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestHeaders(t *testing.T) {
+	headers := Headers{
+		"type":         "ping",
+		"payload":      []byte{0, 1},
+		"compressed":   true,
+		"id":           int64(-7),
+		"int":          int(math.MinInt32),
+		"int8":         int8(-8),
+		"int16":        int16(-16),
+		"int32":        int32(-32),
+		"sequence":     uint64(math.MaxUint64),
+		"uint":         uint(1),
+		"uint8":        uint8(8),
+		"uint16":       uint16(16),
+		"uint32":       uint32(32),
+		"ratio":        0.5,
+		"float32":      float32(1.5),
+		"":             false,
+		"content-type": "text/plain",
+	}
+	p, err := appendHeaders(nil, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := parseHeaders(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h, Headers{
+		"type":         "ping",
+		"payload":      []byte{0, 1},
+		"compressed":   true,
+		"id":           int64(-7),
+		"int":          int64(math.MinInt32),
+		"int8":         int64(-8),
+		"int16":        int64(-16),
+		"int32":        int64(-32),
+		"sequence":     uint64(math.MaxUint64),
+		"uint":         uint64(1),
+		"uint8":        uint64(8),
+		"uint16":       uint64(16),
+		"uint32":       uint64(32),
+		"ratio":        0.5,
+		"float32":      1.5,
+		"":             false,
+		"content-type": "text/plain",
+	}) {
+		t.Error(h)
+	}
+	if _, err := appendHeaders(nil, Headers{"a": struct{}{}}); err != ErrHeaderType {
+		t.Error(err)
+	}
+	for _, p := range [][]byte{
+		{1, 'a'},
+		{1, 'a', 9},
+		{1, 'a', headerString, 2, 'b'},
+		{1, 'a', headerBool},
+		{1, 'a', headerBool, 2},
+		{1, 'a', headerInt, 0x80},
+		{1, 'a', headerUint},
+		{1, 'a', headerFloat, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		if _, err := parseHeaders(p); err != ErrEnvelope {
+			t.Error(p, err)
+		}
+	}
+}
+
+func TestMessagesWithHeaders(t *testing.T) {
+	server, client := net.Pipe()
+	serverMessages := NewEnvelopeMessages(NewMessages(server, false), nil)
+	clientMessages := NewEnvelopeMessages(NewMessages(client, false), nil)
+	go func() {
+		clientMessages.WriteMessageWithHeaders(Headers{"type": "ping", "id": 1}, []byte("Hello World"))
+		clientMessages.WriteMessageWithHeaders(Headers{"type": "ping", "id": 2}, []byte("Hello World"))
+		clientMessages.WriteMessage([]byte("Hello World"))
+		if err := clientMessages.WriteMessageWithHeaders(Headers{"id": nil}, nil); err != ErrHeaderType {
+			t.Error(err)
+		}
+		clientMessages.WriteMessageWithHeaders(nil, nil)
+	}()
+	h, msg, err := serverMessages.ReadMessageWithHeaders(nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(msg) != "Hello World" || !reflect.DeepEqual(h, Headers{"type": "ping", "id": int64(1)}) {
+		t.Error(string(msg), h)
+	}
+	ctx, msg, err := serverMessages.ReadMessageContext(context.Background(), nil)
+	if err != nil {
+		t.Error(err)
+	} else if string(msg) != "Hello World" || !reflect.DeepEqual(MetadataOf(ctx), Metadata{"type": "ping"}) {
+		t.Error(string(msg), MetadataOf(ctx))
+	}
+	h, msg, err = serverMessages.ReadMessageWithHeaders(nil)
+	if err != nil {
+		t.Error(err)
+	} else if string(msg) != "Hello World" || h != nil {
+		t.Error(string(msg), h)
+	}
+	if msg, err := serverMessages.ReadMessage(nil); err != nil || len(msg) != 0 {
+		t.Error(msg, err)
+	}
+	serverMessages.Close()
+	clientMessages.Close()
+}
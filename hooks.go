@@ -0,0 +1,47 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// Hooks observes the lifecycle of the connections of a socket. The transport argument
+// is one of tcp, unix, http, ws, inproc and sim. The nil funcs are not called.
+//
+// The conn passed to OnDial, OnAccept, OnClose, OnMessageRead and OnMessageWritten is
+// the same for a connection, so it can be used as the key of the connection. OnHandshake
+// and OnUpgrade are called before OnDial or OnAccept with the connection being handshaken.
+//
+// The funcs are called synchronously and may be called concurrently.
+type Hooks struct {
+	// OnDial is called after a connection is dialed.
+	OnDial func(transport, address string, conn net.Conn)
+	// OnDialError is called when a dial fails.
+	OnDialError func(transport, address string, err error)
+	// OnAccept is called after a connection is accepted and handshaken.
+	OnAccept func(transport string, conn net.Conn)
+	// OnHandshake is called after a TLS handshake is completed.
+	OnHandshake func(transport string, conn net.Conn, state tls.ConnectionState)
+	// OnUpgrade is called after the HTTP upgrade of the http and ws transports is completed.
+	OnUpgrade func(transport string, conn net.Conn)
+	// OnClose is called once when a connection is closed, or fails to read or write.
+	OnClose func(transport string, conn net.Conn, info CloseInfo)
+	// OnMessageRead is called after a message is read.
+	OnMessageRead func(transport string, conn net.Conn, size int)
+	// OnMessageWritten is called after a message is written.
+	OnMessageWritten func(transport string, conn net.Conn, size int)
+}
+
+// CloseInfo describes a closed connection.
+type CloseInfo struct {
+	// Err is the reason of the close. It is nil if the connection is closed by Close,
+	// or io.EOF if the connection is closed by the peer.
+	Err error
+	// BytesRead is the number of the bytes read from the connection.
+	BytesRead int64
+	// BytesWritten is the number of the bytes written to the connection.
+	BytesWritten int64
+}
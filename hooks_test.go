@@ -0,0 +1,176 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testHooks struct {
+	mu     sync.Mutex
+	events map[string]int
+	closes []CloseInfo
+	conns  map[net.Conn]bool
+}
+
+func newTestHooks() (*testHooks, *Hooks) {
+	h := &testHooks{events: make(map[string]int), conns: make(map[net.Conn]bool)}
+	return h, &Hooks{
+		OnDial: func(transport, address string, conn net.Conn) {
+			h.add("dial", conn)
+		},
+		OnDialError: func(transport, address string, err error) {
+			h.add("dial_error", nil)
+		},
+		OnAccept: func(transport string, conn net.Conn) {
+			h.add("accept", conn)
+		},
+		OnHandshake: func(transport string, conn net.Conn, state tls.ConnectionState) {
+			if state.HandshakeComplete {
+				h.add("handshake", nil)
+			}
+		},
+		OnUpgrade: func(transport string, conn net.Conn) {
+			h.add("upgrade", nil)
+		},
+		OnClose: func(transport string, conn net.Conn, info CloseInfo) {
+			h.mu.Lock()
+			if !h.conns[conn] {
+				h.events["unknown_close"]++
+			}
+			h.closes = append(h.closes, info)
+			h.mu.Unlock()
+			h.add("close", nil)
+		},
+		OnMessageRead: func(transport string, conn net.Conn, size int) {
+			h.add("read", conn)
+		},
+		OnMessageWritten: func(transport string, conn net.Conn, size int) {
+			h.add("write", conn)
+		},
+	}
+}
+
+func (h *testHooks) add(event string, conn net.Conn) {
+	h.mu.Lock()
+	h.events[event]++
+	if conn != nil {
+		if event == "dial" || event == "accept" {
+			h.conns[conn] = true
+		} else if !h.conns[conn] {
+			h.events["unknown_"+event]++
+		}
+	}
+	h.mu.Unlock()
+}
+
+func (h *testHooks) count(event string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.events[event]
+}
+
+func (h *testHooks) wait(event string, n int) int {
+	for i := 0; i < 100 && h.count(event) < n; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	return h.count(event)
+}
+
+func TestHooks(t *testing.T) {
+	server, serverHooks := newTestHooks()
+	client, clientHooks := newTestHooks()
+	testHooksAccept(&TCP{Config: DefalutServerTLSConfig(), Options: Options{Hooks: serverHooks}},
+		&TCP{Config: DefalutClientTLSConfig(), Options: Options{Hooks: clientHooks}}, t)
+	for _, h := range []*testHooks{server, client} {
+		for event, n := range map[string]int{"handshake": 1, "read": 1, "write": 1, "close": 1, "upgrade": 0} {
+			if v := h.wait(event, n); v != n {
+				t.Error(event, v)
+			}
+		}
+		if n := h.count("unknown_read") + h.count("unknown_write") + h.count("unknown_close"); n != 0 {
+			t.Error(n)
+		}
+	}
+	if n := client.count("dial_error"); n != 1 {
+		t.Error(n)
+	}
+	if n := client.count("dial"); n != 1 {
+		t.Error(n)
+	}
+	if n := server.count("accept"); n != 1 {
+		t.Error(n)
+	}
+	if info := client.closes[0]; info.Err != nil || info.BytesRead == 0 || info.BytesWritten == 0 {
+		t.Error(info)
+	}
+	if info := server.closes[0]; info.Err != io.EOF || info.BytesRead != client.closes[0].BytesWritten {
+		t.Error(info, client.closes[0])
+	}
+
+	server, serverHooks = newTestHooks()
+	client, clientHooks = newTestHooks()
+	testHooksAccept(&HTTP{Options: Options{Hooks: serverHooks}}, &HTTP{Options: Options{Hooks: clientHooks}}, t)
+	for _, h := range []*testHooks{server, client} {
+		for event, n := range map[string]int{"upgrade": 1, "read": 1, "write": 1, "close": 1, "handshake": 0} {
+			if v := h.wait(event, n); v != n {
+				t.Error(event, v)
+			}
+		}
+	}
+
+	server, serverHooks = newTestHooks()
+	testSocketServeMessages(&TCP{Options: Options{Hooks: serverHooks}}, NewTCPSocket(nil), t)
+	for event, n := range map[string]int{"accept": 1, "read": 1, "write": 1, "close": 1} {
+		if v := server.wait(event, n); v != n {
+			t.Error(event, v)
+		}
+	}
+}
+
+func testHooksAccept(serverSock, clientSock Socket, t *testing.T) {
+	var addr = ":9999"
+	if _, err := clientSock.Dial(addr); err == nil {
+		t.Error("should be refused")
+	}
+	l, err := serverSock.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			messages := conn.Messages()
+			msg, err := messages.ReadMessage(nil)
+			if err == nil {
+				messages.WriteMessage(msg)
+				_, err = messages.ReadMessage(nil)
+			}
+			if err != io.EOF {
+				t.Error(err)
+			}
+			messages.Close()
+		}
+	}()
+	conn, err := clientSock.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := conn.Messages()
+	messages.WriteMessage([]byte("Hello World"))
+	if _, err := messages.ReadMessage(nil); err != nil {
+		t.Error(err)
+	}
+	messages.Close()
+	time.Sleep(time.Millisecond * 10)
+	l.Close()
+}
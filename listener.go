@@ -0,0 +1,230 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"errors"
+	"github.com/hslam/netpoll"
+	"net"
+	"sync"
+)
+
+// ErrListenerClosed is the error when the listener is closed.
+var ErrListenerClosed = errors.New("listener is closed")
+
+// connQueue is a net.Listener that accepts the upgraded connections delivered to it.
+type connQueue struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnQueue(addr net.Addr) *connQueue {
+	return &connQueue{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// deliver hands the conn over to the next Accept.
+// It returns false when the queue is closed.
+func (q *connQueue) deliver(conn net.Conn) bool {
+	select {
+	case <-q.done:
+		return false
+	default:
+	}
+	select {
+	case q.conns <- conn:
+		return true
+	case <-q.done:
+		return false
+	}
+}
+
+func (q *connQueue) closed() bool {
+	select {
+	case <-q.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Accept waits for and returns the next delivered connection.
+func (q *connQueue) Accept() (net.Conn, error) {
+	select {
+	case conn := <-q.conns:
+		return conn, nil
+	case <-q.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close closes the queue.
+func (q *connQueue) Close() error {
+	q.closeOnce.Do(func() {
+		close(q.done)
+	})
+	return nil
+}
+
+// Addr returns the listener's network address.
+func (q *connQueue) Addr() net.Addr {
+	return q.addr
+}
+
+// queueListener implements the Listener interface for the upgraded connections
+// delivered by a dispatcher such as a route or an http.Handler.
+type queueListener struct {
+	q      *connQueue
+	mu     sync.Mutex
+	server *netpoll.Server
+	// framed reports whether the delivered connections are message oriented,
+	// in which case ServeData serves the messages instead of the raw bytes.
+	framed bool
+}
+
+func newQueueListener(addr net.Addr, framed bool) *queueListener {
+	return &queueListener{q: newConnQueue(addr), framed: framed}
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *queueListener) Accept() (Conn, error) {
+	conn, err := l.q.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return conn.(Conn), nil
+}
+
+func (l *queueListener) serve(handler netpoll.Handler) error {
+	l.mu.Lock()
+	if l.q.closed() {
+		l.mu.Unlock()
+		return ErrListenerClosed
+	}
+	l.server = &netpoll.Server{
+		Handler: handler,
+	}
+	server := l.server
+	l.mu.Unlock()
+	return server.Serve(l.q)
+}
+
+// Serve serves the netpoll.Handler by the netpoll.
+func (l *queueListener) Serve(handler netpoll.Handler) error {
+	if handler == nil {
+		return ErrHandler
+	}
+	return l.serve(handler)
+}
+
+// ServeData serves the opened func and the serve func by the netpoll.
+func (l *queueListener) ServeData(opened func(net.Conn) error, serve func(req []byte) (res []byte)) error {
+	if serve == nil {
+		return ErrServe
+	}
+	type Context struct {
+		Conn     net.Conn
+		messages Messages
+		buf      []byte
+	}
+	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
+		if opened != nil {
+			if err := opened(conn); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		ctx := &Context{Conn: conn}
+		if l.framed {
+			ctx.messages = conn.(Conn).Messages()
+		} else {
+			ctx.buf = make([]byte, 1024*64)
+		}
+		return ctx, nil
+	}
+	Serve := func(context netpoll.Context) error {
+		c := context.(*Context)
+		if c.messages != nil {
+			msg, err := c.messages.ReadMessage(nil)
+			if err != nil {
+				return err
+			}
+			res := serve(msg)
+			if len(res) == 0 {
+				return nil
+			}
+			return c.messages.WriteMessage(res)
+		}
+		n, err := c.Conn.Read(c.buf)
+		if err != nil {
+			return err
+		}
+		res := serve(c.buf[:n])
+		if len(res) == 0 {
+			return nil
+		}
+		_, err = c.Conn.Write(res)
+		return err
+	}
+	return l.serve(netpoll.NewHandler(Upgrade, Serve))
+}
+
+// ServeConn serves the opened func and the serve func by the netpoll.
+func (l *queueListener) ServeConn(opened func(net.Conn) (Context, error), serve func(Context) error) error {
+	if opened == nil {
+		return ErrOpened
+	} else if serve == nil {
+		return ErrServe
+	}
+	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
+		return opened(conn)
+	}
+	Serve := func(context netpoll.Context) error {
+		return serve(context)
+	}
+	return l.serve(netpoll.NewHandler(Upgrade, Serve))
+}
+
+// ServeMessages serves the opened func and the serve func by the netpoll.
+func (l *queueListener) ServeMessages(opened func(Messages) (Context, error), serve func(Context) error) error {
+	if opened == nil {
+		return ErrOpened
+	} else if serve == nil {
+		return ErrServe
+	}
+	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
+		var messages Messages
+		if l.framed {
+			messages = conn.(Conn).Messages()
+		} else {
+			messages = NewMessages(conn, true)
+		}
+		return opened(messages)
+	}
+	Serve := func(context netpoll.Context) error {
+		return serve(context)
+	}
+	return l.serve(netpoll.NewHandler(Upgrade, Serve))
+}
+
+// Close closes the listener.
+func (l *queueListener) Close() error {
+	l.mu.Lock()
+	server := l.server
+	l.mu.Unlock()
+	if server != nil {
+		server.Close()
+	}
+	return l.q.Close()
+}
+
+// Addr returns the listener's network address.
+func (l *queueListener) Addr() net.Addr {
+	return l.q.Addr()
+}
@@ -4,6 +4,8 @@
 package socket
 
 import (
+	"encoding/binary"
+	"errors"
 	"github.com/hslam/buffer"
 	"github.com/hslam/writer"
 	"io"
@@ -14,6 +16,10 @@ import (
 
 const bufferSize = 65536
 
+// ErrVarintOverflow is the error returned when the length prefix of a message frame
+// overflows a 64-bit integer.
+var ErrVarintOverflow = errors.New("varint overflows a 64-bit integer")
+
 // BufferedOutput sets the buffered writer with the buffer size.
 type BufferedOutput interface {
 	SetBufferedOutput(bufferSize int)
@@ -51,6 +57,7 @@ type messages struct {
 	readPool        *buffer.Pool
 	writePool       *buffer.Pool
 	closed          int32
+	observed        *observedConn
 }
 
 // NewMessages returns a new messages.
@@ -78,6 +85,7 @@ func NewMessages(rwc io.ReadWriteCloser, shared bool) Messages {
 		writeBuffer:     writeBuffer,
 		readPool:        readPool,
 		writePool:       writePool,
+		observed:        observedOf(rwc),
 	}
 }
 
@@ -136,19 +144,24 @@ func (m *messages) ReadMessage(buf []byte) (p []byte, err error) {
 					t |= uint64(b&0x7f) << s
 					s += 7
 					i++
+					if i == binary.MaxVarintLen64 {
+						m.reading.Unlock()
+						return nil, ErrVarintOverflow
+					}
 					if length < i+1 {
 						goto read
 					}
 					b = m.buffer[i]
 				}
 			}
-			if i > 9 || i == 9 && b > 1 {
-				panic("varint overflows a 64-bit integer")
+			if i == binary.MaxVarintLen64-1 && b > 1 {
+				m.reading.Unlock()
+				return nil, ErrVarintOverflow
 			}
 			t |= uint64(b) << s
 			i++
 			msgLength = t
-			if length < i+msgLength {
+			if length-i < msgLength {
 				goto read
 			}
 			if uint64(cap(buf)) >= msgLength {
@@ -161,6 +174,7 @@ func (m *messages) ReadMessage(buf []byte) (p []byte, err error) {
 			n := copy(m.buffer, m.buffer[i:])
 			m.buffer = m.buffer[:n]
 			m.reading.Unlock()
+			m.observed.message("read", len(p))
 			return
 		}
 	read:
@@ -230,7 +244,9 @@ func (m *messages) WriteMessage(b []byte) error {
 	i += n
 	_, err := m.writer.Write(writeBuffer[:i])
 	m.writing.Unlock()
-	if err != nil {
+	if err == nil {
+		m.observed.message("write", len(b))
+	} else {
 		errMsg := err.Error()
 		if strings.Contains(errMsg, "use of closed network connection") || strings.Contains(errMsg, "connection reset by peer") {
 			err = io.EOF
@@ -0,0 +1,44 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package socket
+
+import (
+	"testing"
+)
+
+func FuzzReadMessage(f *testing.F) {
+	f.Add([]byte{11, 'H', 'e', 'l', 'l', 'o', ' ', 'W', 'o', 'r', 'l', 'd'}, []byte{}, false, uint16(0))
+	f.Add([]byte{0, 0, 1, 'H', 0}, []byte{0}, true, uint16(1))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, []byte{3}, false, uint16(2))
+	f.Add([]byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}, []byte{}, true, uint16(0))
+	f.Fuzz(func(t *testing.T, data, sizes []byte, shared bool, readBufferSize uint16) {
+		if err := checkReadFrames(data, sizes, shared, int(readBufferSize)); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func FuzzWriteMessage(f *testing.F) {
+	f.Add([]byte("Hello World"), []byte{5, 0, 6}, []byte{}, false, uint16(0))
+	f.Add(make([]byte, 300), []byte{200}, []byte{0, 7}, true, uint16(3))
+	f.Fuzz(func(t *testing.T, data, cuts, sizes []byte, shared bool, readBufferSize uint16) {
+		// The cuts split the data into the payloads, including the zero-length payloads.
+		var payloads [][]byte
+		for _, cut := range cuts {
+			n := int(cut)
+			if n > len(data) {
+				n = len(data)
+			}
+			payloads = append(payloads, data[:n])
+			data = data[n:]
+		}
+		payloads = append(payloads, data)
+		if err := checkRoundTrip(payloads, sizes, shared, int(readBufferSize)); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -4,10 +4,15 @@
 package socket
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"io"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"testing/quick"
 )
 
 func TestMessages(t *testing.T) {
@@ -71,3 +76,194 @@ func TestMessagesRetain(t *testing.T) {
 	}
 	messages.Close()
 }
+
+// fragmentedConn reads the data in the fragments of the cyclic sizes,
+// and records the written data.
+type fragmentedConn struct {
+	data  []byte
+	sizes []byte
+	n     int
+	mu    sync.Mutex
+	w     bytes.Buffer
+}
+
+func (c *fragmentedConn) Read(p []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	size := len(p)
+	if len(c.sizes) > 0 {
+		if s := int(c.sizes[c.n%len(c.sizes)]) + 1; s < size {
+			size = s
+		}
+		c.n++
+	}
+	n := copy(p[:size], c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func (c *fragmentedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.w.Write(p)
+}
+
+func (c *fragmentedConn) Close() error {
+	return nil
+}
+
+// decodeFrames decodes the message frames by the encoding/binary, and returns
+// the error expected after the frames.
+func decodeFrames(data []byte) (frames [][]byte, err error) {
+	for len(data) > 0 {
+		length, n := binary.Uvarint(data)
+		if n < 0 || n == 0 && len(data) >= binary.MaxVarintLen64 {
+			return frames, ErrVarintOverflow
+		} else if n == 0 || uint64(len(data)-n) < length {
+			return frames, io.EOF
+		}
+		frames = append(frames, data[n:n+int(length)])
+		data = data[n+int(length):]
+	}
+	return frames, io.EOF
+}
+
+// checkReadFrames checks the frames read from the fragmented data against decodeFrames.
+func checkReadFrames(data, sizes []byte, shared bool, readBufferSize int) error {
+	expected, expectedErr := decodeFrames(data)
+	messages := NewMessages(&fragmentedConn{data: data, sizes: sizes}, shared)
+	messages.(BufferedInput).SetBufferedInput(readBufferSize)
+	defer messages.Close()
+	for i := 0; ; i++ {
+		msg, err := messages.ReadMessage(nil)
+		if err != nil {
+			if i != len(expected) || err != expectedErr {
+				return fmt.Errorf("error %v after %d frames, expected %v after %d frames", err, i, expectedErr, len(expected))
+			}
+			return nil
+		}
+		if i >= len(expected) || !bytes.Equal(msg, expected[i]) {
+			return fmt.Errorf("unexpected frame %d of %d bytes", i, len(msg))
+		}
+	}
+}
+
+// checkRoundTrip checks the messages written and read back from the fragmented frames.
+func checkRoundTrip(payloads [][]byte, sizes []byte, shared bool, readBufferSize int) error {
+	conn := &fragmentedConn{}
+	messages := NewMessages(conn, shared)
+	for _, payload := range payloads {
+		if err := messages.WriteMessage(payload); err != nil {
+			return err
+		}
+	}
+	var encoded []byte
+	for _, payload := range payloads {
+		encoded = append(appendUvarint(encoded, uint64(len(payload))), payload...)
+	}
+	if !bytes.Equal(conn.w.Bytes(), encoded) {
+		return fmt.Errorf("frames are not encoded as the uvarint length prefixed payloads")
+	}
+	conn.data, conn.sizes = conn.w.Bytes(), sizes
+	messages.(BufferedInput).SetBufferedInput(readBufferSize)
+	for i, payload := range payloads {
+		msg, err := messages.ReadMessage(make([]byte, 0, i))
+		if err != nil {
+			return err
+		} else if !bytes.Equal(msg, payload) {
+			return fmt.Errorf("frame %d of %d bytes != %d bytes", i, len(msg), len(payload))
+		}
+	}
+	if _, err := messages.ReadMessage(nil); err != io.EOF {
+		return fmt.Errorf("error %v, expected EOF", err)
+	}
+	return nil
+}
+
+func TestMessagesRoundTrip(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		shared := shared
+		f := func(payloads [][]byte, sizes []byte, readBufferSize uint8) bool {
+			payloads = append(payloads, nil, make([]byte, bufferSize+1))
+			if err := checkRoundTrip(payloads, sizes, shared, int(readBufferSize)); err != nil {
+				t.Log(err)
+				return false
+			}
+			return true
+		}
+		if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+			t.Error(shared, err)
+		}
+	}
+}
+
+func TestMessagesMalformed(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		shared := shared
+		f := func(data, sizes []byte, readBufferSize uint8) bool {
+			if err := checkReadFrames(data, sizes, shared, int(readBufferSize)); err != nil {
+				t.Log(err)
+				return false
+			}
+			return true
+		}
+		if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+			t.Error(shared, err)
+		}
+		for _, data := range [][]byte{
+			{},
+			{0},
+			{0, 0, 0},
+			{0x80},
+			{5, 'H', 'e'},
+			{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+			{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02},
+			{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80},
+			{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01},
+			{1, 'H', 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+			{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 'H'},
+		} {
+			for _, sizes := range [][]byte{nil, {0}, {2, 0, 5}} {
+				if err := checkReadFrames(data, sizes, shared, 0); err != nil {
+					t.Error(data, sizes, err)
+				}
+			}
+		}
+	}
+}
+
+func TestMessagesConcurrentWrites(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		conn := &fragmentedConn{}
+		messages := NewMessages(conn, shared)
+		const writers, count = 8, 100
+		wg := sync.WaitGroup{}
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < count; j++ {
+					// A message is the writer, the sequence and the padding.
+					messages.WriteMessage(append([]byte{byte(i), byte(j)}, make([]byte, j*i)...))
+				}
+			}(i)
+		}
+		wg.Wait()
+		frames, _ := decodeFrames(conn.w.Bytes())
+		if len(frames) != writers*count {
+			t.Fatal(len(frames))
+		}
+		next := make([]int, writers)
+		for _, frame := range frames {
+			i, j := int(frame[0]), int(frame[1])
+			if j != next[i] || len(frame) != 2+j*i {
+				t.Fatal(i, j, len(frame))
+			}
+			next[i]++
+		}
+		if err := checkReadFrames(conn.w.Bytes(), []byte{3, 0, 200}, shared, 16); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+// The names of the metrics recorded by the sockets. Every metric has the transport label,
+// whose value is one of tcp, unix, http, ws, inproc and sim.
+const (
+	// MetricDials counts the dials by the result label, which is success or failure.
+	MetricDials = "socket_dials_total"
+	// MetricDialDuration observes the seconds of the dials by the stage label,
+	// which is connect, tls, upgrade or total.
+	MetricDialDuration = "socket_dial_duration_seconds"
+	// MetricAccepts counts the accepted connections by the result label, which is success or failure.
+	MetricAccepts = "socket_accepts_total"
+	// MetricActiveConnections is the gauge of the open connections.
+	MetricActiveConnections = "socket_active_connections"
+	// MetricTLSHandshakes counts the completed TLS handshakes by the side label,
+	// which is client or server, and by the mode label, which is full or resumed.
+	MetricTLSHandshakes = "socket_tls_handshakes_total"
+	// MetricMessagesRead counts the messages read.
+	MetricMessagesRead = "socket_messages_read_total"
+	// MetricMessagesWritten counts the messages written.
+	MetricMessagesWritten = "socket_messages_written_total"
+	// MetricBytesRead counts the bytes read from the connections.
+	MetricBytesRead = "socket_bytes_read_total"
+	// MetricBytesWritten counts the bytes written to the connections.
+	MetricBytesWritten = "socket_bytes_written_total"
+	// MetricMessageSize observes the bytes of the messages by the direction label,
+	// which is read or write.
+	MetricMessageSize = "socket_message_size_bytes"
+	// MetricErrors counts the errors by the kind label, which is dial, handshake,
+	// timeout, read or write.
+	MetricErrors = "socket_errors_total"
+)
+
+// Metrics records the metrics of the sockets. The labels are pairs of
+// label names and label values, which are shared by the calls and must not be
+// modified. It must be safe for concurrent use.
+type Metrics interface {
+	// Count adds the delta to the counter.
+	Count(name string, delta float64, labels ...string)
+	// Gauge adds the delta to the gauge.
+	Gauge(name string, delta float64, labels ...string)
+	// Observe records the value in the histogram.
+	Observe(name string, value float64, labels ...string)
+}
+
+// Counter is a counter of a metric with a set of labels.
+type Counter interface {
+	// Add adds the delta to the counter.
+	Add(delta float64)
+}
+
+// Histogram is a histogram of a metric with a set of labels.
+type Histogram interface {
+	// Observe records the value in the histogram.
+	Observe(value float64)
+}
+
+// SeriesMetrics is the optional interface of a Metrics which returns the counters
+// and the histograms by their names and labels. The connections look them up once
+// when they open instead of passing the labels on every read and write.
+type SeriesMetrics interface {
+	// Counter returns the counter of the metric with the labels.
+	Counter(name string, labels ...string) Counter
+	// Histogram returns the histogram of the metric with the labels.
+	Histogram(name string, labels ...string) Histogram
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// DefaultDurationBuckets are the default buckets of the histograms of seconds.
+	DefaultDurationBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+	// DefaultSizeBuckets are the default buckets of the histograms of bytes.
+	DefaultSizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+)
+
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+// MemoryMetrics implements the Metrics interface by keeping the metrics in memory.
+// It implements the expvar.Var interface, so it can be published by expvar.Publish,
+// and the http.Handler interface, which serves the Prometheus text format.
+// It implements the SeriesMetrics interface too, whose counters and histograms
+// are updated without looking up the series.
+type MemoryMetrics struct {
+	mu      sync.Mutex
+	buckets map[string][]float64
+	series  map[string]*metricSeries
+}
+
+type metricSeries struct {
+	mu      sync.Mutex
+	name    string
+	kind    string
+	labels  string
+	value   float64
+	buckets []float64
+	counts  []uint64
+	count   uint64
+}
+
+// NewMemoryMetrics returns a new MemoryMetrics.
+func NewMemoryMetrics() *MemoryMetrics {
+	return &MemoryMetrics{
+		buckets: map[string][]float64{
+			MetricDialDuration: DefaultDurationBuckets,
+			MetricMessageSize:  DefaultSizeBuckets,
+		},
+		series: make(map[string]*metricSeries),
+	}
+}
+
+// SetBuckets sets the upper bounds of the buckets of the histogram with the name.
+// The buckets of the other histograms are DefaultDurationBuckets.
+func (m *MemoryMetrics) SetBuckets(name string, buckets []float64) {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	m.mu.Lock()
+	m.buckets[name] = buckets
+	m.mu.Unlock()
+}
+
+// Count adds the delta to the counter.
+func (m *MemoryMetrics) Count(name string, delta float64, labels ...string) {
+	m.lookup(counterType, name, labels).Add(delta)
+}
+
+// Gauge adds the delta to the gauge.
+func (m *MemoryMetrics) Gauge(name string, delta float64, labels ...string) {
+	m.lookup(gaugeType, name, labels).Add(delta)
+}
+
+// Observe records the value in the histogram.
+func (m *MemoryMetrics) Observe(name string, value float64, labels ...string) {
+	m.lookup(histogramType, name, labels).Observe(value)
+}
+
+// Counter returns the counter of the metric with the labels.
+func (m *MemoryMetrics) Counter(name string, labels ...string) Counter {
+	return m.lookup(counterType, name, labels)
+}
+
+// Histogram returns the histogram of the metric with the labels.
+func (m *MemoryMetrics) Histogram(name string, labels ...string) Histogram {
+	return m.lookup(histogramType, name, labels)
+}
+
+func (m *MemoryMetrics) lookup(kind, name string, labels []string) *metricSeries {
+	m.mu.Lock()
+	s := m.get(kind, name, labels)
+	m.mu.Unlock()
+	return s
+}
+
+// Add adds the delta to the value of the series.
+func (s *metricSeries) Add(delta float64) {
+	s.mu.Lock()
+	s.value += delta
+	s.mu.Unlock()
+}
+
+// Observe records the value in the histogram of the series.
+func (s *metricSeries) Observe(value float64) {
+	s.mu.Lock()
+	s.value += value
+	s.count++
+	for i, bound := range s.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.mu.Unlock()
+}
+
+func (m *MemoryMetrics) get(kind, name string, labels []string) *metricSeries {
+	key := name + "{" + formatLabels(labels) + "}"
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{name: name, kind: kind, labels: formatLabels(labels)}
+		if kind == histogramType {
+			s.buckets = m.buckets[name]
+			if s.buckets == nil {
+				s.buckets = DefaultDurationBuckets
+			}
+			s.counts = make([]uint64, len(s.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Value returns the value of the counter or the gauge, or the sum of the histogram.
+func (m *MemoryMetrics) Value(name string, labels ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.series[name+"{"+formatLabels(labels)+"}"]; ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.value
+	}
+	return 0
+}
+
+// ObservedCount returns the number of the values recorded in the histogram.
+func (m *MemoryMetrics) ObservedCount(name string, labels ...string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.series[name+"{"+formatLabels(labels)+"}"]; ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.count
+	}
+	return 0
+}
+
+func (m *MemoryMetrics) sorted() []*metricSeries {
+	series := make([]*metricSeries, 0, len(m.series))
+	for _, s := range m.series {
+		series = append(series, s)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+		return series[i].labels < series[j].labels
+	})
+	return series
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format.
+func (m *MemoryMetrics) WritePrometheus(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	var name string
+	for _, s := range m.sorted() {
+		if s.name != name {
+			name = s.name
+			bw.WriteString("# TYPE " + s.name + " " + s.kind + "\n")
+		}
+		s.mu.Lock()
+		if s.kind != histogramType {
+			bw.WriteString(seriesName(s.name, s.labels) + " " + formatFloat(s.value) + "\n")
+			s.mu.Unlock()
+			continue
+		}
+		prefix := s.labels
+		if prefix != "" {
+			prefix += ","
+		}
+		for i, bound := range s.buckets {
+			bw.WriteString(s.name + "_bucket{" + prefix + `le="` + formatFloat(bound) + `"} ` + strconv.FormatUint(s.counts[i], 10) + "\n")
+		}
+		bw.WriteString(s.name + "_bucket{" + prefix + `le="+Inf"} ` + strconv.FormatUint(s.count, 10) + "\n")
+		bw.WriteString(seriesName(s.name+"_sum", s.labels) + " " + formatFloat(s.value) + "\n")
+		bw.WriteString(seriesName(s.name+"_count", s.labels) + " " + strconv.FormatUint(s.count, 10) + "\n")
+		s.mu.Unlock()
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (m *MemoryMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WritePrometheus(w)
+}
+
+// String returns the metrics in JSON for expvar.
+func (m *MemoryMetrics) String() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values := make(map[string]interface{}, len(m.series))
+	for key, s := range m.series {
+		s.mu.Lock()
+		if s.kind != histogramType {
+			values[key] = s.value
+			s.mu.Unlock()
+			continue
+		}
+		buckets := make(map[string]uint64, len(s.buckets))
+		for i, bound := range s.buckets {
+			buckets[formatFloat(bound)] = s.counts[i]
+		}
+		values[key] = map[string]interface{}{"count": s.count, "sum": s.value, "buckets": buckets}
+		s.mu.Unlock()
+	}
+	b, _ := json.Marshal(values)
+	return string(b)
+}
+
+// formatLabels formats the pairs of label names and label values.
+func formatLabels(labels []string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(labelReplacer.Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func seriesName(name, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
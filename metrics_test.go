@@ -0,0 +1,288 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMemoryMetrics(t *testing.T) {
+	m := NewMemoryMetrics()
+	m.Count(MetricDials, 1, "transport", "tcp", "result", "success")
+	m.Count(MetricDials, 2, "transport", "tcp", "result", "success")
+	m.Gauge(MetricActiveConnections, 1, "transport", "tcp")
+	m.Gauge(MetricActiveConnections, -1, "transport", "tcp")
+	m.Observe(MetricMessageSize, 100, "transport", "tcp", "direction", "read")
+	m.Observe(MetricMessageSize, 5000, "transport", "tcp", "direction", "read")
+	m.SetBuckets("latency", []float64{2, 1})
+	m.Observe("latency", 1.5, "path", "a\"b")
+	if v := m.Value(MetricDials, "transport", "tcp", "result", "success"); v != 3 {
+		t.Error(v)
+	}
+	if v := m.Value(MetricActiveConnections, "transport", "tcp"); v != 0 {
+		t.Error(v)
+	}
+	if v := m.Value(MetricMessageSize, "transport", "tcp", "direction", "read"); v != 5100 {
+		t.Error(v)
+	}
+	if n := m.ObservedCount(MetricMessageSize, "transport", "tcp", "direction", "read"); n != 2 {
+		t.Error(n)
+	}
+	if n := m.ObservedCount(MetricMessageSize); n != 0 {
+		t.Error(n)
+	}
+	buf := &bytes.Buffer{}
+	if err := m.WritePrometheus(buf); err != nil {
+		t.Error(err)
+	}
+	text := buf.String()
+	for _, line := range []string{
+		"# TYPE socket_dials_total counter\n",
+		`socket_dials_total{transport="tcp",result="success"} 3` + "\n",
+		"# TYPE socket_active_connections gauge\n",
+		`socket_active_connections{transport="tcp"} 0` + "\n",
+		"# TYPE socket_message_size_bytes histogram\n",
+		`socket_message_size_bytes_bucket{transport="tcp",direction="read",le="256"} 1` + "\n",
+		`socket_message_size_bytes_bucket{transport="tcp",direction="read",le="+Inf"} 2` + "\n",
+		`socket_message_size_bytes_sum{transport="tcp",direction="read"} 5100` + "\n",
+		`socket_message_size_bytes_count{transport="tcp",direction="read"} 2` + "\n",
+		`latency_bucket{path="a\"b",le="1"} 0` + "\n",
+		`latency_bucket{path="a\"b",le="2"} 1` + "\n",
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("missing %q in\n%s", line, text)
+		}
+	}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Body.String() != text {
+		t.Error(rec.Body.String())
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(m.String()), &values); err != nil {
+		t.Error(err)
+	} else if v := values[`socket_dials_total{transport="tcp",result="success"}`]; v != 3.0 {
+		t.Error(v)
+	}
+}
+
+func TestSocketMetrics(t *testing.T) {
+	newSockets := []func(server, client Metrics) (Socket, Socket){
+		func(server, client Metrics) (Socket, Socket) {
+			return &TCP{Config: DefalutServerTLSConfig(), Options: Options{Metrics: server}}, &TCP{Config: DefalutClientTLSConfig(), Options: Options{Metrics: client}}
+		},
+		func(server, client Metrics) (Socket, Socket) {
+			return &UNIX{Options: Options{Metrics: server}}, &UNIX{Options: Options{Metrics: client}}
+		},
+		func(server, client Metrics) (Socket, Socket) {
+			return &HTTP{Options: Options{Metrics: server}}, &HTTP{Options: Options{Metrics: client}}
+		},
+		func(server, client Metrics) (Socket, Socket) {
+			return &WS{Options: Options{Metrics: server}}, &WS{Options: Options{Metrics: client}}
+		},
+		func(server, client Metrics) (Socket, Socket) {
+			return &INPROC{Options: Options{Metrics: server}}, &INPROC{Options: Options{Metrics: client}}
+		},
+	}
+	for _, newSocket := range newSockets {
+		server, client := NewMemoryMetrics(), NewMemoryMetrics()
+		serverSock, clientSock := newSocket(server, client)
+		testSocketMetrics(serverSock, clientSock, server, client, t)
+	}
+	server := NewMemoryMetrics()
+	testSocketServeMessages(&TCP{Options: Options{Metrics: server}}, NewTCPSocket(nil), t)
+	if v := server.Value(MetricAccepts, "transport", "tcp", "result", "success"); v != 1 {
+		t.Error(v)
+	}
+	if v := server.Value(MetricMessagesRead, "transport", "tcp"); v != 1 {
+		t.Error(v)
+	}
+}
+
+func testSocketMetrics(serverSock, clientSock Socket, server, client *MemoryMetrics, t *testing.T) {
+	var addr = ":9999"
+	transport := serverSock.Scheme()
+	if transport == "tcps" {
+		transport = "tcp"
+	}
+	if _, err := clientSock.Dial(addr); err == nil {
+		t.Error("should be refused")
+	}
+	if v := client.Value(MetricDials, "transport", transport, "result", "failure"); v != 1 {
+		t.Error(transport, v)
+	}
+	if v := client.Value(MetricErrors, "transport", transport, "kind", "dial"); v != 1 {
+		t.Error(transport, v)
+	}
+	l, err := serverSock.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn Conn) {
+				messages := conn.Messages()
+				for {
+					msg, err := messages.ReadMessage(nil)
+					if err != nil {
+						break
+					}
+					messages.WriteMessage(msg)
+				}
+				messages.Close()
+			}(conn)
+		}
+	}()
+	conn, err := clientSock.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := conn.Connection().(*observedConn); ok {
+		t.Error(transport, "Connection returns the observed conn")
+	}
+	messages := conn.Messages()
+	for i := 0; i < 3; i++ {
+		messages.WriteMessage([]byte("Hello World"))
+		if _, err := messages.ReadMessage(nil); err != nil {
+			t.Error(err)
+		}
+	}
+	if v := client.Value(MetricActiveConnections, "transport", transport); v != 1 {
+		t.Error(transport, v)
+	}
+	messages.Close()
+	if v := client.Value(MetricDials, "transport", transport, "result", "success"); v != 1 {
+		t.Error(transport, v)
+	}
+	for _, stage := range []string{"connect", "total"} {
+		if n := client.ObservedCount(MetricDialDuration, "transport", transport, "stage", stage); n != 1 {
+			t.Error(transport, stage, n)
+		}
+	}
+	if v := client.Value(MetricMessagesWritten, "transport", transport); v != 3 {
+		t.Error(transport, v)
+	}
+	if v := client.Value(MetricMessagesRead, "transport", transport); v != 3 {
+		t.Error(transport, v)
+	}
+	if n := client.ObservedCount(MetricMessageSize, "transport", transport, "direction", "write"); n != 3 {
+		t.Error(transport, n)
+	}
+	if v := client.Value(MetricBytesWritten, "transport", transport); v < 33 {
+		t.Error(transport, v)
+	}
+	if v := client.Value(MetricActiveConnections, "transport", transport); v != 0 {
+		t.Error(transport, v)
+	}
+	if v := server.Value(MetricAccepts, "transport", transport, "result", "success"); v != 1 {
+		t.Error(transport, v)
+	}
+	if v := server.Value(MetricMessagesRead, "transport", transport); v != 3 {
+		t.Error(transport, v)
+	}
+	if v := server.Value(MetricBytesRead, "transport", transport); v < 33 {
+		t.Error(transport, v)
+	}
+	for i := 0; i < 100 && server.Value(MetricActiveConnections, "transport", transport) != 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if v := server.Value(MetricActiveConnections, "transport", transport); v != 0 {
+		t.Error(transport, v)
+	}
+	if transport == "tcp" {
+		if v := client.Value(MetricTLSHandshakes, "transport", transport, "side", "client", "mode", "full"); v != 1 {
+			t.Error(v)
+		}
+		if v := server.Value(MetricTLSHandshakes, "transport", transport, "side", "server", "mode", "full"); v != 1 {
+			t.Error(v)
+		}
+	}
+	l.Close()
+}
+
+type discardConn struct {
+	net.Conn
+}
+
+func (c *discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func TestObservedConn(t *testing.T) {
+	for _, metrics := range []Metrics{NewMemoryMetrics(), &countMetrics{}} {
+		o := newObserver(metrics, nil, "tcp")
+		conn := o.conn(&discardConn{})
+		b := make([]byte, 64)
+		// The counters are looked up when the connection opens.
+		if allocs := testing.AllocsPerRun(100, func() {
+			conn.Write(b)
+			observedOf(conn).message("write", len(b))
+		}); allocs > 0 {
+			t.Errorf("%T %v allocs", metrics, allocs)
+		}
+		if m, ok := metrics.(*MemoryMetrics); ok {
+			if v := m.Value(MetricBytesWritten, "transport", "tcp"); v != 64*101 {
+				t.Error(v)
+			}
+			if n := m.ObservedCount(MetricMessageSize, "transport", "tcp", "direction", "write"); n != 101 {
+				t.Error(n)
+			}
+		}
+	}
+	// The observed conn can be shut down like the conn it observes.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newObserver(NewMemoryMetrics(), nil, "tcp").conn(server)
+	if _, ok := conn.(syscall.Conn); !ok {
+		t.Fatal("should be a syscall.Conn")
+	}
+	abort(conn)
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Error(err)
+	}
+	if _, err := conn.Write([]byte{0}); err == nil || strings.Contains(err.Error(), "use of closed network connection") {
+		t.Error("should be shut down rather than closed", err)
+	}
+	conn.Close()
+	if _, err := newObserver(NewMemoryMetrics(), nil, "inproc").conn(&discardConn{}).(syscall.Conn).SyscallConn(); err != errNoSyscallConn {
+		t.Error(err)
+	}
+}
+
+type countMetrics struct {
+	count int64
+}
+
+func (m *countMetrics) Count(name string, delta float64, labels ...string) {
+	atomic.AddInt64(&m.count, 1)
+}
+
+func (m *countMetrics) Gauge(name string, delta float64, labels ...string) {}
+
+func (m *countMetrics) Observe(name string, value float64, labels ...string) {}
@@ -0,0 +1,372 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/hslam/netpoll"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// observer records the metrics and calls the hooks of a transport. A nil observer
+// does nothing.
+type observer struct {
+	metrics   Metrics
+	hooks     *Hooks
+	transport string
+	labels    []string
+	mu        sync.Mutex
+	accepted  map[*observedConn]struct{}
+}
+
+// errNoSyscallConn is the error when the observed conn is not a syscall.Conn.
+var errNoSyscallConn = errors.New("conn is not a syscall.Conn")
+
+func newObserver(metrics Metrics, hooks *Hooks, transport string) *observer {
+	if metrics == nil && hooks == nil {
+		return nil
+	}
+	if hooks == nil {
+		hooks = &Hooks{}
+	}
+	return &observer{metrics: metrics, hooks: hooks, transport: transport, labels: []string{"transport", transport}}
+}
+
+// withLabels returns the transport label followed by the labels. The transport label
+// is shared by the calls without labels, so that they allocate nothing.
+func (o *observer) withLabels(labels []string) []string {
+	if len(labels) == 0 {
+		return o.labels
+	}
+	return append(o.labels[:len(o.labels):len(o.labels)], labels...)
+}
+
+func (o *observer) count(name string, labels ...string) {
+	if o != nil && o.metrics != nil {
+		o.metrics.Count(name, 1, o.withLabels(labels)...)
+	}
+}
+
+func (o *observer) gauge(name string, delta float64) {
+	if o != nil && o.metrics != nil {
+		o.metrics.Gauge(name, delta, o.labels...)
+	}
+}
+
+func (o *observer) observe(name string, value float64, labels ...string) {
+	if o != nil && o.metrics != nil {
+		o.metrics.Observe(name, value, o.withLabels(labels)...)
+	}
+}
+
+// stage observes the duration of a stage of Dial since the start.
+func (o *observer) stage(stage string, start time.Time) {
+	o.observe(MetricDialDuration, time.Since(start).Seconds(), "stage", stage)
+}
+
+// dialed records a dial and observes its total duration.
+func (o *observer) dialed(address string, conn Conn, start time.Time, err error) {
+	if o == nil {
+		return
+	}
+	if err != nil {
+		o.count(MetricDials, "result", "failure")
+		o.error("dial", err)
+		if o.hooks.OnDialError != nil {
+			o.hooks.OnDialError(o.transport, address, err)
+		}
+		return
+	}
+	o.count(MetricDials, "result", "success")
+	o.stage("total", start)
+	if o.hooks.OnDial != nil {
+		o.hooks.OnDial(o.transport, address, observedOf(conn))
+	}
+}
+
+// accept records an accepted connection and returns the conn which is observed.
+func (o *observer) accept(conn net.Conn) net.Conn {
+	if o == nil {
+		return conn
+	}
+	o.count(MetricAccepts, "result", "success")
+	conn = o.conn(conn)
+	o.mu.Lock()
+	if o.accepted == nil {
+		o.accepted = make(map[*observedConn]struct{})
+	}
+	o.accepted[conn.(*observedConn)] = struct{}{}
+	o.mu.Unlock()
+	if o.hooks.OnAccept != nil {
+		o.hooks.OnAccept(o.transport, conn)
+	}
+	return conn
+}
+
+// shutdown records the accepted connections which are still open as closed by
+// the listener. The netpoll closes the connections it serves when the listener
+// is closed without calling Close.
+func (o *observer) shutdown() {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	accepted := o.accepted
+	o.accepted = nil
+	o.mu.Unlock()
+	for c := range accepted {
+		c.done(ErrListenerClosed)
+	}
+}
+
+// reject records a connection which has failed the handshake.
+func (o *observer) reject(err error) {
+	o.count(MetricAccepts, "result", "failure")
+	o.error("handshake", err)
+}
+
+// handler returns a netpoll.Handler which observes the connections upgraded
+// by the handler, or the handler itself if the observer is nil.
+func (o *observer) handler(handler netpoll.Handler) netpoll.Handler {
+	if o == nil {
+		return handler
+	}
+	return netpoll.NewHandler(func(conn net.Conn) (netpoll.Context, error) {
+		return handler.Upgrade(o.accept(conn))
+	}, handler.Serve)
+}
+
+// handshake records a completed TLS handshake.
+func (o *observer) handshake(side string, tlsConn *tls.Conn) {
+	if o == nil {
+		return
+	}
+	state := tlsConn.ConnectionState()
+	mode := "full"
+	if state.DidResume {
+		mode = "resumed"
+	}
+	o.count(MetricTLSHandshakes, "side", side, "mode", mode)
+	if o.hooks.OnHandshake != nil {
+		o.hooks.OnHandshake(o.transport, tlsConn, state)
+	}
+}
+
+// upgraded records a completed HTTP upgrade.
+func (o *observer) upgraded(conn net.Conn) {
+	if o != nil && o.hooks.OnUpgrade != nil {
+		o.hooks.OnUpgrade(o.transport, conn)
+	}
+}
+
+// error counts an error by its kind, or as a timeout if it is one.
+func (o *observer) error(kind string, err error) {
+	if e, ok := err.(net.Error); ok && e.Timeout() || err == ErrHandshakeTimeout {
+		kind = "timeout"
+	}
+	o.count(MetricErrors, "kind", kind)
+}
+
+// conn returns a net.Conn which observes the conn, or the conn itself if the
+// observer is nil.
+func (o *observer) conn(conn net.Conn) net.Conn {
+	if o == nil {
+		return conn
+	}
+	o.gauge(MetricActiveConnections, 1)
+	c := &observedConn{Conn: conn, observer: o}
+	if o.metrics != nil {
+		c.bytesReadCounter = o.counter(MetricBytesRead)
+		c.bytesWrittenCounter = o.counter(MetricBytesWritten)
+		c.messagesReadCounter = o.counter(MetricMessagesRead)
+		c.messagesWrittenCounter = o.counter(MetricMessagesWritten)
+		c.readSizeHistogram = o.histogram(MetricMessageSize, "direction", "read")
+		c.writeSizeHistogram = o.histogram(MetricMessageSize, "direction", "write")
+	}
+	return c
+}
+
+// counter returns the counter of the metric with the labels, which is looked up
+// once if the metrics implement SeriesMetrics.
+func (o *observer) counter(name string, labels ...string) Counter {
+	labels = o.withLabels(labels)
+	if m, ok := o.metrics.(SeriesMetrics); ok {
+		return m.Counter(name, labels...)
+	}
+	return &metricsCounter{metrics: o.metrics, name: name, labels: labels}
+}
+
+// histogram returns the histogram of the metric with the labels, which is looked up
+// once if the metrics implement SeriesMetrics.
+func (o *observer) histogram(name string, labels ...string) Histogram {
+	labels = o.withLabels(labels)
+	if m, ok := o.metrics.(SeriesMetrics); ok {
+		return m.Histogram(name, labels...)
+	}
+	return &metricsHistogram{metrics: o.metrics, name: name, labels: labels}
+}
+
+// metricsCounter is the Counter of the Metrics without SeriesMetrics.
+type metricsCounter struct {
+	metrics Metrics
+	name    string
+	labels  []string
+}
+
+func (c *metricsCounter) Add(delta float64) {
+	c.metrics.Count(c.name, delta, c.labels...)
+}
+
+// metricsHistogram is the Histogram of the Metrics without SeriesMetrics.
+type metricsHistogram struct {
+	metrics Metrics
+	name    string
+	labels  []string
+}
+
+func (h *metricsHistogram) Observe(value float64) {
+	h.metrics.Observe(h.name, value, h.labels...)
+}
+
+// observedOf returns the observed connection underlying v if there is one.
+func observedOf(v interface{}) *observedConn {
+	for v != nil {
+		if c, ok := v.(*observedConn); ok {
+			return c
+		}
+		v = unwrap(v)
+	}
+	return nil
+}
+
+// connectionOf returns the conn observed by conn if conn is an observedConn, so that
+// Connection returns the conn of the transport.
+func connectionOf(conn net.Conn) net.Conn {
+	if c, ok := conn.(*observedConn); ok {
+		return c.Conn
+	}
+	return conn
+}
+
+// observedConn records the bytes, the errors, the messages and the lifetime of a connection.
+// The counters and the histograms are looked up when the connection opens, so that
+// the reads, the writes and the messages neither build the labels nor look them up.
+type observedConn struct {
+	net.Conn
+	observer               *observer
+	bytesReadCounter       Counter
+	bytesWrittenCounter    Counter
+	messagesReadCounter    Counter
+	messagesWrittenCounter Counter
+	readSizeHistogram      Histogram
+	writeSizeHistogram     Histogram
+	bytesRead              int64
+	bytesWritten           int64
+	closed                 int32
+}
+
+// SyscallConn returns the raw connection of the observed conn, so that the
+// conn can be shut down like the conn it observes.
+func (c *observedConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.Conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, errNoSyscallConn
+}
+
+func (c *observedConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		atomic.AddInt64(&c.bytesRead, int64(n))
+		if c.bytesReadCounter != nil {
+			c.bytesReadCounter.Add(float64(n))
+		}
+	}
+	if err != nil && err != syscall.EAGAIN {
+		c.fail("read", err)
+	}
+	return
+}
+
+func (c *observedConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if n > 0 {
+		atomic.AddInt64(&c.bytesWritten, int64(n))
+		if c.bytesWrittenCounter != nil {
+			c.bytesWrittenCounter.Add(float64(n))
+		}
+	}
+	if err != nil && err != syscall.EAGAIN {
+		c.fail("write", err)
+	}
+	return
+}
+
+// message records a message of the connection. A nil observedConn does nothing.
+func (c *observedConn) message(direction string, size int) {
+	if c == nil {
+		return
+	}
+	o := c.observer
+	if direction == "read" {
+		if c.messagesReadCounter != nil {
+			c.messagesReadCounter.Add(1)
+			c.readSizeHistogram.Observe(float64(size))
+		}
+		if o.hooks.OnMessageRead != nil {
+			o.hooks.OnMessageRead(o.transport, c, size)
+		}
+	} else {
+		if c.messagesWrittenCounter != nil {
+			c.messagesWrittenCounter.Add(1)
+			c.writeSizeHistogram.Observe(float64(size))
+		}
+		if o.hooks.OnMessageWritten != nil {
+			o.hooks.OnMessageWritten(o.transport, c, size)
+		}
+	}
+}
+
+// fail records the error. The connections served by the netpoll are closed
+// after the errors without calling Close, so they are closed unless the error
+// is a timeout.
+func (c *observedConn) fail(kind string, err error) {
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		c.observer.error(kind, err)
+		return
+	}
+	if err != io.EOF && atomic.LoadInt32(&c.closed) == 0 {
+		c.observer.error(kind, err)
+	}
+	c.done(err)
+}
+
+func (c *observedConn) done(err error) {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return
+	}
+	o := c.observer
+	o.mu.Lock()
+	delete(o.accepted, c)
+	o.mu.Unlock()
+	o.gauge(MetricActiveConnections, -1)
+	if o.hooks.OnClose != nil {
+		o.hooks.OnClose(o.transport, c, CloseInfo{
+			Err:          err,
+			BytesRead:    atomic.LoadInt64(&c.bytesRead),
+			BytesWritten: atomic.LoadInt64(&c.bytesWritten),
+		})
+	}
+}
+
+func (c *observedConn) Close() error {
+	c.done(nil)
+	return c.Conn.Close()
+}
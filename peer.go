@@ -0,0 +1,96 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/url"
+)
+
+// PeerIdentity is the identity parsed from the verified certificate of a TLS peer.
+type PeerIdentity struct {
+	// CommonName is the common name of the certificate's subject.
+	CommonName string
+	// DNSNames are the DNS names of the subject alternative names.
+	DNSNames []string
+	// EmailAddresses are the email addresses of the subject alternative names.
+	EmailAddresses []string
+	// IPAddresses are the IP addresses of the subject alternative names.
+	IPAddresses []net.IP
+	// URIs are the URIs of the subject alternative names.
+	URIs []*url.URL
+	// SPIFFEID is the first URI with the spiffe scheme, or nil if there is none.
+	SPIFFEID *url.URL
+	// Certificate is the leaf certificate.
+	Certificate *x509.Certificate
+}
+
+// TLSConnOf returns the *tls.Conn underlying the Conn, the net.Conn passed to the opened
+// func of ServeConn or the Messages passed to the opened func of ServeMessages.
+// It returns nil if the connection is not secured by TLS.
+func TLSConnOf(v interface{}) *tls.Conn {
+	for v != nil {
+		if c, ok := v.(*tls.Conn); ok {
+			return c
+		}
+		v = unwrap(v)
+	}
+	return nil
+}
+
+// NegotiatedProtocolOf returns the application level protocol negotiated by ALPN
+// on the TLS connection underlying v, or an empty string if there is none.
+func NegotiatedProtocolOf(v interface{}) string {
+	c := TLSConnOf(v)
+	if c == nil {
+		return ""
+	}
+	return c.ConnectionState().NegotiatedProtocol
+}
+
+// VerifiedChainOf returns the verified certificate chain of the TLS peer, starting with
+// the leaf certificate. It returns nil if the peer has presented no certificate
+// or the certificate has not been verified.
+func VerifiedChainOf(v interface{}) []*x509.Certificate {
+	c := TLSConnOf(v)
+	if c == nil {
+		return nil
+	}
+	state := c.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0]
+}
+
+// PeerIdentityOf returns the identity of the TLS peer parsed from its verified
+// certificate. It returns nil if there is no verified certificate.
+func PeerIdentityOf(v interface{}) *PeerIdentity {
+	chain := VerifiedChainOf(v)
+	if len(chain) == 0 {
+		return nil
+	}
+	return ParsePeerIdentity(chain[0])
+}
+
+// ParsePeerIdentity parses the identity of the certificate.
+func ParsePeerIdentity(cert *x509.Certificate) *PeerIdentity {
+	identity := &PeerIdentity{
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		IPAddresses:    cert.IPAddresses,
+		URIs:           cert.URIs,
+		Certificate:    cert,
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			identity.SPIFFEID = uri
+			break
+		}
+	}
+	return identity
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClientCertificate returns a CA certificate and a client certificate with its key signed by the CA.
+func testClientCertificate(t *testing.T) (caPEM, certPEM, keyPEM []byte) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "client ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spiffeID, _ := url.Parse("spiffe://hslam.com/client")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "client"},
+		DNSNames:     []string{"client.hslam.com"},
+		URIs:         []*url.URL{spiffeID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return
+}
+
+func testPeerIdentity(t *testing.T, v interface{}) {
+	identity := PeerIdentityOf(v)
+	if identity == nil {
+		t.Error("should have a peer identity")
+		return
+	}
+	if identity.CommonName != "client" {
+		t.Error(identity.CommonName)
+	}
+	if len(identity.DNSNames) != 1 || identity.DNSNames[0] != "client.hslam.com" {
+		t.Error(identity.DNSNames)
+	}
+	if identity.SPIFFEID == nil || identity.SPIFFEID.String() != "spiffe://hslam.com/client" {
+		t.Error(identity.SPIFFEID)
+	}
+	if chain := VerifiedChainOf(v); len(chain) != 2 || chain[1].Subject.CommonName != "client ca" {
+		t.Error(chain)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	caPEM, certPEM, keyPEM := testClientCertificate(t)
+	serverConfig := MutualServerTLSConfig(DefaultServerCertPEM, DefaultServerKeyPEM, caPEM, tls.RequireAndVerifyClientCert)
+	clientConfig := func() *tls.Config {
+		return MutualClientTLSConfig(DefaultRootCertPEM, certPEM, keyPEM, DefalutServerName("hello"))
+	}
+	var addr = ":9999"
+	for i := 0; i < 3; i++ {
+		for _, serverSock := range []Socket{NewTCPSocket(serverConfig), NewHTTPSocket(serverConfig), NewWSSocket(serverConfig)} {
+			l, err := serverSock.Listen(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wg := sync.WaitGroup{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serve := func(context Context) error {
+					messages := context.(Messages)
+					msg, err := messages.ReadMessage(nil)
+					if err != nil {
+						return err
+					}
+					return messages.WriteMessage(msg)
+				}
+				switch i {
+				case 0:
+					conn, err := l.Accept()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					testPeerIdentity(t, conn)
+					messages := conn.Messages()
+					for serve(messages) == nil {
+					}
+					messages.Close()
+				case 1:
+					l.ServeConn(func(conn net.Conn) (Context, error) {
+						testPeerIdentity(t, conn)
+						if ws, ok := conn.(*WSConn); ok {
+							return ws, nil
+						}
+						return NewMessages(conn, false), nil
+					}, serve)
+				case 2:
+					l.ServeMessages(func(messages Messages) (Context, error) {
+						testPeerIdentity(t, messages)
+						return messages, nil
+					}, serve)
+				}
+			}()
+			var clientSock Socket
+			switch serverSock.(type) {
+			case *TCP:
+				clientSock = NewTCPSocket(clientConfig())
+			case *HTTP:
+				clientSock = NewHTTPSocket(clientConfig())
+			case *WS:
+				clientSock = NewWSSocket(clientConfig())
+			}
+			conn, err := clientSock.Dial(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chain := VerifiedChainOf(conn); len(chain) == 0 || chain[0].Subject.CommonName != "servername" {
+				t.Error(chain)
+			}
+			if PeerIdentityOf(conn.Messages()) == nil {
+				t.Error("should have a peer identity")
+			}
+			messages := conn.Messages()
+			str := "Hello World"
+			messages.WriteMessage([]byte(str))
+			if msg, err := messages.ReadMessage(nil); err != nil {
+				t.Error(err)
+			} else if string(msg) != str {
+				t.Errorf("error %s != %s", string(msg), str)
+			}
+			messages.Close()
+			if i == 0 {
+				wg.Wait()
+			}
+			l.Close()
+			wg.Wait()
+		}
+	}
+}
+
+func TestPeerIdentityOf(t *testing.T) {
+	if PeerIdentityOf(&TCPConn{}) != nil {
+		t.Error("should be nil")
+	}
+	if VerifiedChainOf(nil) != nil {
+		t.Error("should be nil")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrPinMismatch is the error when no certificate of the peer matches the pins.
+var ErrPinMismatch = errors.New("certificate pin mismatch")
+
+// PinSet is a set of the SHA-256 pins of the SubjectPublicKeyInfo of the certificates,
+// encoded in base64 like the pin-sha256 of HTTP Public Key Pinning.
+// If the chain of the peer has been verified, a pin may match any certificate of the
+// verified chains, such as an intermediate or a root. Otherwise only the leaf
+// certificate is pinned, since the rest of the unverified chain proves nothing.
+type PinSet struct {
+	// Pins are the pins of the current keys.
+	Pins []string
+	// BackupPins are the pins of the keys to rotate to, which are accepted as well.
+	BackupPins []string
+}
+
+// SPKIPin returns the SHA-256 pin of the SubjectPublicKeyInfo of the certificate.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Verify returns nil if the leaf certificate, which is the first of the certificates,
+// matches a pin or a backup pin. The other certificates are ignored, since they are
+// not verified to have issued the leaf.
+func (s *PinSet) Verify(certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("%w: the peer presented no certificate", ErrPinMismatch)
+	}
+	pin := SPKIPin(certs[0])
+	if s.contains(pin) {
+		return nil
+	}
+	return fmt.Errorf("%w: the peer presented %s", ErrPinMismatch, pin)
+}
+
+// VerifyChains returns nil if any certificate of the verified chains matches a pin or
+// a backup pin.
+func (s *PinSet) VerifyChains(chains [][]*x509.Certificate) error {
+	var presented []string
+	for _, chain := range chains {
+		for _, cert := range chain {
+			pin := SPKIPin(cert)
+			if s.contains(pin) {
+				return nil
+			}
+			presented = append(presented, pin)
+		}
+	}
+	if len(presented) == 0 {
+		return fmt.Errorf("%w: the peer presented no certificate", ErrPinMismatch)
+	}
+	return fmt.Errorf("%w: the peer presented %s", ErrPinMismatch, strings.Join(presented, ", "))
+}
+
+func (s *PinSet) contains(pin string) bool {
+	for _, p := range s.Pins {
+		if p == pin {
+			return true
+		}
+	}
+	for _, p := range s.BackupPins {
+		if p == pin {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyPins verifies the verified chains of the TLS connection, or the leaf certificate
+// if the chain verification is skipped, if the pins are not nil.
+func verifyPins(pins *PinSet, tlsConn *tls.Conn) error {
+	if pins == nil {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) > 0 {
+		return pins.VerifyChains(state.VerifiedChains)
+	}
+	return pins.Verify(state.PeerCertificates)
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestPinSet(t *testing.T) {
+	testPinSet(&TCP{Config: DefalutServerTLSConfig()}, func(pins *PinSet) Socket {
+		return &TCP{Config: SkipVerifyTLSConfig(), Options: Options{Pins: pins}}
+	}, t)
+	testPinSet(&WS{Config: DefalutServerTLSConfig()}, func(pins *PinSet) Socket {
+		return &WS{Config: SkipVerifyTLSConfig(), Options: Options{Pins: pins}}
+	}, t)
+}
+
+func testPinSet(serverSock Socket, newClientSocket func(pins *PinSet) Socket, t *testing.T) {
+	cert, err := tls.X509KeyPair(DefaultServerCertPEM, DefaultServerKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := NewCA(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addr = ":9999"
+	l, err := serverSock.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if e, ok := err.(*net.OpError); ok && e.Op == "accept" {
+					return
+				}
+				continue
+			}
+			conn.Close()
+		}
+	}()
+	for _, pins := range []*PinSet{
+		{Pins: []string{SPKIPin(leaf)}},
+		{Pins: []string{SPKIPin(ca.Certificate)}, BackupPins: []string{SPKIPin(leaf)}},
+	} {
+		conn, err := newClientSocket(pins).Dial(addr)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		conn.Close()
+	}
+	for _, pins := range []*PinSet{
+		{Pins: []string{SPKIPin(ca.Certificate)}},
+		{},
+	} {
+		if _, err := newClientSocket(pins).Dial(addr); !errors.Is(err, ErrPinMismatch) {
+			t.Error(err)
+		}
+	}
+	l.Close()
+}
+
+func TestPinSetChain(t *testing.T) {
+	cert, err := tls.X509KeyPair(DefaultServerCertPEM, DefaultServerKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := NewCA(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := ca.IssueServerCertificate(&CertificateOptions{DNSNames: []string{"localhost"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuedLeaf, err := x509.ParseCertificate(issued.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The attacker presents its own leaf with the pinned certificate in the chain.
+	attacker := issued
+	attacker.Certificate = append([][]byte{issued.Certificate[0]}, cert.Certificate[0])
+	listen := func(certificate tls.Certificate) Listener {
+		l, err := NewTCPSocket(&tls.Config{Certificates: []tls.Certificate{certificate}}).Listen(":9999")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					if e, ok := err.(*net.OpError); ok && e.Op == "accept" {
+						return
+					}
+					continue
+				}
+				conn.Close()
+			}
+		}()
+		return l
+	}
+	l := listen(attacker)
+	pins := &PinSet{Pins: []string{SPKIPin(leaf)}}
+	if _, err := (&TCP{Config: SkipVerifyTLSConfig(), Options: Options{Pins: pins}}).Dial(":9999"); !errors.Is(err, ErrPinMismatch) {
+		t.Error(err)
+	}
+	l.Close()
+	// The verified chain is pinned by the root.
+	l = listen(issued)
+	clientConfig, err := ca.ClientTLSConfig("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pins := range []*PinSet{
+		{Pins: []string{SPKIPin(ca.Certificate)}},
+		{Pins: []string{SPKIPin(issuedLeaf)}},
+	} {
+		conn, err := (&TCP{Config: clientConfig, Options: Options{Pins: pins}}).Dial(":9999")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		conn.Close()
+	}
+	// The root is not pinned if the chain is not verified.
+	if _, err := (&TCP{Config: SkipVerifyTLSConfig(), Options: Options{Pins: &PinSet{Pins: []string{SPKIPin(ca.Certificate)}}}}).Dial(":9999"); !errors.Is(err, ErrPinMismatch) {
+		t.Error(err)
+	}
+	l.Close()
+	if err := (&PinSet{}).Verify(nil); !errors.Is(err, ErrPinMismatch) {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,538 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/hslam/netpoll"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PSKMinKeySize is the minimum size of a pre-shared key.
+const PSKMinKeySize = 32
+
+const (
+	pskNonceSize        = 32
+	pskMACSize          = sha256.Size
+	pskMaxPlaintextSize = 1024 * 16
+	pskRecordHeaderSize = 2
+	// pskReadBufferSize holds two records of the largest size with the 16-byte tag
+	// of AES-GCM, so that a read can take the next record while completing a partial one.
+	pskReadBufferSize = 2 * (pskRecordHeaderSize + pskMaxPlaintextSize + 16)
+	// pskCloseTimeout is the time to wait for the peer to read the close record.
+	pskCloseTimeout = time.Second * 5
+)
+
+// pskSuffix is the suffix of the scheme of a PSK socket.
+const pskSuffix = "+psk"
+
+// pskMagic starts the handshake of the client.
+var pskMagic = []byte("PSK1")
+
+// ErrPSKHandshake is the error when the peer does not know the pre-shared key.
+var ErrPSKHandshake = errors.New("psk handshake failed")
+
+// ErrPSKKey is the error when the pre-shared key is shorter than PSKMinKeySize.
+var ErrPSKKey = errors.New("psk key is shorter than 32 bytes")
+
+// ErrPSKRecord is the error when a record fails the authentication.
+var ErrPSKRecord = errors.New("psk record authentication failed")
+
+// PSK implements the Socket interface by securing the connections of another Socket
+// with a pre-shared key instead of X.509 certificates.
+//
+// Both sides exchange random nonces and prove that they know the key, then the traffic
+// is framed into records sealed by AES-256-GCM with a key for each direction.
+// Close sends a record without plaintext, so that the reader can tell the end of
+// the stream from a truncation.
+// The keys are derived from the pre-shared key and the nonces, so there is no
+// forward secrecy if the pre-shared key leaks.
+type PSK struct {
+	// Socket is the underlying socket.
+	Socket Socket
+	// Key is the pre-shared key, which must be at least PSKMinKeySize random bytes.
+	Key []byte
+	// HandshakeTimeout is the maximum duration of the handshake of Dial and of an accepted
+	// connection. Zero means DefaultHandshakeTimeout, and a negative value means no timeout.
+	HandshakeTimeout time.Duration
+	// MaxConcurrentHandshakes is the maximum number of the accepted connections in handshake.
+	// Zero means DefaultMaxConcurrentHandshakes, and a negative value means no limit.
+	MaxConcurrentHandshakes int
+}
+
+// NewPSKSocket returns a new socket by a network like NewSocket, which secures
+// the connections with the pre-shared key.
+func NewPSKSocket(network string, key []byte) (Socket, error) {
+	if len(key) < PSKMinKeySize {
+		return nil, ErrPSKKey
+	}
+	s, err := NewSocket(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &PSK{Socket: s, Key: key}, nil
+}
+
+// Scheme returns the socket's scheme.
+func (t *PSK) Scheme() string {
+	return t.Socket.Scheme() + pskSuffix
+}
+
+// Dial connects to an address.
+func (t *PSK) Dial(address string) (Conn, error) {
+	if len(t.Key) < PSKMinKeySize {
+		return nil, ErrPSKKey
+	}
+	conn, err := t.Socket.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	c := newPSKConn(conn, t.Key, true)
+	if err = newHandshaker(t.HandshakeTimeout, -1, nil, nil).do(conn, c.Handshake); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Listen announces on the local address.
+func (t *PSK) Listen(address string) (Listener, error) {
+	if len(t.Key) < PSKMinKeySize {
+		return nil, ErrPSKKey
+	}
+	lis, err := t.Socket.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return &PSKListener{l: lis, key: t.Key, handshaker: newHandshaker(t.HandshakeTimeout, t.MaxConcurrentHandshakes, nil, nil)}, nil
+}
+
+// PSKListener implements the Listener interface.
+type PSKListener struct {
+	l          Listener
+	key        []byte
+	handshaker *handshaker
+}
+
+func (l *PSKListener) handshake(conn net.Conn) (*PSKConn, error) {
+	c := newPSKConn(conn, l.key, false)
+	if err := l.handshaker.do(conn, c.Handshake); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *PSKListener) Accept() (Conn, error) {
+	conn, err := l.l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c, err := l.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Serve serves the netpoll.Handler by the netpoll.
+func (l *PSKListener) Serve(handler netpoll.Handler) error {
+	if handler == nil {
+		return ErrHandler
+	}
+	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
+		c, err := l.handshake(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return handler.Upgrade(c)
+	}
+	return l.l.Serve(netpoll.NewHandler(Upgrade, handler.Serve))
+}
+
+// ServeData serves the opened func and the serve func by the netpoll.
+func (l *PSKListener) ServeData(opened func(net.Conn) error, serve func(req []byte) (res []byte)) error {
+	if serve == nil {
+		return ErrServe
+	}
+	type dataContext struct {
+		Conn net.Conn
+		buf  []byte
+	}
+	Upgrade := func(conn net.Conn) (Context, error) {
+		c, err := l.handshake(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if opened != nil {
+			if err := opened(c); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+		ctx := &dataContext{
+			Conn: c,
+			buf:  make([]byte, 1024*64),
+		}
+		return ctx, nil
+	}
+	Serve := func(context Context) error {
+		c := context.(*dataContext)
+		n, err := c.Conn.Read(c.buf)
+		if err != nil {
+			return err
+		}
+		res := serve(c.buf[:n])
+		if len(res) == 0 {
+			return nil
+		}
+		_, err = c.Conn.Write(res)
+		return err
+	}
+	return l.l.ServeConn(Upgrade, Serve)
+}
+
+// ServeConn serves the opened func and the serve func by the netpoll.
+func (l *PSKListener) ServeConn(opened func(net.Conn) (Context, error), serve func(Context) error) error {
+	if opened == nil {
+		return ErrOpened
+	} else if serve == nil {
+		return ErrServe
+	}
+	Upgrade := func(conn net.Conn) (Context, error) {
+		c, err := l.handshake(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return opened(c)
+	}
+	return l.l.ServeConn(Upgrade, serve)
+}
+
+// ServeMessages serves the opened func and the serve func by the netpoll.
+func (l *PSKListener) ServeMessages(opened func(Messages) (Context, error), serve func(Context) error) error {
+	if opened == nil {
+		return ErrOpened
+	} else if serve == nil {
+		return ErrServe
+	}
+	Upgrade := func(conn net.Conn) (Context, error) {
+		c, err := l.handshake(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		messages := NewMessages(c, true)
+		return opened(messages)
+	}
+	return l.l.ServeConn(Upgrade, serve)
+}
+
+// Close closes the listener.
+func (l *PSKListener) Close() error {
+	return l.l.Close()
+}
+
+// Addr returns the listener's network address.
+func (l *PSKListener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
+// PSKConn implements the Conn interface.
+type PSKConn struct {
+	net.Conn
+	key          []byte
+	isClient     bool
+	handshakeMu  sync.Mutex
+	handshaked   bool
+	handshakeErr error
+	completed    int32
+	closeSent    bool
+	closeRead    bool
+	reading      sync.Mutex
+	writing      sync.Mutex
+	readAEAD     cipher.AEAD
+	writeAEAD    cipher.AEAD
+	readSeq      uint64
+	writeSeq     uint64
+	readNonce    []byte
+	writeNonce   []byte
+	readBuffer   []byte
+	input        []byte
+	plaintext    []byte
+	writeBuffer  []byte
+}
+
+func newPSKConn(conn net.Conn, key []byte, isClient bool) *PSKConn {
+	return &PSKConn{Conn: conn, key: key, isClient: isClient}
+}
+
+// Messages returns a new Messages.
+func (c *PSKConn) Messages() Messages {
+	return NewMessages(c, false)
+}
+
+// Connection returns the net.Conn.
+func (c *PSKConn) Connection() net.Conn {
+	return c.Conn
+}
+
+// NegotiatedProtocol returns the application level protocol negotiated by ALPN.
+func (c *PSKConn) NegotiatedProtocol() string {
+	return NegotiatedProtocolOf(c)
+}
+
+// Handshake runs the handshake if it has not yet been run.
+// Read and Write call it automatically.
+func (c *PSKConn) Handshake() error {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	if !c.handshaked {
+		c.handshaked = true
+		if c.isClient {
+			c.handshakeErr = c.clientHandshake()
+		} else {
+			c.handshakeErr = c.serverHandshake()
+		}
+		if c.handshakeErr == nil {
+			atomic.StoreInt32(&c.completed, 1)
+		}
+	}
+	return c.handshakeErr
+}
+
+func (c *PSKConn) clientHandshake() error {
+	hello := make([]byte, len(pskMagic)+pskNonceSize)
+	copy(hello, pskMagic)
+	clientNonce := hello[len(pskMagic):]
+	if _, err := io.ReadFull(rand.Reader, clientNonce); err != nil {
+		return err
+	}
+	if _, err := c.Conn.Write(hello); err != nil {
+		return err
+	}
+	reply := make([]byte, pskNonceSize+pskMACSize)
+	if _, err := io.ReadFull(c.Conn, reply); err != nil {
+		return err
+	}
+	serverNonce := reply[:pskNonceSize]
+	confirmKey := c.deriveKeys(clientNonce, serverNonce)
+	if !hmac.Equal(reply[pskNonceSize:], pskMAC(confirmKey, "server", clientNonce, serverNonce)) {
+		return ErrPSKHandshake
+	}
+	_, err := c.Conn.Write(pskMAC(confirmKey, "client", clientNonce, serverNonce))
+	return err
+}
+
+func (c *PSKConn) serverHandshake() error {
+	hello := make([]byte, len(pskMagic)+pskNonceSize)
+	if _, err := io.ReadFull(c.Conn, hello); err != nil {
+		return err
+	}
+	if !hmac.Equal(hello[:len(pskMagic)], pskMagic) {
+		return ErrPSKHandshake
+	}
+	clientNonce := hello[len(pskMagic):]
+	serverNonce := make([]byte, pskNonceSize)
+	if _, err := io.ReadFull(rand.Reader, serverNonce); err != nil {
+		return err
+	}
+	confirmKey := c.deriveKeys(clientNonce, serverNonce)
+	reply := append(serverNonce, pskMAC(confirmKey, "server", clientNonce, serverNonce)...)
+	if _, err := c.Conn.Write(reply); err != nil {
+		return err
+	}
+	mac := make([]byte, pskMACSize)
+	if _, err := io.ReadFull(c.Conn, mac); err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, pskMAC(confirmKey, "client", clientNonce, serverNonce)) {
+		return ErrPSKHandshake
+	}
+	return nil
+}
+
+// deriveKeys derives the traffic keys and returns the key to confirm the handshake.
+func (c *PSKConn) deriveKeys(clientNonce, serverNonce []byte) []byte {
+	secret := pskMAC(c.key, "secret", clientNonce, serverNonce)
+	clientAEAD := newPSKAEAD(pskMAC(secret, "client write key"))
+	serverAEAD := newPSKAEAD(pskMAC(secret, "server write key"))
+	if c.isClient {
+		c.readAEAD, c.writeAEAD = serverAEAD, clientAEAD
+	} else {
+		c.readAEAD, c.writeAEAD = clientAEAD, serverAEAD
+	}
+	c.readNonce = make([]byte, c.readAEAD.NonceSize())
+	c.writeNonce = make([]byte, c.writeAEAD.NonceSize())
+	return pskMAC(secret, "confirm key")
+}
+
+func pskMAC(key []byte, label string, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func newPSKAEAD(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// Read reads the plaintext of the records. It returns io.EOF after the close record,
+// or io.ErrUnexpectedEOF if the stream ends without the close record.
+func (c *PSKConn) Read(b []byte) (n int, err error) {
+	if err = c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.reading.Lock()
+	defer c.reading.Unlock()
+	for len(c.plaintext) == 0 {
+		if c.closeRead {
+			return 0, io.EOF
+		}
+		if err = c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(b, c.plaintext)
+	c.plaintext = c.plaintext[n:]
+	return n, nil
+}
+
+// readRecord reads and opens the next record. The bytes of a partial record are kept
+// in the input when the conn returns an error like the EAGAIN of the netpoll, so that
+// the next call resumes the record instead of losing them.
+func (c *PSKConn) readRecord() error {
+	for {
+		if len(c.input) >= pskRecordHeaderSize {
+			length := int(binary.BigEndian.Uint16(c.input))
+			if length < c.readAEAD.Overhead() || length > pskMaxPlaintextSize+c.readAEAD.Overhead() {
+				return ErrPSKRecord
+			}
+			if size := pskRecordHeaderSize + length; len(c.input) >= size {
+				return c.openRecord(c.input[:pskRecordHeaderSize], c.input[pskRecordHeaderSize:size])
+			}
+		}
+		if c.readBuffer == nil {
+			c.readBuffer = make([]byte, pskReadBufferSize)
+		}
+		// The plaintext of the previous record has been read, so the partial
+		// record is moved to the front of the buffer.
+		c.input = c.readBuffer[:copy(c.readBuffer, c.input)]
+		n, err := c.Conn.Read(c.readBuffer[len(c.input):])
+		c.input = c.readBuffer[:len(c.input)+n]
+		if n == 0 && err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+}
+
+// openRecord opens the record in place and consumes it from the input.
+func (c *PSKConn) openRecord(header, record []byte) error {
+	c.input = c.input[len(header)+len(record):]
+	binary.BigEndian.PutUint64(c.readNonce[len(c.readNonce)-8:], c.readSeq)
+	c.readSeq++
+	plaintext, err := c.readAEAD.Open(record[:0], c.readNonce, record, header)
+	if err != nil {
+		return ErrPSKRecord
+	}
+	// The record without plaintext is the close record.
+	c.closeRead = len(plaintext) == 0
+	c.plaintext = plaintext
+	return nil
+}
+
+// Write seals b into the records.
+func (c *PSKConn) Write(b []byte) (n int, err error) {
+	if err = c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.writing.Lock()
+	defer c.writing.Unlock()
+	for len(b) > 0 {
+		size := len(b)
+		if size > pskMaxPlaintextSize {
+			size = pskMaxPlaintextSize
+		}
+		if err = c.writeRecord(b[:size]); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+func (c *PSKConn) writeRecord(p []byte) error {
+	length := len(p) + c.writeAEAD.Overhead()
+	if cap(c.writeBuffer) < pskRecordHeaderSize+length {
+		c.writeBuffer = make([]byte, pskRecordHeaderSize+pskMaxPlaintextSize+c.writeAEAD.Overhead())
+	}
+	var header [pskRecordHeaderSize]byte
+	binary.BigEndian.PutUint16(header[:], uint16(length))
+	binary.BigEndian.PutUint64(c.writeNonce[len(c.writeNonce)-8:], c.writeSeq)
+	c.writeSeq++
+	record := append(c.writeBuffer[:0], header[:]...)
+	record = c.writeAEAD.Seal(record, c.writeNonce, p, header[:])
+	_, err := c.Conn.Write(record)
+	return err
+}
+
+// Close sends the close record if the handshake has completed, then closes the connection.
+func (c *PSKConn) Close() error {
+	var closeErr error
+	if atomic.LoadInt32(&c.completed) == 1 {
+		closeErr = c.closeNotify()
+	}
+	if err := c.Conn.Close(); err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// closeNotify writes the close record once, which authenticates the end of the stream.
+func (c *PSKConn) closeNotify() error {
+	c.writing.Lock()
+	defer c.writing.Unlock()
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+	if c.Conn.SetWriteDeadline(time.Now().Add(pskCloseTimeout)) == nil {
+		return c.writeRecord(nil)
+	}
+	// The conns without deadlines are closed if the peer does not read the close record in time.
+	timer := time.AfterFunc(pskCloseTimeout, func() {
+		c.Conn.Close()
+	})
+	defer timer.Stop()
+	return c.writeRecord(nil)
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testPSK = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestPSKSocket(network string, t *testing.T) Socket {
+	s, err := NewPSKSocket(network, testPSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestPSKSocket(t *testing.T) {
+	if _, err := NewPSKSocket("udp", testPSK); err != ErrNetwork {
+		t.Error(err)
+	}
+	if _, err := NewPSKSocket("tcp", []byte("secret")); err != ErrPSKKey {
+		t.Error(err)
+	}
+	for _, network := range []string{"tcp+psk", "tcps+psk", "inproc+psk"} {
+		if s, err := NewSocket(network, nil); err != nil {
+			t.Error(err)
+		} else if _, ok := s.(*PSK); !ok {
+			t.Error(s)
+		} else if s.Scheme() != strings.Replace(network, "s+", "+", 1) {
+			t.Error(s.Scheme())
+		}
+	}
+	if _, err := NewSocket("udp+psk", nil); err != ErrNetwork {
+		t.Error(err)
+	}
+	if _, err := (&PSK{Socket: NewTCPSocket(nil), Key: testPSK[:PSKMinKeySize-1]}).Dial(":9999"); err != ErrPSKKey {
+		t.Error(err)
+	}
+	if _, err := (&PSK{Socket: NewTCPSocket(nil)}).Listen(":9999"); err != ErrPSKKey {
+		t.Error(err)
+	}
+	for _, network := range []string{"tcp", "unix", "inproc"} {
+		testSocket(newTestPSKSocket(network, t), newTestPSKSocket(network, t), network+"+psk", t)
+	}
+	for _, network := range []string{"tcp", "unix", "inproc"} {
+		testSocketServeData(newTestPSKSocket(network, t), newTestPSKSocket(network, t), t)
+		testSocketServeConn(newTestPSKSocket(network, t), newTestPSKSocket(network, t), t)
+		testSocketServeMessages(newTestPSKSocket(network, t), newTestPSKSocket(network, t), t)
+	}
+}
+
+func TestPSKSocketKey(t *testing.T) {
+	var addr = ":9999"
+	l, err := newTestPSKSocket("tcp", t).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if e, ok := err.(*net.OpError); ok && e.Op == "accept" {
+					return
+				}
+				errs <- err
+				continue
+			}
+			conn.Close()
+		}
+	}()
+	if _, err := (&PSK{Socket: NewTCPSocket(nil), Key: []byte("fedcba9876543210fedcba9876543210")}).Dial(addr); err != ErrPSKHandshake {
+		t.Error(err)
+	}
+	// The client rejects the server first and closes the connection.
+	if err := <-errs; err == nil {
+		t.Error("should be failed")
+	}
+	l.Close()
+}
+
+func TestPSKSocketHandshakeTimeout(t *testing.T) {
+	var addr = ":9999"
+	for _, s := range []Socket{NewTCPSocket(nil), NewINPROCSocket(nil)} {
+		// The listener never replies to the handshake.
+		l, err := s.Listen(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go io.Copy(ioutil.Discard, conn)
+			}
+		}()
+		start := time.Now()
+		if _, err := (&PSK{Socket: s, Key: testPSK, HandshakeTimeout: time.Millisecond * 50}).Dial(addr); err != ErrHandshakeTimeout {
+			t.Error(err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Error(d)
+		}
+		l.Close()
+	}
+}
+
+func TestPSKConn(t *testing.T) {
+	server, client := net.Pipe()
+	serverConn, clientConn := newPSKConn(server, testPSK, false), newPSKConn(client, testPSK, true)
+	data := bytes.Repeat([]byte("Hello World"), pskMaxPlaintextSize/5)
+	go clientConn.Write(data)
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(serverConn, buf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, data) {
+		t.Error("the data should be equal")
+	}
+	records := &bytes.Buffer{}
+	clientConn.Conn = &bufferConn{Conn: client, buf: records}
+	serverConn.Conn = &bufferConn{Conn: server, buf: records}
+	clientConn.Write([]byte("Hello World"))
+	records.Bytes()[records.Len()-1] ^= 1
+	if _, err := serverConn.Read(buf); err != ErrPSKRecord {
+		t.Error(err)
+	}
+	server.Close()
+	client.Close()
+}
+
+func TestPSKConnClose(t *testing.T) {
+	newPair := func() (serverConn, clientConn *PSKConn) {
+		server, client := net.Pipe()
+		serverConn, clientConn = newPSKConn(server, testPSK, false), newPSKConn(client, testPSK, true)
+		go clientConn.Handshake()
+		if err := serverConn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	buf := make([]byte, 64)
+	// The close record ends the stream.
+	serverConn, clientConn := newPair()
+	go func() {
+		clientConn.Write([]byte("Hello World"))
+		clientConn.Close()
+	}()
+	if n, err := serverConn.Read(buf); err != nil || string(buf[:n]) != "Hello World" {
+		t.Error(string(buf[:n]), err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := serverConn.Read(buf); err != io.EOF {
+			t.Error(err)
+		}
+	}
+	serverConn.Close()
+	// The stream without the close record is truncated.
+	serverConn, clientConn = newPair()
+	go func() {
+		clientConn.Write([]byte("Hello World"))
+		clientConn.Conn.Close()
+	}()
+	if n, err := serverConn.Read(buf); err != nil || string(buf[:n]) != "Hello World" {
+		t.Error(string(buf[:n]), err)
+	}
+	if _, err := serverConn.Read(buf); err != io.ErrUnexpectedEOF {
+		t.Error(err)
+	}
+	serverConn.Close()
+	// The stream is truncated in a record.
+	serverConn, clientConn = newPair()
+	records := &bytes.Buffer{}
+	clientConn.Conn = &bufferConn{Conn: clientConn.Conn, buf: records}
+	clientConn.Write([]byte("Hello World"))
+	records.Truncate(records.Len() - 1)
+	serverConn.Conn = &bufferConn{Conn: serverConn.Conn, buf: records}
+	if _, err := serverConn.Read(buf); err != io.ErrUnexpectedEOF {
+		t.Error(err)
+	}
+	serverConn.Conn.(*bufferConn).Conn.Close()
+	clientConn.Conn.(*bufferConn).Conn.Close()
+}
+
+type bufferConn struct {
+	net.Conn
+	buf *bytes.Buffer
+}
+
+func (c *bufferConn) Read(b []byte) (int, error) {
+	return c.buf.Read(b)
+}
+
+func (c *bufferConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
@@ -0,0 +1,15 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package socket
+
+import (
+	"syscall"
+)
+
+func shutdown(fd uintptr) error {
+	return syscall.Shutdown(int(fd), syscall.SHUT_RDWR)
+}
@@ -0,0 +1,548 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSimReset is the error returned by the reads and the writes of a reset simulated connection.
+var ErrSimReset = errors.New("connection reset by peer")
+
+// ErrSimRefused is the error returned when dialing an address without a simulated listener.
+var ErrSimRefused = errors.New("connection refused")
+
+// ErrSimUnreachable is the error returned when dialing an address over a partitioned link.
+var ErrSimUnreachable = errors.New("network is unreachable")
+
+var errSimClosed = errors.New("use of closed network connection")
+
+// SimFaults are the faults of a simulated link. Each direction of a connection
+// is simulated independently.
+type SimFaults struct {
+	// Latency is the one-way delay of the packets. Dial takes a round trip.
+	Latency time.Duration
+	// Jitter is the maximum random delay added to the latency. The packets are never reordered.
+	Jitter time.Duration
+	// Bandwidth is the maximum number of bytes per second. Zero means unlimited.
+	// The writes block while the link is busy.
+	Bandwidth int
+	// MTU is the maximum size of a packet. Zero means unlimited.
+	// A Read returns the data of at most one packet.
+	MTU int
+	// Fragment splits the writes into the packets of random sizes up to the MTU.
+	Fragment bool
+	// ResetRate is the probability in [0, 1] that a write resets the connection.
+	ResetRate float64
+}
+
+// SimNetwork is a simulated in-process network. The faults of the links between
+// the dialers and the listening addresses can be changed at runtime.
+type SimNetwork struct {
+	mu        sync.Mutex
+	rand      *rand.Rand
+	listeners map[string]*simListener
+	links     map[string]*SimLink
+	conns     uint64
+}
+
+// DefaultSimNetwork is the simulated network of the SIM sockets without a network.
+var DefaultSimNetwork = NewSimNetwork()
+
+// NewSimNetwork returns a new simulated network.
+func NewSimNetwork() *SimNetwork {
+	return &SimNetwork{
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		listeners: make(map[string]*simListener),
+		links:     make(map[string]*SimLink),
+	}
+}
+
+// Seed seeds the random faults of the network, so that they are reproducible.
+func (n *SimNetwork) Seed(seed int64) {
+	n.mu.Lock()
+	n.rand.Seed(seed)
+	n.mu.Unlock()
+}
+
+// Link returns the link to the listening address, which is shared by the connections
+// dialed to the address.
+func (n *SimNetwork) Link(address string) *SimLink {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	link, ok := n.links[address]
+	if !ok {
+		link = &SimLink{network: n, pipes: make(map[*simPipe]struct{})}
+		n.links[address] = link
+	}
+	return link
+}
+
+func (n *SimNetwork) float64() float64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.rand.Float64()
+}
+
+func (n *SimNetwork) int63n(max int64) int64 {
+	if max <= 0 {
+		return 0
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.rand.Int63n(max)
+}
+
+func (n *SimNetwork) listen(address string) (net.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[address]; ok {
+		return nil, errors.New("address already in use")
+	}
+	l := &simListener{
+		network: n,
+		address: address,
+		accepts: make(chan net.Conn, 128),
+		done:    make(chan struct{}),
+	}
+	n.listeners[address] = l
+	return l, nil
+}
+
+func (n *SimNetwork) dial(address string) (net.Conn, error) {
+	link := n.Link(address)
+	if link.partitioned() {
+		return nil, ErrSimUnreachable
+	}
+	n.mu.Lock()
+	l := n.listeners[address]
+	n.mu.Unlock()
+	if l == nil {
+		return nil, ErrSimRefused
+	}
+	time.Sleep(link.Faults().Latency * 2)
+	local := simAddr("client-" + strconv.FormatUint(atomic.AddUint64(&n.conns, 1), 10))
+	client, server := link.pair(local, simAddr(address))
+	// The read lock keeps Close from draining the backlog until the send is done,
+	// so that a server end sent after the close is not left behind.
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	select {
+	case <-l.done:
+	default:
+		select {
+		case l.accepts <- server:
+			return client, nil
+		case <-l.done:
+		}
+	}
+	client.Close()
+	server.Close()
+	return nil, ErrSimRefused
+}
+
+// SimLink is a simulated link to a listening address.
+type SimLink struct {
+	network *SimNetwork
+	mu      sync.Mutex
+	faults  SimFaults
+	part    bool
+	stalled bool
+	pipes   map[*simPipe]struct{}
+}
+
+// Faults returns the faults of the link.
+func (l *SimLink) Faults() SimFaults {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.faults
+}
+
+// SetFaults sets the faults of the link. The packets in flight are not affected.
+func (l *SimLink) SetFaults(faults SimFaults) {
+	l.mu.Lock()
+	l.faults = faults
+	l.mu.Unlock()
+}
+
+// Partition partitions the link. The dials fail with ErrSimUnreachable, and the packets
+// are held until the link is healed.
+func (l *SimLink) Partition() {
+	l.mu.Lock()
+	l.part = true
+	l.mu.Unlock()
+}
+
+// Stall holds the packets of the connections until the link is healed.
+func (l *SimLink) Stall() {
+	l.mu.Lock()
+	l.stalled = true
+	l.mu.Unlock()
+}
+
+// Heal ends the partition and the stall of the link, and delivers the held packets.
+func (l *SimLink) Heal() {
+	l.mu.Lock()
+	l.part, l.stalled = false, false
+	pipes := l.snapshot()
+	l.mu.Unlock()
+	for _, p := range pipes {
+		p.notify()
+	}
+}
+
+// Reset resets the connections over the link. Their reads and writes fail with ErrSimReset.
+func (l *SimLink) Reset() {
+	l.mu.Lock()
+	pipes := l.snapshot()
+	l.mu.Unlock()
+	for _, p := range pipes {
+		p.reset()
+	}
+}
+
+func (l *SimLink) snapshot() []*simPipe {
+	pipes := make([]*simPipe, 0, len(l.pipes))
+	for p := range l.pipes {
+		pipes = append(pipes, p)
+	}
+	return pipes
+}
+
+func (l *SimLink) partitioned() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.part
+}
+
+func (l *SimLink) held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.part || l.stalled
+}
+
+// pair returns the two ends of a new connection over the link.
+func (l *SimLink) pair(client, server simAddr) (*simConn, *simConn) {
+	up, down := newSimPipe(l), newSimPipe(l)
+	l.mu.Lock()
+	l.pipes[up] = struct{}{}
+	l.pipes[down] = struct{}{}
+	l.mu.Unlock()
+	return &simConn{r: down, w: up, local: client, remote: server},
+		&simConn{r: up, w: down, local: server, remote: client}
+}
+
+func (l *SimLink) remove(p *simPipe) {
+	l.mu.Lock()
+	delete(l.pipes, p)
+	l.mu.Unlock()
+}
+
+type simPacket struct {
+	data []byte
+	at   time.Time
+}
+
+// simPipe is a direction of a simulated connection.
+type simPipe struct {
+	link          *SimLink
+	mu            sync.Mutex
+	packets       []simPacket
+	last          time.Time
+	busy          time.Time
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readClosed    bool
+	writeClosed   bool
+	err           error
+	wake          chan struct{}
+}
+
+func newSimPipe(link *SimLink) *simPipe {
+	return &simPipe{link: link, wake: make(chan struct{})}
+}
+
+// notify wakes up the blocked reads and writes.
+func (p *simPipe) notify() {
+	p.mu.Lock()
+	p.broadcast()
+	p.mu.Unlock()
+}
+
+func (p *simPipe) broadcast() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+// wait waits for a notification or the duration, unless d is negative.
+func (p *simPipe) wait(d time.Duration) {
+	wake := p.wake
+	p.mu.Unlock()
+	if d < 0 {
+		<-wake
+	} else {
+		timer := time.NewTimer(d)
+		select {
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	p.mu.Lock()
+}
+
+func (p *simPipe) read(b []byte) (n int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if p.readClosed {
+			return 0, errSimClosed
+		} else if p.err != nil {
+			return 0, p.err
+		}
+		now := time.Now()
+		if !p.readDeadline.IsZero() && !now.Before(p.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		d := time.Duration(-1)
+		if held := p.link.held(); !held && len(p.packets) > 0 {
+			packet := &p.packets[0]
+			if !now.Before(packet.at) {
+				if len(b) == 0 {
+					return 0, nil
+				}
+				n = copy(b, packet.data)
+				if packet.data = packet.data[n:]; len(packet.data) == 0 {
+					p.packets = p.packets[1:]
+				}
+				return n, nil
+			}
+			d = packet.at.Sub(now)
+		} else if !held && p.writeClosed {
+			return 0, io.EOF
+		}
+		if !p.readDeadline.IsZero() && (d < 0 || p.readDeadline.Sub(now) < d) {
+			d = p.readDeadline.Sub(now)
+		}
+		p.wait(d)
+	}
+}
+
+func (p *simPipe) write(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return 0, p.writable()
+	}
+	faults := p.link.Faults()
+	network := p.link.network
+	for n < len(b) {
+		size := len(b) - n
+		if faults.MTU > 0 && size > faults.MTU {
+			size = faults.MTU
+		}
+		if faults.Fragment {
+			size = 1 + int(network.int63n(int64(size)))
+		}
+		jitter := time.Duration(network.int63n(int64(faults.Jitter) + 1))
+		p.mu.Lock()
+		if err = p.writable(); err != nil {
+			p.mu.Unlock()
+			return n, err
+		}
+		now := time.Now()
+		if p.busy.Before(now) {
+			p.busy = now
+		}
+		if faults.Bandwidth > 0 {
+			p.busy = p.busy.Add(time.Duration(size) * time.Second / time.Duration(faults.Bandwidth))
+		}
+		at := p.busy.Add(faults.Latency + jitter)
+		if at.Before(p.last) {
+			at = p.last
+		}
+		p.last = at
+		p.packets = append(p.packets, simPacket{data: append([]byte{}, b[n:n+size]...), at: at})
+		p.broadcast()
+		// The writes block while the link is busy.
+		for err == nil && time.Now().Before(p.busy) {
+			d := time.Until(p.busy)
+			if !p.writeDeadline.IsZero() && time.Until(p.writeDeadline) < d {
+				d = time.Until(p.writeDeadline)
+			}
+			if d < 0 {
+				d = 0
+			}
+			p.wait(d)
+			err = p.writable()
+		}
+		p.mu.Unlock()
+		if err != nil {
+			return n, err
+		}
+		n += size
+	}
+	return n, nil
+}
+
+func (p *simPipe) writable() error {
+	if p.writeClosed {
+		return errSimClosed
+	} else if p.err != nil {
+		return p.err
+	} else if p.readClosed {
+		return io.ErrClosedPipe
+	} else if !p.writeDeadline.IsZero() && !time.Now().Before(p.writeDeadline) {
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func (p *simPipe) reset() {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = ErrSimReset
+		p.packets = nil
+		p.broadcast()
+	}
+	p.mu.Unlock()
+	p.link.remove(p)
+}
+
+func (p *simPipe) close(read bool) {
+	p.mu.Lock()
+	if read {
+		p.readClosed = true
+	} else {
+		p.writeClosed = true
+	}
+	closed := p.readClosed && p.writeClosed
+	p.broadcast()
+	p.mu.Unlock()
+	if closed {
+		p.link.remove(p)
+	}
+}
+
+// simConn is an end of a simulated connection.
+type simConn struct {
+	r, w          *simPipe
+	local, remote simAddr
+	closed        int32
+}
+
+func (c *simConn) Read(b []byte) (int, error) {
+	return c.r.read(b)
+}
+
+func (c *simConn) Write(b []byte) (int, error) {
+	if rate := c.w.link.Faults().ResetRate; rate > 0 && c.w.link.network.float64() < rate {
+		c.r.reset()
+		c.w.reset()
+		return 0, ErrSimReset
+	}
+	return c.w.write(b)
+}
+
+func (c *simConn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return errSimClosed
+	}
+	c.r.close(true)
+	c.w.close(false)
+	return nil
+}
+
+func (c *simConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *simConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *simConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *simConn) SetReadDeadline(t time.Time) error {
+	c.r.mu.Lock()
+	c.r.readDeadline = t
+	c.r.broadcast()
+	c.r.mu.Unlock()
+	return nil
+}
+
+func (c *simConn) SetWriteDeadline(t time.Time) error {
+	c.w.mu.Lock()
+	c.w.writeDeadline = t
+	c.w.broadcast()
+	c.w.mu.Unlock()
+	return nil
+}
+
+// simListener is a listener of a simulated network.
+type simListener struct {
+	network *SimNetwork
+	address string
+	accepts chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+	mu      sync.RWMutex
+}
+
+func (l *simListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepts:
+		return conn, nil
+	case <-l.done:
+		return nil, errSimClosed
+	}
+}
+
+func (l *simListener) Close() error {
+	err := errSimClosed
+	l.once.Do(func() {
+		err = nil
+		l.network.mu.Lock()
+		delete(l.network.listeners, l.address)
+		l.network.mu.Unlock()
+		close(l.done)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for {
+			select {
+			case conn := <-l.accepts:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	return err
+}
+
+func (l *simListener) Addr() net.Addr {
+	return simAddr(l.address)
+}
+
+// simAddr is an address of a simulated network.
+type simAddr string
+
+func (a simAddr) Network() string {
+	return "sim"
+}
+
+func (a simAddr) String() string {
+	return string(a)
+}
@@ -1,7 +1,7 @@
 // Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
 // This package is licensed under a MIT license that can be found in the LICENSE file.
 
-// Package socket implements a network socket that supports TCP, UNIX, HTTP, WS and INPROC.
+// Package socket implements a network socket that supports TCP, UNIX, HTTP, WS, INPROC and SIM.
 package socket
 
 import (
@@ -12,6 +12,7 @@ import (
 	"net"
 	"runtime"
 	"strings"
+	"time"
 )
 
 var numCPU = runtime.NumCPU()
@@ -40,6 +41,15 @@ type Conn interface {
 	Connection() net.Conn
 }
 
+// ProtocolNegotiator is the optional interface of a Conn which reports the application
+// level protocol negotiated by ALPN. The Conns of this package implement it, while
+// NegotiatedProtocolOf works with any Conn.
+type ProtocolNegotiator interface {
+	// NegotiatedProtocol returns the application level protocol negotiated by ALPN,
+	// or an empty string if there is none.
+	NegotiatedProtocol() string
+}
+
 // Dialer is a generic network dialer for stream-oriented protocols.
 type Dialer interface {
 	// Dial connects to an address.
@@ -77,6 +87,32 @@ type Socket interface {
 	Listen(address string) (Listener, error)
 }
 
+// Options are the options shared by the sockets of this package.
+type Options struct {
+	// ConfigForAddress returns the TLS config to dial the address, which overrides
+	// Config unless it is nil. It allows one socket to dial many hosts with
+	// different TLS configs.
+	ConfigForAddress func(address string) *tls.Config
+	// HandshakeTimeout is the maximum duration of the handshake of an accepted connection,
+	// including the TLS handshake and the CONNECT request or the WebSocket upgrade.
+	// Zero means DefaultHandshakeTimeout, and a negative value means no timeout.
+	HandshakeTimeout time.Duration
+	// MaxConcurrentHandshakes is the maximum number of the accepted connections in handshake.
+	// Zero means DefaultMaxConcurrentHandshakes, and a negative value means no limit.
+	MaxConcurrentHandshakes int
+	// NextProtos is the list of the application level protocols negotiated by ALPN,
+	// in order of preference. It overrides the NextProtos of the TLS config unless it is empty.
+	NextProtos []string
+	// HandshakeStats counts the TLS handshakes of Dial and of the listeners if it is not nil.
+	HandshakeStats *HandshakeStats
+	// Pins verifies the public key of the server after the TLS handshake of Dial if it is not nil.
+	Pins *PinSet
+	// Metrics records the metrics of the socket if it is not nil.
+	Metrics Metrics
+	// Hooks observes the lifecycle of the connections of the socket if it is not nil.
+	Hooks *Hooks
+}
+
 // Address returns the socket's address by a url.
 func Address(s Socket, url string) (string, error) {
 	if !strings.HasPrefix(url, s.Scheme()+"://") {
@@ -91,7 +127,16 @@ func URL(s Socket, addr string) string {
 }
 
 // NewSocket returns a new socket by a network and a TLS config.
+// A network with the "+psk" suffix, such as "tcp+psk", returns a *PSK socket
+// over the network, whose Key must be set before it dials or listens.
 func NewSocket(network string, config *tls.Config) (Socket, error) {
+	if strings.HasSuffix(network, pskSuffix) {
+		s, err := NewSocket(strings.TrimSuffix(network, pskSuffix), config)
+		if err != nil {
+			return nil, err
+		}
+		return &PSK{Socket: s}, nil
+	}
 	switch network {
 	case "tcp", "tcps":
 		return NewTCPSocket(config), nil
@@ -103,6 +148,8 @@ func NewSocket(network string, config *tls.Config) (Socket, error) {
 		return NewWSSocket(config), nil
 	case "inproc", "inprocs":
 		return NewINPROCSocket(config), nil
+	case "sim", "sims":
+		return NewSIMSocket(config), nil
 	default:
 		return nil, ErrNetwork
 	}
@@ -12,6 +12,9 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,12 +27,32 @@ const (
 
 // HTTP implements the Socket interface.
 type HTTP struct {
+	// Config is the TLS config, which is never modified by Dial.
 	Config *tls.Config
+	Options
+	// Path is the request target of the CONNECT request. Default is HTTPPath.
+	// A listener with a non-empty Path only accepts the CONNECT requests to the Path.
+	Path string
+	// Host is the Host header of the CONNECT request. Default is the dialed address.
+	// A listener with a non-empty Host only accepts the CONNECT requests to the Host.
+	Host string
+	// Header contains the additional header fields sent with the CONNECT request.
+	Header http.Header
+	// Authenticator authenticates the accepted CONNECT requests if it is not nil.
+	Authenticator Authenticator
+
+	sessions sessionCache
 }
 
 // HTTPConn implements the Conn interface.
 type HTTPConn struct {
 	net.Conn
+	identity Identity
+}
+
+// Identity returns the identity attached by the listener's Authenticator.
+func (c *HTTPConn) Identity() Identity {
+	return c.identity
 }
 
 // Messages returns a new Messages.
@@ -39,7 +62,12 @@ func (c *HTTPConn) Messages() Messages {
 
 // Connection returns the net.Conn.
 func (c *HTTPConn) Connection() net.Conn {
-	return c.Conn
+	return connectionOf(c.Conn)
+}
+
+// NegotiatedProtocol returns the application level protocol negotiated by ALPN.
+func (c *HTTPConn) NegotiatedProtocol() string {
+	return NegotiatedProtocolOf(c)
 }
 
 // NewHTTPSocket returns a new HTTP socket.
@@ -57,26 +85,50 @@ func (t *HTTP) Scheme() string {
 
 // Dial connects to an address.
 func (t *HTTP) Dial(address string) (Conn, error) {
-	var err error
-	var conn net.Conn
-	conn, err = net.Dial("tcp", address)
+	m := newObserver(t.Metrics, t.Hooks, "http")
+	start := time.Now()
+	conn, err := t.dial(address, m)
+	m.dialed(address, conn, start, err)
+	return conn, err
+}
+
+func (t *HTTP) dial(address string, m *observer) (Conn, error) {
+	start := time.Now()
+	conn, err := net.Dial("tcp", address)
 	if err != nil {
 		return nil, err
 	}
-	if t.Config != nil {
-		if t.Config.ServerName == "" {
-			t.Config.ServerName = parseHost(address)
-		}
-		tlsConn := tls.Client(conn, t.Config)
-		if err = tlsConn.Handshake(); err != nil {
+	m.stage("connect", start)
+	if config := clientTLSConfig(t.Config, t.ConfigForAddress, address, t.NextProtos, &t.sessions); config != nil {
+		tlsConn := tls.Client(conn, config)
+		if err = handshakeTLSClient(tlsConn, t.HandshakeStats, t.Pins, m); err != nil {
 			conn.Close()
 			return nil, err
 		}
 		conn = tlsConn
 	}
-	io.WriteString(conn, "CONNECT "+HTTPPath+" HTTP/1.1\n\n")
-	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
-	if err != nil || resp.Status != HTTPConnected {
+	start = time.Now()
+	path := t.Path
+	if path == "" {
+		path = HTTPPath
+	}
+	host := t.Host
+	if host == "" {
+		host = address
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: path},
+		Host:   host,
+		Header: t.Header,
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	if err != nil || resp.StatusCode < 200 || resp.StatusCode > 299 {
 		if err == nil {
 			err = errors.New("unexpected HTTP response: " + resp.Status)
 		}
@@ -88,7 +140,13 @@ func (t *HTTP) Dial(address string) (Conn, error) {
 			Err:  err,
 		}
 	}
-	return &HTTPConn{conn}, nil
+	m.stage("upgrade", start)
+	m.upgraded(conn)
+	return &HTTPConn{Conn: m.conn(newBufferedConn(conn, reader))}, nil
+}
+
+func (t *HTTP) handshaker() *handshaker {
+	return newHandshaker(t.HandshakeTimeout, t.MaxConcurrentHandshakes, t.HandshakeStats, newObserver(t.Metrics, t.Hooks, "http"))
 }
 
 // Listen announces on the local address.
@@ -97,39 +155,161 @@ func (t *HTTP) Listen(address string) (Listener, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &HTTPListener{l: lis, config: t.Config}, nil
+	return &HTTPListener{l: lis, config: serverTLSConfig(t.Config, t.NextProtos), handshaker: t.handshaker(),
+		observer: newObserver(t.Metrics, t.Hooks, "http"), host: t.Host, path: t.Path, authenticator: t.Authenticator}, nil
 }
 
 // HTTPListener implements the Listener interface.
 type HTTPListener struct {
-	l      net.Listener
-	server *netpoll.Server
-	config *tls.Config
+	l             net.Listener
+	server        *netpoll.Server
+	config        *tls.Config
+	handshaker    *handshaker
+	observer      *observer
+	host          string
+	path          string
+	authenticator Authenticator
+	mu            sync.Mutex
+	routes        []*httpRoute
+	queue         *queueListener
+}
+
+type httpRoute struct {
+	host  string
+	path  string
+	queue *queueListener
+}
+
+// Route returns a Listener that accepts the CONNECT requests to the host and the path,
+// so that several services can share one HTTP port. An empty host or path matches any.
+//
+// Once a route is added, the listener dispatches every connection itself and
+// answers the CONNECT requests which match neither a route nor the listener
+// with 404 Not Found. Routes should be added before serving.
+func (l *HTTPListener) Route(host, path string) Listener {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	route := &httpRoute{host: host, path: path, queue: newQueueListener(l.l.Addr(), false)}
+	l.routes = append(l.routes, route)
+	if l.queue == nil {
+		l.queue = newQueueListener(l.l.Addr(), false)
+		go l.dispatch()
+	}
+	return route.queue
+}
+
+func (l *HTTPListener) dispatch() {
+	for {
+		conn, err := l.l.Accept()
+		if err != nil {
+			l.queue.Close()
+			return
+		}
+		go l.dispatchConn(conn)
+	}
+}
+
+func (l *HTTPListener) dispatchConn(conn net.Conn) {
+	var c *HTTPConn
+	var queue *queueListener
+	err := l.handshaker.do(conn, func() error {
+		var tlsConn net.Conn = conn
+		if l.config != nil {
+			secureConn := tls.Server(conn, l.config)
+			if err := secureConn.Handshake(); err != nil {
+				return err
+			}
+			l.handshaker.observe(secureConn)
+			tlsConn = secureConn
+		}
+		reader := bufio.NewReader(tlsConn)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return err
+		}
+		res := &response{handlerHeader: make(http.Header), conn: tlsConn, reader: reader}
+		if queue = l.match(req); queue == nil {
+			notFoundHTTP(res)
+			return ErrConn
+		}
+		if c = upgradeHTTP(res, req, l.authenticator); c == nil {
+			return ErrConn
+		}
+		return nil
+	})
+	if err != nil {
+		l.observer.reject(err)
+		conn.Close()
+		return
+	}
+	l.observer.upgraded(c.Conn)
+	c.Conn = l.observer.accept(c.Conn)
+	if !queue.q.deliver(c) {
+		c.Close()
+	}
+}
+
+func (l *HTTPListener) match(req *http.Request) *queueListener {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, route := range l.routes {
+		if !route.queue.q.closed() && matchHTTPRoute(route.host, route.path, req) {
+			return route.queue
+		}
+	}
+	if matchHTTPRoute(l.host, l.path, req) {
+		return l.queue
+	}
+	return nil
+}
+
+func (l *HTTPListener) routed() *queueListener {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.queue
 }
 
 // Accept waits for and returns the next connection to the listener.
 func (l *HTTPListener) Accept() (Conn, error) {
+	if queue := l.routed(); queue != nil {
+		return queue.Accept()
+	}
 	conn, err := l.l.Accept()
 	if err != nil {
 		return nil, err
 	}
-	if l.config == nil {
-		c := upgradeHTTPConn(conn)
-		if c == nil {
-			return nil, ErrConn
-		}
-		return &HTTPConn{c}, err
-	}
-	tlsConn := tls.Server(conn, l.config)
-	if err = tlsConn.Handshake(); err != nil {
+	c, err := l.handshake(conn)
+	if err != nil {
 		conn.Close()
 		return nil, err
 	}
-	c := upgradeHTTPConn(tlsConn)
-	if c == nil {
-		return nil, ErrConn
+	return c, nil
+}
+
+// handshake performs the TLS handshake and the CONNECT upgrade within the handshake timeout.
+func (l *HTTPListener) handshake(conn net.Conn) (c *HTTPConn, err error) {
+	err = l.handshaker.do(conn, func() error {
+		var tlsConn net.Conn = conn
+		if l.config != nil {
+			secureConn := tls.Server(conn, l.config)
+			if err := secureConn.Handshake(); err != nil {
+				return err
+			}
+			l.handshaker.observe(secureConn)
+			tlsConn = secureConn
+		}
+		if c = l.upgrade(tlsConn); c == nil {
+			return ErrConn
+		}
+		return nil
+	})
+	if err != nil {
+		l.observer.reject(err)
+		return nil, err
 	}
-	return &HTTPConn{c}, err
+	l.observer.upgraded(c.Conn)
+	c.Conn = l.observer.accept(c.Conn)
+	return c, nil
 }
 
 // Serve serves the netpoll.Handler by the netpoll.
@@ -137,10 +317,10 @@ func (l *HTTPListener) Serve(handler netpoll.Handler) error {
 	if handler == nil {
 		return ErrHandler
 	}
-	l.server = &netpoll.Server{
-		Handler: handler,
+	if queue := l.routed(); queue != nil {
+		return queue.Serve(handler)
 	}
-	return l.server.Serve(l.l)
+	return l.serve(l.observer.handler(handler))
 }
 
 // ServeData serves the opened func and the serve func by the netpoll.
@@ -148,23 +328,18 @@ func (l *HTTPListener) ServeData(opened func(net.Conn) error, serve func(req []b
 	if serve == nil {
 		return ErrServe
 	}
+	if queue := l.routed(); queue != nil {
+		return queue.ServeData(opened, serve)
+	}
 	type Context struct {
 		Conn net.Conn
 		buf  []byte
 	}
 	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
-		if l.config != nil {
-			tlsConn := tls.Server(conn, l.config)
-			if err := tlsConn.Handshake(); err != nil {
-				conn.Close()
-				return nil, err
-			}
-			conn = tlsConn
-		}
-		httpConn := upgradeHTTPConn(conn)
-		if httpConn == nil {
+		httpConn, err := l.handshake(conn)
+		if err != nil {
 			conn.Close()
-			return nil, ErrConn
+			return nil, err
 		}
 		conn = httpConn
 		if opened != nil {
@@ -192,10 +367,7 @@ func (l *HTTPListener) ServeData(opened func(net.Conn) error, serve func(req []b
 		_, err = c.Conn.Write(res)
 		return err
 	}
-	l.server = &netpoll.Server{
-		Handler: netpoll.NewHandler(Upgrade, Serve),
-	}
-	return l.server.Serve(l.l)
+	return l.serve(netpoll.NewHandler(Upgrade, Serve))
 }
 
 // ServeConn serves the opened func and the serve func by the netpoll.
@@ -205,19 +377,14 @@ func (l *HTTPListener) ServeConn(opened func(net.Conn) (Context, error), serve f
 	} else if serve == nil {
 		return ErrServe
 	}
+	if queue := l.routed(); queue != nil {
+		return queue.ServeConn(opened, serve)
+	}
 	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
-		if l.config != nil {
-			tlsConn := tls.Server(conn, l.config)
-			if err := tlsConn.Handshake(); err != nil {
-				conn.Close()
-				return nil, err
-			}
-			conn = tlsConn
-		}
-		httpConn := upgradeHTTPConn(conn)
-		if httpConn == nil {
+		httpConn, err := l.handshake(conn)
+		if err != nil {
 			conn.Close()
-			return nil, ErrConn
+			return nil, err
 		}
 		conn = httpConn
 		return opened(conn)
@@ -225,10 +392,7 @@ func (l *HTTPListener) ServeConn(opened func(net.Conn) (Context, error), serve f
 	Serve := func(context netpoll.Context) error {
 		return serve(context)
 	}
-	l.server = &netpoll.Server{
-		Handler: netpoll.NewHandler(Upgrade, Serve),
-	}
-	return l.server.Serve(l.l)
+	return l.serve(netpoll.NewHandler(Upgrade, Serve))
 }
 
 // ServeMessages serves the opened func and the serve func by the netpoll.
@@ -238,19 +402,14 @@ func (l *HTTPListener) ServeMessages(opened func(Messages) (Context, error), ser
 	} else if serve == nil {
 		return ErrServe
 	}
+	if queue := l.routed(); queue != nil {
+		return queue.ServeMessages(opened, serve)
+	}
 	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
-		if l.config != nil {
-			tlsConn := tls.Server(conn, l.config)
-			if err := tlsConn.Handshake(); err != nil {
-				conn.Close()
-				return nil, err
-			}
-			conn = tlsConn
-		}
-		httpConn := upgradeHTTPConn(conn)
-		if httpConn == nil {
+		httpConn, err := l.handshake(conn)
+		if err != nil {
 			conn.Close()
-			return nil, ErrConn
+			return nil, err
 		}
 		conn = httpConn
 		messages := NewMessages(conn, true)
@@ -259,16 +418,37 @@ func (l *HTTPListener) ServeMessages(opened func(Messages) (Context, error), ser
 	Serve := func(context netpoll.Context) error {
 		return serve(context)
 	}
-	l.server = &netpoll.Server{
-		Handler: netpoll.NewHandler(Upgrade, Serve),
+	return l.serve(netpoll.NewHandler(Upgrade, Serve))
+}
+
+// serve serves the handler by the netpoll. The server is guarded by the mutex,
+// since Close may be called by another goroutine.
+func (l *HTTPListener) serve(handler netpoll.Handler) error {
+	server := &netpoll.Server{
+		Handler: handler,
 	}
-	return l.server.Serve(l.l)
+	l.mu.Lock()
+	l.server = server
+	l.mu.Unlock()
+	return server.Serve(l.l)
 }
 
-// Close closes the listener.
+// Close closes the listener and its routes.
 func (l *HTTPListener) Close() error {
-	if l.server != nil {
-		return l.server.Close()
+	l.mu.Lock()
+	routes := l.routes
+	queue := l.queue
+	server := l.server
+	l.mu.Unlock()
+	for _, route := range routes {
+		route.queue.Close()
+	}
+	if queue != nil {
+		queue.Close()
+	}
+	if server != nil {
+		defer l.observer.shutdown()
+		return server.Close()
 	}
 	return l.l.Close()
 }
@@ -278,39 +458,114 @@ func (l *HTTPListener) Addr() net.Addr {
 	return l.l.Addr()
 }
 
-func upgradeHTTPConn(conn net.Conn) net.Conn {
+func (l *HTTPListener) upgrade(conn net.Conn) *HTTPConn {
 	var b = bufio.NewReader(conn)
 	req, err := http.ReadRequest(b)
 	if err != nil {
 		return nil
 	}
-	res := &response{conn: conn}
-	return upgradeHTTP(res, req)
+	res := &response{handlerHeader: make(http.Header), conn: conn, reader: b}
+	if !matchHTTPRoute(l.host, l.path, req) {
+		notFoundHTTP(res)
+		return nil
+	}
+	return upgradeHTTP(res, req, l.authenticator)
 }
 
-func upgradeHTTP(w http.ResponseWriter, r *http.Request) net.Conn {
+func matchHTTPRoute(host, path string, r *http.Request) bool {
+	if path != "" {
+		requestPath := r.URL.Path
+		if requestPath == "" {
+			requestPath = r.RequestURI
+		}
+		if requestPath != path {
+			return false
+		}
+	}
+	if host != "" && !strings.EqualFold(host, r.Host) {
+		if _, _, err := net.SplitHostPort(host); err == nil {
+			return false
+		}
+		if !strings.EqualFold(host, parseHost(r.Host)) {
+			return false
+		}
+	}
+	return true
+}
+
+func notFoundHTTP(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	io.WriteString(w, "404 not found\n")
+}
+
+func upgradeHTTP(w http.ResponseWriter, r *http.Request, a Authenticator) *HTTPConn {
 	if r.Method != "CONNECT" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		io.WriteString(w, "405 must CONNECT\n")
 		return nil
 
 	}
-	conn, _, err := w.(http.Hijacker).Hijack()
+	identity, err := authenticate(a, w, r)
+	if err != nil {
+		return nil
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "500 can not hijack the connection", http.StatusInternalServerError)
+		return nil
+	}
+	conn, rw, err := hj.Hijack()
 	if err != nil {
 		return nil
 	}
-	io.WriteString(conn, "HTTP/1.0 "+HTTPConnected+"\n\n")
-	return conn
+	if _, err = io.WriteString(conn, "HTTP/1.1 "+HTTPConnected+"\r\n\r\n"); err != nil {
+		conn.Close()
+		return nil
+	}
+	return &HTTPConn{Conn: newBufferedConn(conn, rw.Reader), identity: identity}
+}
+
+// bufferedConn is a net.Conn that returns the bytes read ahead
+// by the HTTP handshake before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	buffer []byte
+}
+
+// newBufferedConn returns the conn with the bytes buffered by the reader.
+func newBufferedConn(conn net.Conn, reader *bufio.Reader) net.Conn {
+	if reader == nil || reader.Buffered() == 0 {
+		return conn
+	}
+	buffered, _ := reader.Peek(reader.Buffered())
+	buffer := make([]byte, len(buffered))
+	copy(buffer, buffered)
+	return &bufferedConn{Conn: conn, buffer: buffer}
+}
+
+// Read reads the buffered bytes first and then the connection.
+func (c *bufferedConn) Read(b []byte) (n int, err error) {
+	if len(c.buffer) > 0 {
+		n = copy(b, c.buffer)
+		c.buffer = c.buffer[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
 }
 
 type response struct {
 	handlerHeader http.Header
 	status        int
 	conn          net.Conn
+	reader        *bufio.Reader
 }
 
 func (w *response) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+	reader := w.reader
+	if reader == nil {
+		reader = bufio.NewReader(w.conn)
+	}
+	return w.conn, bufio.NewReadWriter(reader, bufio.NewWriter(w.conn)), nil
 }
 
 func (w *response) Header() http.Header {
@@ -323,6 +578,14 @@ func (w *response) Write(data []byte) (n int, err error) {
 	h = append(h, fmt.Sprintf("Date: %s\r\n", time.Now().UTC().Format(http.TimeFormat))...)
 	h = append(h, fmt.Sprintf("Content-Length: %d\r\n", len(data))...)
 	h = append(h, "Content-Type: text/plain; charset=utf-8\r\n"...)
+	for k, values := range w.handlerHeader {
+		if k == "Content-Type" || k == "Content-Length" {
+			continue
+		}
+		for _, v := range values {
+			h = append(h, k+": "+v+"\r\n"...)
+		}
+	}
 	h = append(h, "\r\n"...)
 	h = append(h, data...)
 	n, err = w.conn.Write(h)
@@ -4,7 +4,11 @@
 package socket
 
 import (
+	"bufio"
+	"io"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -307,3 +311,248 @@ func TestHTTPSocketServeMessages(t *testing.T) {
 	l.Close()
 	wg.Wait()
 }
+
+func TestHTTPSocketDialRequest(t *testing.T) {
+	var addr = ":9999"
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if req.Method != "CONNECT" {
+			t.Error(req.Method)
+		}
+		if req.URL.Path != "/service" {
+			t.Error(req.URL.Path)
+		}
+		if req.Host != "service.hslam.com" {
+			t.Error(req.Host)
+		}
+		if req.Header.Get("Authorization") != "Bearer token" {
+			t.Error(req.Header.Get("Authorization"))
+		}
+		io.WriteString(conn, "HTTP/1.0 "+HTTPConnected+"\n\n")
+	}()
+	sock := &HTTP{Path: "/service", Host: "service.hslam.com", Header: http.Header{}}
+	sock.Header.Set("Authorization", "Bearer token")
+	conn, err := sock.Dial(addr)
+	if err != nil {
+		t.Error(err)
+	} else {
+		conn.Close()
+	}
+	wg.Wait()
+	l.Close()
+}
+
+func TestHTTPSocketRoute(t *testing.T) {
+	var addr = ":9999"
+	serverSock := &HTTP{Path: "/default"}
+	l, err := serverSock.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners := map[string]Listener{
+		"default": l,
+		"a":       l.(*HTTPListener).Route("", "/a"),
+		"b":       l.(*HTTPListener).Route("b.hslam.com", "/b"),
+	}
+	wg := sync.WaitGroup{}
+	for name, lis := range listeners {
+		wg.Add(1)
+		go func(name string, lis Listener) {
+			defer wg.Done()
+			for {
+				conn, err := lis.Accept()
+				if err != nil {
+					return
+				}
+				messages := conn.Messages()
+				if _, err := messages.ReadMessage(nil); err == nil {
+					messages.WriteMessage([]byte(name))
+				}
+				messages.Close()
+			}
+		}(name, lis)
+	}
+	testRoute := func(sock Socket, name string) {
+		conn, err := sock.Dial(addr)
+		if err != nil {
+			t.Error(name, err)
+			return
+		}
+		messages := conn.Messages()
+		messages.WriteMessage([]byte("route"))
+		if msg, err := messages.ReadMessage(nil); err != nil {
+			t.Error(err)
+		} else if string(msg) != name {
+			t.Errorf("error %s != %s", string(msg), name)
+		}
+		messages.Close()
+	}
+	testRoute(&HTTP{Path: "/default"}, "default")
+	testRoute(&HTTP{Path: "/a"}, "a")
+	testRoute(&HTTP{Path: "/a", Host: "a.hslam.com"}, "a")
+	testRoute(&HTTP{Path: "/b", Host: "b.hslam.com:9999"}, "b")
+	if _, err := (&HTTP{Path: "/b", Host: "c.hslam.com"}).Dial(addr); err == nil {
+		t.Error("should be dial-http tcp :9999: unexpected HTTP response: 404 Not Found")
+	}
+	if _, err := (&HTTP{Path: "/c"}).Dial(addr); err == nil {
+		t.Error("should be dial-http tcp :9999: unexpected HTTP response: 404 Not Found")
+	}
+	listeners["a"].Close()
+	if _, err := (&HTTP{Path: "/a"}).Dial(addr); err == nil {
+		t.Error("should be dial-http tcp :9999: unexpected HTTP response: 404 Not Found")
+	}
+	l.Close()
+	wg.Wait()
+}
+
+func TestHTTPSocketRouteServeMessages(t *testing.T) {
+	var addr = ":9999"
+	l, err := NewHTTPSocket(nil).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := l.(*HTTPListener).Route("", "/messages")
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		route.ServeMessages(func(messages Messages) (Context, error) {
+			return messages, nil
+		}, func(context Context) error {
+			messages := context.(Messages)
+			msg, err := messages.ReadMessage(nil)
+			if err != nil {
+				return err
+			}
+			return messages.WriteMessage(msg)
+		})
+	}()
+	conn, err := (&HTTP{Path: "/messages"}).Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := conn.Messages()
+	str := strings.Repeat("Hello World", 50)
+	messages.WriteMessage([]byte(str))
+	if msg, err := messages.ReadMessage(nil); err != nil {
+		t.Error(err)
+	} else if string(msg) != str {
+		t.Errorf("error %s != %s", string(msg), str)
+	}
+	messages.Close()
+	l.Close()
+	wg.Wait()
+}
+
+func TestHTTPSocketDialBuffered(t *testing.T) {
+	var addr = ":9999"
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	str := "Hello World"
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			t.Error(err)
+			return
+		}
+		// The response and the first message arrive in a single segment.
+		data := []byte("HTTP/1.1 204 Connection established\r\n\r\n")
+		data = append(data, byte(len(str)))
+		data = append(data, str...)
+		conn.Write(data)
+		time.Sleep(time.Millisecond * 10)
+	}()
+	conn, err := NewHTTPSocket(nil).Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := conn.Messages()
+	if msg, err := messages.ReadMessage(nil); err != nil {
+		t.Error(err)
+	} else if string(msg) != str {
+		t.Errorf("error %s != %s", string(msg), str)
+	}
+	messages.Close()
+	wg.Wait()
+	l.Close()
+}
+
+func TestHTTPSocketAcceptBuffered(t *testing.T) {
+	var addr = ":9999"
+	l, err := NewHTTPSocket(nil).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		messages := conn.Messages()
+		msg, err := messages.ReadMessage(nil)
+		if err != nil {
+			t.Error(err)
+		}
+		messages.WriteMessage(msg)
+		messages.Close()
+	}()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	str := "Hello World"
+	// The CONNECT request in authority-form is followed by the first message
+	// without waiting for the response.
+	data := []byte("CONNECT hslam.com:443 HTTP/1.1\r\nHost: hslam.com:443\r\n\r\n")
+	data = append(data, byte(len(str)))
+	data = append(data, str...)
+	conn.Write(data)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Proto != "HTTP/1.1" {
+		t.Error(resp.Proto, resp.Status)
+	}
+	messages := NewMessages(newBufferedConn(conn, reader), false)
+	if msg, err := messages.ReadMessage(nil); err != nil {
+		t.Error(err)
+	} else if string(msg) != str {
+		t.Errorf("error %s != %s", string(msg), str)
+	}
+	messages.Close()
+	wg.Wait()
+	l.Close()
+}
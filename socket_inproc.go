@@ -8,11 +8,16 @@ import (
 	"github.com/hslam/inproc"
 	"github.com/hslam/netpoll"
 	"net"
+	"time"
 )
 
 // INPROC implements the Socket interface.
 type INPROC struct {
+	// Config is the TLS config, which is never modified by Dial.
 	Config *tls.Config
+	Options
+
+	sessions sessionCache
 }
 
 // INPROConn implements the Conn interface.
@@ -27,7 +32,12 @@ func (c *INPROConn) Messages() Messages {
 
 // Connection returns the net.Conn.
 func (c *INPROConn) Connection() net.Conn {
-	return c.Conn
+	return connectionOf(c.Conn)
+}
+
+// NegotiatedProtocol returns the application level protocol negotiated by ALPN.
+func (c *INPROConn) NegotiatedProtocol() string {
+	return NegotiatedProtocolOf(c)
 }
 
 // NewINPROCSocket returns a new TCP socket.
@@ -45,22 +55,34 @@ func (t *INPROC) Scheme() string {
 
 // Dial connects to an address.
 func (t *INPROC) Dial(address string) (Conn, error) {
+	m := newObserver(t.Metrics, t.Hooks, "inproc")
+	start := time.Now()
+	conn, err := t.dial(address, m)
+	m.dialed(address, conn, start, err)
+	return conn, err
+}
+
+func (t *INPROC) dial(address string, m *observer) (Conn, error) {
+	start := time.Now()
 	conn, err := inproc.Dial(address)
 	if err != nil {
 		return nil, err
 	}
-	if t.Config == nil {
-		return &INPROConn{conn}, err
-	}
-	if t.Config.ServerName == "" {
-		t.Config.ServerName = parseHost(address)
+	m.stage("connect", start)
+	config := clientTLSConfig(t.Config, t.ConfigForAddress, address, t.NextProtos, &t.sessions)
+	if config == nil {
+		return &INPROConn{m.conn(conn)}, err
 	}
-	tlsConn := tls.Client(conn, t.Config)
-	if err = tlsConn.Handshake(); err != nil {
+	tlsConn := tls.Client(conn, config)
+	if err = handshakeTLSClient(tlsConn, t.HandshakeStats, t.Pins, m); err != nil {
 		conn.Close()
 		return nil, err
 	}
-	return &INPROConn{tlsConn}, err
+	return &INPROConn{m.conn(tlsConn)}, err
+}
+
+func (t *INPROC) handshaker() *handshaker {
+	return newHandshaker(t.HandshakeTimeout, t.MaxConcurrentHandshakes, t.HandshakeStats, newObserver(t.Metrics, t.Hooks, "inproc"))
 }
 
 // Listen announces on the local address.
@@ -69,14 +91,16 @@ func (t *INPROC) Listen(address string) (Listener, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &INPROCListener{l: lis, config: t.Config}, err
+	return &INPROCListener{l: lis, config: serverTLSConfig(t.Config, t.NextProtos), handshaker: t.handshaker(), observer: newObserver(t.Metrics, t.Hooks, "inproc")}, err
 }
 
 // INPROCListener implements the Listener interface.
 type INPROCListener struct {
-	l      net.Listener
-	server *netpoll.Server
-	config *tls.Config
+	l          net.Listener
+	server     *netpoll.Server
+	config     *tls.Config
+	handshaker *handshaker
+	observer   *observer
 }
 
 // Accept waits for and returns the next connection to the listener.
@@ -86,14 +110,15 @@ func (l *INPROCListener) Accept() (Conn, error) {
 		return nil, err
 	}
 	if l.config == nil {
-		return &INPROConn{conn}, err
+		return &INPROConn{l.observer.accept(conn)}, err
 	}
 	tlsConn := tls.Server(conn, l.config)
-	if err = tlsConn.Handshake(); err != nil {
+	if err = l.handshaker.handshakeTLS(conn, tlsConn); err != nil {
+		l.observer.reject(err)
 		conn.Close()
 		return nil, err
 	}
-	return &INPROConn{tlsConn}, err
+	return &INPROConn{l.observer.accept(tlsConn)}, err
 }
 
 // Serve serves the netpoll.Handler by the netpoll.
@@ -102,7 +127,7 @@ func (l *INPROCListener) Serve(handler netpoll.Handler) error {
 		return ErrHandler
 	}
 	l.server = &netpoll.Server{
-		Handler: handler,
+		Handler: l.observer.handler(handler),
 	}
 	return l.server.Serve(l.l)
 }
@@ -119,12 +144,14 @@ func (l *INPROCListener) ServeData(opened func(net.Conn) error, serve func(req [
 	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
 		if l.config != nil {
 			tlsConn := tls.Server(conn, l.config)
-			if err := tlsConn.Handshake(); err != nil {
+			if err := l.handshaker.handshakeTLS(conn, tlsConn); err != nil {
+				l.observer.reject(err)
 				conn.Close()
 				return nil, err
 			}
 			conn = tlsConn
 		}
+		conn = l.observer.accept(conn)
 		if opened != nil {
 			if err := opened(conn); err != nil {
 				conn.Close()
@@ -166,12 +193,14 @@ func (l *INPROCListener) ServeConn(opened func(net.Conn) (Context, error), serve
 	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
 		if l.config != nil {
 			tlsConn := tls.Server(conn, l.config)
-			if err := tlsConn.Handshake(); err != nil {
+			if err := l.handshaker.handshakeTLS(conn, tlsConn); err != nil {
+				l.observer.reject(err)
 				conn.Close()
 				return nil, err
 			}
 			conn = tlsConn
 		}
+		conn = l.observer.accept(conn)
 		return opened(conn)
 	}
 	Serve := func(context netpoll.Context) error {
@@ -193,12 +222,14 @@ func (l *INPROCListener) ServeMessages(opened func(Messages) (Context, error), s
 	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
 		if l.config != nil {
 			tlsConn := tls.Server(conn, l.config)
-			if err := tlsConn.Handshake(); err != nil {
+			if err := l.handshaker.handshakeTLS(conn, tlsConn); err != nil {
+				l.observer.reject(err)
 				conn.Close()
 				return nil, err
 			}
 			conn = tlsConn
 		}
+		conn = l.observer.accept(conn)
 		messages := NewMessages(conn, true)
 		return opened(messages)
 	}
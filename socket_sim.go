@@ -0,0 +1,262 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"crypto/tls"
+	"github.com/hslam/netpoll"
+	"net"
+	"time"
+)
+
+// SIM implements the Socket interface over a simulated network, whose links can inject
+// the faults such as latency, bandwidth caps, resets and partitions.
+type SIM struct {
+	// Network is the simulated network. It is DefaultSimNetwork if it is nil.
+	Network *SimNetwork
+	// Config is the TLS config, which is never modified by Dial.
+	Config *tls.Config
+	Options
+
+	sessions sessionCache
+}
+
+// SIMConn implements the Conn interface.
+type SIMConn struct {
+	net.Conn
+}
+
+// Messages returns a new Messages.
+func (c *SIMConn) Messages() Messages {
+	return NewMessages(c.Conn, false)
+}
+
+// Connection returns the net.Conn.
+func (c *SIMConn) Connection() net.Conn {
+	return connectionOf(c.Conn)
+}
+
+// NegotiatedProtocol returns the application level protocol negotiated by ALPN.
+func (c *SIMConn) NegotiatedProtocol() string {
+	return NegotiatedProtocolOf(c)
+}
+
+// NewSIMSocket returns a new SIM socket over the DefaultSimNetwork.
+func NewSIMSocket(config *tls.Config) Socket {
+	return &SIM{Config: config}
+}
+
+// Scheme returns the socket's scheme.
+func (t *SIM) Scheme() string {
+	if t.Config == nil {
+		return "sim"
+	}
+	return "sims"
+}
+
+// Dial connects to an address.
+func (t *SIM) Dial(address string) (Conn, error) {
+	m := newObserver(t.Metrics, t.Hooks, "sim")
+	start := time.Now()
+	conn, err := t.dial(address, m)
+	m.dialed(address, conn, start, err)
+	return conn, err
+}
+
+func (t *SIM) dial(address string, m *observer) (Conn, error) {
+	start := time.Now()
+	conn, err := t.network().dial(address)
+	if err != nil {
+		return nil, err
+	}
+	m.stage("connect", start)
+	config := clientTLSConfig(t.Config, t.ConfigForAddress, address, t.NextProtos, &t.sessions)
+	if config == nil {
+		return &SIMConn{m.conn(conn)}, err
+	}
+	tlsConn := tls.Client(conn, config)
+	if err = handshakeTLSClient(tlsConn, t.HandshakeStats, t.Pins, m); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &SIMConn{m.conn(tlsConn)}, err
+}
+
+func (t *SIM) network() *SimNetwork {
+	if t.Network == nil {
+		return DefaultSimNetwork
+	}
+	return t.Network
+}
+
+func (t *SIM) handshaker() *handshaker {
+	return newHandshaker(t.HandshakeTimeout, t.MaxConcurrentHandshakes, t.HandshakeStats, newObserver(t.Metrics, t.Hooks, "sim"))
+}
+
+// Listen announces on the local address.
+func (t *SIM) Listen(address string) (Listener, error) {
+	lis, err := t.network().listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return &SIMListener{l: lis, config: serverTLSConfig(t.Config, t.NextProtos), handshaker: t.handshaker(), observer: newObserver(t.Metrics, t.Hooks, "sim")}, err
+}
+
+// SIMListener implements the Listener interface.
+type SIMListener struct {
+	l          net.Listener
+	server     *netpoll.Server
+	config     *tls.Config
+	handshaker *handshaker
+	observer   *observer
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *SIMListener) Accept() (Conn, error) {
+	conn, err := l.l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if l.config == nil {
+		return &SIMConn{l.observer.accept(conn)}, err
+	}
+	tlsConn := tls.Server(conn, l.config)
+	if err = l.handshaker.handshakeTLS(conn, tlsConn); err != nil {
+		l.observer.reject(err)
+		conn.Close()
+		return nil, err
+	}
+	return &SIMConn{l.observer.accept(tlsConn)}, err
+}
+
+// Serve serves the netpoll.Handler by the netpoll.
+func (l *SIMListener) Serve(handler netpoll.Handler) error {
+	if handler == nil {
+		return ErrHandler
+	}
+	l.server = &netpoll.Server{
+		Handler: l.observer.handler(handler),
+	}
+	return l.server.Serve(l.l)
+}
+
+// ServeData serves the opened func and the serve func by the netpoll.
+func (l *SIMListener) ServeData(opened func(net.Conn) error, serve func(req []byte) (res []byte)) error {
+	if serve == nil {
+		return ErrServe
+	}
+	type Context struct {
+		Conn net.Conn
+		buf  []byte
+	}
+	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
+		if l.config != nil {
+			tlsConn := tls.Server(conn, l.config)
+			if err := l.handshaker.handshakeTLS(conn, tlsConn); err != nil {
+				l.observer.reject(err)
+				conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+		conn = l.observer.accept(conn)
+		if opened != nil {
+			if err := opened(conn); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		ctx := &Context{
+			Conn: conn,
+			buf:  make([]byte, 1024*64),
+		}
+		return ctx, nil
+	}
+	Serve := func(context netpoll.Context) error {
+		c := context.(*Context)
+		n, err := c.Conn.Read(c.buf)
+		if err != nil {
+			return err
+		}
+		res := serve(c.buf[:n])
+		if len(res) == 0 {
+			return nil
+		}
+		_, err = c.Conn.Write(res)
+		return err
+	}
+	l.server = &netpoll.Server{
+		Handler: netpoll.NewHandler(Upgrade, Serve),
+	}
+	return l.server.Serve(l.l)
+}
+
+// ServeConn serves the opened func and the serve func by the netpoll.
+func (l *SIMListener) ServeConn(opened func(net.Conn) (Context, error), serve func(Context) error) error {
+	if opened == nil {
+		return ErrOpened
+	} else if serve == nil {
+		return ErrServe
+	}
+	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
+		if l.config != nil {
+			tlsConn := tls.Server(conn, l.config)
+			if err := l.handshaker.handshakeTLS(conn, tlsConn); err != nil {
+				l.observer.reject(err)
+				conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+		conn = l.observer.accept(conn)
+		return opened(conn)
+	}
+	Serve := func(context netpoll.Context) error {
+		return serve(context)
+	}
+	l.server = &netpoll.Server{
+		Handler: netpoll.NewHandler(Upgrade, Serve),
+	}
+	return l.server.Serve(l.l)
+}
+
+// ServeMessages serves the opened func and the serve func by the netpoll.
+func (l *SIMListener) ServeMessages(opened func(Messages) (Context, error), serve func(Context) error) error {
+	if opened == nil {
+		return ErrOpened
+	} else if serve == nil {
+		return ErrServe
+	}
+	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
+		if l.config != nil {
+			tlsConn := tls.Server(conn, l.config)
+			if err := l.handshaker.handshakeTLS(conn, tlsConn); err != nil {
+				l.observer.reject(err)
+				conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+		conn = l.observer.accept(conn)
+		messages := NewMessages(conn, true)
+		return opened(messages)
+	}
+	Serve := func(context netpoll.Context) error {
+		return serve(context)
+	}
+	l.server = &netpoll.Server{
+		Handler: netpoll.NewHandler(Upgrade, Serve),
+	}
+	return l.server.Serve(l.l)
+}
+
+// Close closes the listener.
+func (l *SIMListener) Close() error {
+	return l.l.Close()
+}
+
+// Addr returns the listener's network address.
+func (l *SIMListener) Addr() net.Addr {
+	return l.l.Addr()
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSIM(t *testing.T) {
+	address := ":9999"
+	serverSock := NewSIMSocket(nil)
+	l, err := serverSock.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serverSock.Listen(address); err == nil {
+		t.Error("should be in use")
+	}
+	l.Serve(nil)
+	l.ServeConn(nil, nil)
+	l.ServeData(nil, nil)
+	l.ServeMessages(nil, nil)
+	l.Close()
+	if err := l.Close(); err == nil {
+		t.Error("should be closed")
+	}
+	if _, err := serverSock.Dial(address); err != ErrSimRefused {
+		t.Error(err)
+	}
+	if s, err := NewSocket("sims", nil); err != nil || s.Scheme() != "sim" {
+		t.Error(err)
+	}
+}
+
+func TestSIMServe(t *testing.T) {
+	network := NewSimNetwork()
+	network.Seed(1)
+	link := network.Link(":9999")
+	newSocket := func() Socket {
+		return &SIM{Network: network}
+	}
+	// The raw data are echoed by a single read.
+	link.SetFaults(SimFaults{Latency: time.Millisecond, Jitter: time.Millisecond})
+	testSocketServeData(newSocket(), newSocket(), t)
+	testSocketServeConn(newSocket(), newSocket(), t)
+	link.SetFaults(SimFaults{Latency: time.Millisecond, Jitter: time.Millisecond, MTU: 64, Fragment: true})
+	testSocket(newSocket(), newSocket(), "sim", t)
+	testSocketServeMessages(newSocket(), newSocket(), t)
+	testSocket(&SIM{Network: network, Config: DefalutServerTLSConfig()}, &SIM{Network: network, Config: SkipVerifyTLSConfig()}, "sims", t)
+}
+
+// simPair returns the two ends of a connection over the link to the address.
+func simPair(t *testing.T, network *SimNetwork, address string) (client, server net.Conn) {
+	l, err := network.listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if client, err = network.dial(address); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestSimLatency(t *testing.T) {
+	network := NewSimNetwork()
+	network.Link(":9999").SetFaults(SimFaults{Latency: time.Millisecond * 50, Bandwidth: 1024 * 100})
+	start := time.Now()
+	client, server := simPair(t, network, ":9999")
+	if d := time.Since(start); d < time.Millisecond*100 {
+		t.Error("dial takes a round trip", d)
+	}
+	start = time.Now()
+	if n, err := client.Write(make([]byte, 1024*10)); err != nil || n != 1024*10 {
+		t.Error(n, err)
+	}
+	if d := time.Since(start); d < time.Millisecond*100 {
+		t.Error("write is limited by the bandwidth", d)
+	}
+	if _, err := io.ReadFull(server, make([]byte, 1024*10)); err != nil {
+		t.Error(err)
+	}
+	if d := time.Since(start); d < time.Millisecond*150 {
+		t.Error("read is delayed by the latency", d)
+	}
+	client.Close()
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Error(err)
+	}
+	if _, err := server.Write([]byte{1}); err != io.ErrClosedPipe {
+		t.Error(err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("should be closed")
+	}
+	server.Close()
+}
+
+func TestSimDialClosed(t *testing.T) {
+	network := NewSimNetwork()
+	network.Link(":9999").SetFaults(SimFaults{Latency: time.Millisecond * 50})
+	for i := 0; i < 16; i++ {
+		l, err := network.listen(":9999")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			time.Sleep(time.Millisecond * 5)
+			l.Close()
+		}()
+		// The listener is closed while the dial is delayed by the latency.
+		if client, err := network.dial(":9999"); err == nil {
+			client.Close()
+			t.Fatal("should be refused")
+		} else if err != ErrSimRefused {
+			t.Fatalf("%v != %v", err, ErrSimRefused)
+		}
+	}
+}
+
+func TestSimFragment(t *testing.T) {
+	network := NewSimNetwork()
+	network.Seed(1)
+	link := network.Link(":9999")
+	link.SetFaults(SimFaults{MTU: 16})
+	client, server := simPair(t, network, ":9999")
+	data := bytes.Repeat([]byte("Hello World"), 100)
+	client.Write(data)
+	buf := make([]byte, len(data))
+	if n, err := server.Read(buf); err != nil || n != 16 {
+		t.Error(n, err)
+	}
+	io.ReadFull(server, buf[16:])
+	if !bytes.Equal(buf, data) {
+		t.Error(string(buf))
+	}
+	link.SetFaults(SimFaults{MTU: 16, Fragment: true})
+	clientMessages, serverMessages := NewMessages(client, false), NewMessages(server, false)
+	for i := 0; i < 10; i++ {
+		if err := clientMessages.WriteMessage(data[:i*100]); err != nil {
+			t.Fatal(err)
+		}
+		if msg, err := serverMessages.ReadMessage(nil); err != nil || !bytes.Equal(msg, data[:i*100]) {
+			t.Fatal(len(msg), err)
+		}
+	}
+	clientMessages.Close()
+	serverMessages.Close()
+}
+
+func TestSimReset(t *testing.T) {
+	network := NewSimNetwork()
+	link := network.Link(":9999")
+	client, server := simPair(t, network, ":9999")
+	client.Write([]byte("Hello World"))
+	link.Reset()
+	if _, err := server.Read(make([]byte, 64)); err != ErrSimReset {
+		t.Error(err)
+	}
+	if _, err := client.Write([]byte("Hello World")); err != ErrSimReset {
+		t.Error(err)
+	}
+	client.Close()
+	server.Close()
+	link.SetFaults(SimFaults{ResetRate: 1})
+	client, server = simPair(t, network, ":9999")
+	if _, err := client.Write([]byte("Hello World")); err != ErrSimReset {
+		t.Error(err)
+	}
+	if _, err := server.Read(make([]byte, 64)); err != ErrSimReset {
+		t.Error(err)
+	}
+	client.Close()
+	server.Close()
+}
+
+func TestSimPartition(t *testing.T) {
+	network := NewSimNetwork()
+	link := network.Link(":9999")
+	client, server := simPair(t, network, ":9999")
+	for _, hold := range []func(){link.Partition, link.Stall} {
+		hold()
+		client.Write([]byte("Hello World"))
+		server.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+		if _, err := server.Read(make([]byte, 64)); err != os.ErrDeadlineExceeded {
+			t.Error(err)
+		}
+		server.SetReadDeadline(time.Time{})
+		time.AfterFunc(time.Millisecond*10, link.Heal)
+		buf := make([]byte, 64)
+		if n, err := server.Read(buf); err != nil || string(buf[:n]) != "Hello World" {
+			t.Error(string(buf[:n]), err)
+		}
+	}
+	link.Partition()
+	if _, err := network.dial(":9999"); err != ErrSimUnreachable {
+		t.Error(err)
+	}
+	link.Heal()
+	link.SetFaults(SimFaults{Bandwidth: 1024})
+	client.SetWriteDeadline(time.Now().Add(time.Millisecond * 50))
+	if _, err := client.Write(make([]byte, 1024)); err != os.ErrDeadlineExceeded {
+		t.Error(err)
+	}
+	client.Close()
+	server.Close()
+}
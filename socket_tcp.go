@@ -7,11 +7,17 @@ import (
 	"crypto/tls"
 	"github.com/hslam/netpoll"
 	"net"
+	"sync"
+	"time"
 )
 
 // TCP implements the Socket interface.
 type TCP struct {
+	// Config is the TLS config, which is never modified by Dial.
 	Config *tls.Config
+	Options
+
+	sessions sessionCache
 }
 
 // TCPConn implements the Conn interface.
@@ -26,7 +32,12 @@ func (c *TCPConn) Messages() Messages {
 
 // Connection returns the net.Conn.
 func (c *TCPConn) Connection() net.Conn {
-	return c.Conn
+	return connectionOf(c.Conn)
+}
+
+// NegotiatedProtocol returns the application level protocol negotiated by ALPN.
+func (c *TCPConn) NegotiatedProtocol() string {
+	return NegotiatedProtocolOf(c)
 }
 
 // NewTCPSocket returns a new TCP socket.
@@ -44,6 +55,15 @@ func (t *TCP) Scheme() string {
 
 // Dial connects to an address.
 func (t *TCP) Dial(address string) (Conn, error) {
+	m := newObserver(t.Metrics, t.Hooks, "tcp")
+	start := time.Now()
+	conn, err := t.dial(address, m)
+	m.dialed(address, conn, start, err)
+	return conn, err
+}
+
+func (t *TCP) dial(address string, m *observer) (Conn, error) {
+	start := time.Now()
 	tcpAddr, err := net.ResolveTCPAddr("tcp4", address)
 	if err != nil {
 		return nil, err
@@ -52,19 +72,22 @@ func (t *TCP) Dial(address string) (Conn, error) {
 	if err != nil {
 		return nil, err
 	}
+	m.stage("connect", start)
 	conn.SetNoDelay(true)
-	if t.Config == nil {
-		return &TCPConn{conn}, err
+	config := clientTLSConfig(t.Config, t.ConfigForAddress, address, t.NextProtos, &t.sessions)
+	if config == nil {
+		return &TCPConn{m.conn(conn)}, err
 	}
-	if t.Config.ServerName == "" {
-		t.Config.ServerName = parseHost(address)
-	}
-	tlsConn := tls.Client(conn, t.Config)
-	if err = tlsConn.Handshake(); err != nil {
+	tlsConn := tls.Client(conn, config)
+	if err = handshakeTLSClient(tlsConn, t.HandshakeStats, t.Pins, m); err != nil {
 		conn.Close()
 		return nil, err
 	}
-	return &TCPConn{tlsConn}, err
+	return &TCPConn{m.conn(tlsConn)}, err
+}
+
+func (t *TCP) handshaker() *handshaker {
+	return newHandshaker(t.HandshakeTimeout, t.MaxConcurrentHandshakes, t.HandshakeStats, newObserver(t.Metrics, t.Hooks, "tcp"))
 }
 
 // Listen announces on the local address.
@@ -77,14 +100,17 @@ func (t *TCP) Listen(address string) (Listener, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &TCPListener{l: lis, config: t.Config}, err
+	return &TCPListener{l: lis, config: serverTLSConfig(t.Config, t.NextProtos), handshaker: t.handshaker(), observer: newObserver(t.Metrics, t.Hooks, "tcp")}, err
 }
 
 // TCPListener implements the Listener interface.
 type TCPListener struct {
-	l      *net.TCPListener
-	server *netpoll.Server
-	config *tls.Config
+	l          *net.TCPListener
+	server     *netpoll.Server
+	mu         sync.Mutex
+	config     *tls.Config
+	handshaker *handshaker
+	observer   *observer
 }
 
 // Accept waits for and returns the next connection to the listener.
@@ -95,14 +121,15 @@ func (l *TCPListener) Accept() (Conn, error) {
 	}
 	conn.SetNoDelay(true)
 	if l.config == nil {
-		return &TCPConn{conn}, err
+		return &TCPConn{l.observer.accept(conn)}, err
 	}
 	tlsConn := tls.Server(conn, l.config)
-	if err = tlsConn.Handshake(); err != nil {
+	if err = l.handshaker.handshakeTLS(conn, tlsConn); err != nil {
+		l.observer.reject(err)
 		conn.Close()
 		return nil, err
 	}
-	return &TCPConn{tlsConn}, err
+	return &TCPConn{l.observer.accept(tlsConn)}, err
 }
 
 // Serve serves the netpoll.Handler by the netpoll.
@@ -110,10 +137,7 @@ func (l *TCPListener) Serve(handler netpoll.Handler) error {
 	if handler == nil {
 		return ErrHandler
 	}
-	l.server = &netpoll.Server{
-		Handler: handler,
-	}
-	return l.server.Serve(l.l)
+	return l.serve(l.observer.handler(handler))
 }
 
 // ServeData serves the opened func and the serve func by the netpoll.
@@ -128,12 +152,14 @@ func (l *TCPListener) ServeData(opened func(net.Conn) error, serve func(req []by
 	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
 		if l.config != nil {
 			tlsConn := tls.Server(conn, l.config)
-			if err := tlsConn.Handshake(); err != nil {
+			if err := l.handshaker.handshakeTLS(conn, tlsConn); err != nil {
+				l.observer.reject(err)
 				conn.Close()
 				return nil, err
 			}
 			conn = tlsConn
 		}
+		conn = l.observer.accept(conn)
 		if opened != nil {
 			if err := opened(conn); err != nil {
 				conn.Close()
@@ -159,10 +185,7 @@ func (l *TCPListener) ServeData(opened func(net.Conn) error, serve func(req []by
 		_, err = c.Conn.Write(res)
 		return err
 	}
-	l.server = &netpoll.Server{
-		Handler: netpoll.NewHandler(Upgrade, Serve),
-	}
-	return l.server.Serve(l.l)
+	return l.serve(netpoll.NewHandler(Upgrade, Serve))
 }
 
 // ServeConn serves the opened func and the serve func by the netpoll.
@@ -175,21 +198,20 @@ func (l *TCPListener) ServeConn(opened func(net.Conn) (Context, error), serve fu
 	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
 		if l.config != nil {
 			tlsConn := tls.Server(conn, l.config)
-			if err := tlsConn.Handshake(); err != nil {
+			if err := l.handshaker.handshakeTLS(conn, tlsConn); err != nil {
+				l.observer.reject(err)
 				conn.Close()
 				return nil, err
 			}
 			conn = tlsConn
 		}
+		conn = l.observer.accept(conn)
 		return opened(conn)
 	}
 	Serve := func(context netpoll.Context) error {
 		return serve(context)
 	}
-	l.server = &netpoll.Server{
-		Handler: netpoll.NewHandler(Upgrade, Serve),
-	}
-	return l.server.Serve(l.l)
+	return l.serve(netpoll.NewHandler(Upgrade, Serve))
 }
 
 // ServeMessages serves the opened func and the serve func by the netpoll.
@@ -202,28 +224,43 @@ func (l *TCPListener) ServeMessages(opened func(Messages) (Context, error), serv
 	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
 		if l.config != nil {
 			tlsConn := tls.Server(conn, l.config)
-			if err := tlsConn.Handshake(); err != nil {
+			if err := l.handshaker.handshakeTLS(conn, tlsConn); err != nil {
+				l.observer.reject(err)
 				conn.Close()
 				return nil, err
 			}
 			conn = tlsConn
 		}
+		conn = l.observer.accept(conn)
 		messages := NewMessages(conn, true)
 		return opened(messages)
 	}
 	Serve := func(context netpoll.Context) error {
 		return serve(context)
 	}
-	l.server = &netpoll.Server{
-		Handler: netpoll.NewHandler(Upgrade, Serve),
+	return l.serve(netpoll.NewHandler(Upgrade, Serve))
+}
+
+// serve serves the handler by the netpoll. The server is guarded by the mutex,
+// since Close may be called by another goroutine.
+func (l *TCPListener) serve(handler netpoll.Handler) error {
+	server := &netpoll.Server{
+		Handler: handler,
 	}
-	return l.server.Serve(l.l)
+	l.mu.Lock()
+	l.server = server
+	l.mu.Unlock()
+	return server.Serve(l.l)
 }
 
 // Close closes the listener.
 func (l *TCPListener) Close() error {
-	if l.server != nil {
-		return l.server.Close()
+	l.mu.Lock()
+	server := l.server
+	l.mu.Unlock()
+	if server != nil {
+		defer l.observer.shutdown()
+		return server.Close()
 	}
 	return l.l.Close()
 }
@@ -8,11 +8,17 @@ import (
 	"github.com/hslam/netpoll"
 	"net"
 	"os"
+	"sync"
+	"time"
 )
 
 // UNIX implements the Socket interface.
 type UNIX struct {
+	// Config is the TLS config, which is never modified by Dial.
 	Config *tls.Config
+	Options
+
+	sessions sessionCache
 }
 
 // UNIXConn implements the Conn interface.
@@ -27,7 +33,12 @@ func (c *UNIXConn) Messages() Messages {
 
 // Connection returns the net.Conn.
 func (c *UNIXConn) Connection() net.Conn {
-	return c.Conn
+	return connectionOf(c.Conn)
+}
+
+// NegotiatedProtocol returns the application level protocol negotiated by ALPN.
+func (c *UNIXConn) NegotiatedProtocol() string {
+	return NegotiatedProtocolOf(c)
 }
 
 // NewUNIXSocket returns a new UNIX socket.
@@ -45,6 +56,15 @@ func (t *UNIX) Scheme() string {
 
 // Dial connects to an address.
 func (t *UNIX) Dial(address string) (Conn, error) {
+	m := newObserver(t.Metrics, t.Hooks, "unix")
+	start := time.Now()
+	conn, err := t.dial(address, m)
+	m.dialed(address, conn, start, err)
+	return conn, err
+}
+
+func (t *UNIX) dial(address string, m *observer) (Conn, error) {
+	start := time.Now()
 	var addr *net.UnixAddr
 	var err error
 	if addr, err = net.ResolveUnixAddr("unix", address); err != nil {
@@ -54,18 +74,21 @@ func (t *UNIX) Dial(address string) (Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	if t.Config == nil {
-		return &UNIXConn{conn}, err
-	}
-	if t.Config.ServerName == "" {
-		t.Config.ServerName = parseHost(address)
+	m.stage("connect", start)
+	config := clientTLSConfig(t.Config, t.ConfigForAddress, address, t.NextProtos, &t.sessions)
+	if config == nil {
+		return &UNIXConn{m.conn(conn)}, err
 	}
-	tlsConn := tls.Client(conn, t.Config)
-	if err = tlsConn.Handshake(); err != nil {
+	tlsConn := tls.Client(conn, config)
+	if err = handshakeTLSClient(tlsConn, t.HandshakeStats, t.Pins, m); err != nil {
 		conn.Close()
 		return nil, err
 	}
-	return &UNIXConn{tlsConn}, err
+	return &UNIXConn{m.conn(tlsConn)}, err
+}
+
+func (t *UNIX) handshaker() *handshaker {
+	return newHandshaker(t.HandshakeTimeout, t.MaxConcurrentHandshakes, t.HandshakeStats, newObserver(t.Metrics, t.Hooks, "unix"))
 }
 
 // Listen announces on the local address.
@@ -81,15 +104,18 @@ func (t *UNIX) Listen(address string) (Listener, error) {
 		return nil, err
 	}
 
-	return &UNIXListener{l: lis, config: t.Config, address: address}, err
+	return &UNIXListener{l: lis, config: serverTLSConfig(t.Config, t.NextProtos), handshaker: t.handshaker(), observer: newObserver(t.Metrics, t.Hooks, "unix"), address: address}, err
 }
 
 // UNIXListener implements the Listener interface.
 type UNIXListener struct {
-	l       *net.UnixListener
-	server  *netpoll.Server
-	config  *tls.Config
-	address string
+	l          *net.UnixListener
+	server     *netpoll.Server
+	mu         sync.Mutex
+	config     *tls.Config
+	handshaker *handshaker
+	observer   *observer
+	address    string
 }
 
 // Accept waits for and returns the next connection to the listener.
@@ -99,14 +125,15 @@ func (l *UNIXListener) Accept() (Conn, error) {
 		return nil, err
 	}
 	if l.config == nil {
-		return &UNIXConn{conn}, err
+		return &UNIXConn{l.observer.accept(conn)}, err
 	}
 	tlsConn := tls.Server(conn, l.config)
-	if err = tlsConn.Handshake(); err != nil {
+	if err = l.handshaker.handshakeTLS(conn, tlsConn); err != nil {
+		l.observer.reject(err)
 		conn.Close()
 		return nil, err
 	}
-	return &UNIXConn{tlsConn}, err
+	return &UNIXConn{l.observer.accept(tlsConn)}, err
 }
 
 // Serve serves the netpoll.Handler by the netpoll.
@@ -114,10 +141,7 @@ func (l *UNIXListener) Serve(handler netpoll.Handler) error {
 	if handler == nil {
 		return ErrHandler
 	}
-	l.server = &netpoll.Server{
-		Handler: handler,
-	}
-	return l.server.Serve(l.l)
+	return l.serve(l.observer.handler(handler))
 }
 
 // ServeData serves the opened func and the serve func by the netpoll.
@@ -132,12 +156,14 @@ func (l *UNIXListener) ServeData(opened func(net.Conn) error, serve func(req []b
 	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
 		if l.config != nil {
 			tlsConn := tls.Server(conn, l.config)
-			if err := tlsConn.Handshake(); err != nil {
+			if err := l.handshaker.handshakeTLS(conn, tlsConn); err != nil {
+				l.observer.reject(err)
 				conn.Close()
 				return nil, err
 			}
 			conn = tlsConn
 		}
+		conn = l.observer.accept(conn)
 		if opened != nil {
 			if err := opened(conn); err != nil {
 				conn.Close()
@@ -163,10 +189,7 @@ func (l *UNIXListener) ServeData(opened func(net.Conn) error, serve func(req []b
 		_, err = c.Conn.Write(res)
 		return err
 	}
-	l.server = &netpoll.Server{
-		Handler: netpoll.NewHandler(Upgrade, Serve),
-	}
-	return l.server.Serve(l.l)
+	return l.serve(netpoll.NewHandler(Upgrade, Serve))
 }
 
 // ServeConn serves the opened func and the serve func by the netpoll.
@@ -179,21 +202,20 @@ func (l *UNIXListener) ServeConn(opened func(net.Conn) (Context, error), serve f
 	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
 		if l.config != nil {
 			tlsConn := tls.Server(conn, l.config)
-			if err := tlsConn.Handshake(); err != nil {
+			if err := l.handshaker.handshakeTLS(conn, tlsConn); err != nil {
+				l.observer.reject(err)
 				conn.Close()
 				return nil, err
 			}
 			conn = tlsConn
 		}
+		conn = l.observer.accept(conn)
 		return opened(conn)
 	}
 	Serve := func(context netpoll.Context) error {
 		return serve(context)
 	}
-	l.server = &netpoll.Server{
-		Handler: netpoll.NewHandler(Upgrade, Serve),
-	}
-	return l.server.Serve(l.l)
+	return l.serve(netpoll.NewHandler(Upgrade, Serve))
 }
 
 // ServeMessages serves the opened func and the serve func by the netpoll.
@@ -206,29 +228,44 @@ func (l *UNIXListener) ServeMessages(opened func(Messages) (Context, error), ser
 	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
 		if l.config != nil {
 			tlsConn := tls.Server(conn, l.config)
-			if err := tlsConn.Handshake(); err != nil {
+			if err := l.handshaker.handshakeTLS(conn, tlsConn); err != nil {
+				l.observer.reject(err)
 				conn.Close()
 				return nil, err
 			}
 			conn = tlsConn
 		}
+		conn = l.observer.accept(conn)
 		messages := NewMessages(conn, true)
 		return opened(messages)
 	}
 	Serve := func(context netpoll.Context) error {
 		return serve(context)
 	}
-	l.server = &netpoll.Server{
-		Handler: netpoll.NewHandler(Upgrade, Serve),
+	return l.serve(netpoll.NewHandler(Upgrade, Serve))
+}
+
+// serve serves the handler by the netpoll. The server is guarded by the mutex,
+// since Close may be called by another goroutine.
+func (l *UNIXListener) serve(handler netpoll.Handler) error {
+	server := &netpoll.Server{
+		Handler: handler,
 	}
-	return l.server.Serve(l.l)
+	l.mu.Lock()
+	l.server = server
+	l.mu.Unlock()
+	return server.Serve(l.l)
 }
 
 // Close closes the listener.
 func (l *UNIXListener) Close() error {
 	defer os.RemoveAll(l.address)
-	if l.server != nil {
-		return l.server.Close()
+	l.mu.Lock()
+	server := l.server
+	l.mu.Unlock()
+	if server != nil {
+		defer l.observer.shutdown()
+		return server.Close()
 	}
 	return l.l.Close()
 }
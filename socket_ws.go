@@ -4,10 +4,14 @@
 package socket
 
 import (
+	"bufio"
 	"crypto/tls"
 	"github.com/hslam/netpoll"
-	"github.com/hslam/websocket"
 	"net"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -17,22 +21,230 @@ const (
 
 // WS implements the Socket interface.
 type WS struct {
+	// Config is the TLS config, which is never modified by Dial.
 	Config *tls.Config
+	Options
+	// Authenticator authenticates the accepted WebSocket upgrade requests if it is not nil.
+	Authenticator Authenticator
+	// Path is the request path of the handshake. Default is WSPath.
+	// A listener with a non-empty Path only accepts the handshakes to the Path.
+	Path string
+	// Subprotocols are the requested subprotocols in order of preference on Dial,
+	// or the supported subprotocols in order of preference on Listen.
+	Subprotocols []string
+	// Origin is the Origin header sent with the handshake request.
+	Origin string
+	// CheckOrigin returns true if the Origin header of the handshake request is acceptable.
+	// If CheckOrigin is nil, a request with an Origin header is only accepted if the host
+	// of the origin is the Host header of the request, so that the browsers can not connect
+	// from other sites.
+	CheckOrigin func(r *http.Request) bool
+	// Header contains the additional header fields sent with the handshake request on Dial,
+	// or with the handshake response on Listen.
+	Header http.Header
+	// Compression enables the permessage-deflate extension if it is not nil.
+	Compression *WSCompression
+	// MaxMessageSize is the maximum size of a received message, which is checked before
+	// the message is buffered. Zero means DefaultWSMaxMessageSize, and a negative value
+	// means no limit.
+	MaxMessageSize int64
+
+	sessions sessionCache
 }
 
 // WSConn implements the Conn interface.
 type WSConn struct {
-	*websocket.Conn
+	stream      *wsStream
+	subprotocol string
+	header      http.Header
+	identity    Identity
+}
+
+func newWSConn(conn net.Conn, isClient bool, shared bool, maxMessageSize int64) *WSConn {
+	return &WSConn{stream: newWSStream(conn, isClient, shared, maxMessageSize)}
 }
 
 // Messages returns a new Messages.
 func (c *WSConn) Messages() Messages {
-	return c.Conn
+	return c
 }
 
 // Connection returns the net.Conn.
 func (c *WSConn) Connection() net.Conn {
-	return c.Conn
+	return c
+}
+
+// NegotiatedProtocol returns the application level protocol negotiated by ALPN.
+func (c *WSConn) NegotiatedProtocol() string {
+	return NegotiatedProtocolOf(c)
+}
+
+// Read implements the net.Conn Read method.
+func (c *WSConn) Read(b []byte) (n int, err error) {
+	return c.stream.read(b)
+}
+
+// Write implements the net.Conn Write method.
+func (c *WSConn) Write(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if err = c.stream.writeMessage(wsBinaryFrame, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadMessage reads single message of either type from the WebSocket.
+func (c *WSConn) ReadMessage(buf []byte) (p []byte, err error) {
+	c.stream.reading.Lock()
+	_, p, err = c.stream.readMessage(buf)
+	c.stream.reading.Unlock()
+	return
+}
+
+// WriteMessage writes data as a binary message to the WebSocket.
+func (c *WSConn) WriteMessage(b []byte) error {
+	return c.stream.writeMessage(wsBinaryFrame, b)
+}
+
+// ReadMessageWithType reads single message from the WebSocket and returns
+// its type, which is either WSTextMessage or WSBinaryMessage.
+func (c *WSConn) ReadMessageWithType(buf []byte) (messageType int, p []byte, err error) {
+	c.stream.reading.Lock()
+	opcode, p, err := c.stream.readMessage(buf)
+	c.stream.reading.Unlock()
+	return int(opcode), p, err
+}
+
+// WriteMessageWithType writes data as a message of the type to the WebSocket.
+// The data of a WSTextMessage must be valid UTF-8.
+func (c *WSConn) WriteMessageWithType(messageType int, b []byte) error {
+	switch messageType {
+	case WSTextMessage:
+		if !utf8.Valid(b) {
+			return ErrWSInvalidUTF8
+		}
+	case WSBinaryMessage:
+	default:
+		return ErrWSMessageType
+	}
+	return c.stream.writeMessage(byte(messageType), b)
+}
+
+// Ping writes a ping frame with the application data.
+func (c *WSConn) Ping(data []byte) error {
+	return c.stream.writeControl(wsPingFrame, data)
+}
+
+// Pong writes a pong frame with the application data.
+func (c *WSConn) Pong(data []byte) error {
+	return c.stream.writeControl(wsPongFrame, data)
+}
+
+// SetPingHandler sets the handler of the ping frames received by the reads.
+// The default handler replies with a pong frame of the same application data.
+// It must not be called concurrently with the reads.
+func (c *WSConn) SetPingHandler(h func(data []byte) error) {
+	c.stream.pingHandler = h
+}
+
+// SetPongHandler sets the handler of the pong frames received by the reads.
+// The pong frames are ignored by default.
+// It must not be called concurrently with the reads.
+func (c *WSConn) SetPongHandler(h func(data []byte) error) {
+	c.stream.pongHandler = h
+}
+
+// WriteClose starts the closing handshake with the close code and the reason.
+// The reads return io.EOF after the peer replies with a close frame.
+func (c *WSConn) WriteClose(code int, reason string) error {
+	if !validWSCloseCode(code) {
+		return ErrWSCloseCode
+	} else if 2+len(reason) > wsMaxControlSize {
+		return ErrWSControlSize
+	}
+	return c.stream.writeClose(code, reason)
+}
+
+// CloseWithReason closes the connection after sending a close frame
+// with the close code and the reason.
+func (c *WSConn) CloseWithReason(code int, reason string) error {
+	if err := c.WriteClose(code, reason); err != nil {
+		c.Close()
+		return err
+	}
+	return c.Close()
+}
+
+// CloseCode returns the close code and the reason received from the peer
+// after the reads return io.EOF. The code is zero if no close frame has been
+// received, or WSCloseNoStatusReceived if the close frame has no close code.
+func (c *WSConn) CloseCode() (code int, reason string) {
+	return c.stream.closeCode, c.stream.closeReason
+}
+
+// Close closes the connection after sending a close frame.
+func (c *WSConn) Close() error {
+	return c.stream.close()
+}
+
+// LocalAddr returns the local network address.
+func (c *WSConn) LocalAddr() net.Addr {
+	return c.stream.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (c *WSConn) RemoteAddr() net.Addr {
+	return c.stream.conn.RemoteAddr()
+}
+
+// SetDeadline implements the net.Conn SetDeadline method.
+func (c *WSConn) SetDeadline(t time.Time) error {
+	return c.stream.conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements the net.Conn SetReadDeadline method.
+func (c *WSConn) SetReadDeadline(t time.Time) error {
+	return c.stream.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements the net.Conn SetWriteDeadline method.
+func (c *WSConn) SetWriteDeadline(t time.Time) error {
+	return c.stream.conn.SetWriteDeadline(t)
+}
+
+// SetBufferedOutput sets the buffered writer with the buffer size.
+func (c *WSConn) SetBufferedOutput(writeBufferSize int) {
+	c.stream.setBufferedOutput(writeBufferSize)
+}
+
+// SetBufferedInput sets the read buffer size.
+func (c *WSConn) SetBufferedInput(readBufferSize int) {
+	c.stream.setBufferedInput(readBufferSize)
+}
+
+// observe replaces the conn under the stream by the observed conn.
+func (c *WSConn) observe(conn net.Conn) {
+	c.stream.conn = conn
+	c.stream.writer = conn
+	c.stream.observed = observedOf(conn)
+}
+
+// Identity returns the identity attached by the listener's Authenticator.
+func (c *WSConn) Identity() Identity {
+	return c.identity
+}
+
+// Subprotocol returns the negotiated subprotocol.
+func (c *WSConn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Header returns the header of the handshake request on the server side,
+// or the header of the handshake response on the client side.
+func (c *WSConn) Header() http.Header {
+	return c.header
 }
 
 // NewWSSocket returns a new WS socket.
@@ -50,12 +262,47 @@ func (t *WS) Scheme() string {
 
 // Dial connects to an address.
 func (t *WS) Dial(address string) (Conn, error) {
-	var err error
-	conn, err := websocket.Dial("tcp", address, WSPath, t.Config)
+	m := newObserver(t.Metrics, t.Hooks, "ws")
+	start := time.Now()
+	conn, err := t.dial(address, m)
+	m.dialed(address, conn, start, err)
+	return conn, err
+}
+
+func (t *WS) dial(address string, m *observer) (Conn, error) {
+	start := time.Now()
+	conn, err := net.Dial("tcp", address)
 	if err != nil {
 		return nil, err
 	}
-	return &WSConn{conn}, err
+	m.stage("connect", start)
+	if config := clientTLSConfig(t.Config, t.ConfigForAddress, address, t.NextProtos, &t.sessions); config != nil {
+		tlsConn := tls.Client(conn, config)
+		if err = handshakeTLSClient(tlsConn, t.HandshakeStats, t.Pins, m); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	start = time.Now()
+	ws, err := t.clientHandshake(conn, address)
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{
+			Op:   "dial-ws",
+			Net:  "tcp" + " " + address,
+			Addr: nil,
+			Err:  err,
+		}
+	}
+	m.stage("upgrade", start)
+	m.upgraded(ws.stream.conn)
+	ws.observe(m.conn(ws.stream.conn))
+	return ws, nil
+}
+
+func (t *WS) handshaker() *handshaker {
+	return newHandshaker(t.HandshakeTimeout, t.MaxConcurrentHandshakes, t.HandshakeStats, newObserver(t.Metrics, t.Hooks, "ws"))
 }
 
 // Listen announces on the local address.
@@ -64,14 +311,32 @@ func (t *WS) Listen(address string) (Listener, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &WSListener{l: lis, config: t.Config}, nil
+	return &WSListener{l: lis, config: serverTLSConfig(t.Config, t.NextProtos), upgrader: t.upgrader(true),
+		handshaker: t.handshaker(), observer: newObserver(t.Metrics, t.Hooks, "ws")}, nil
+}
+
+func (t *WS) upgrader(shared bool) *wsUpgrader {
+	return &wsUpgrader{
+		path:           t.Path,
+		subprotocols:   t.Subprotocols,
+		checkOrigin:    t.CheckOrigin,
+		header:         t.Header,
+		authenticator:  t.Authenticator,
+		compression:    t.Compression,
+		maxMessageSize: t.MaxMessageSize,
+		shared:         shared,
+	}
 }
 
 // WSListener implements the Listener interface.
 type WSListener struct {
-	l      net.Listener
-	server *netpoll.Server
-	config *tls.Config
+	l          net.Listener
+	server     *netpoll.Server
+	mu         sync.Mutex
+	config     *tls.Config
+	upgrader   *wsUpgrader
+	handshaker *handshaker
+	observer   *observer
 }
 
 // Accept waits for and returns the next connection to the listener.
@@ -80,14 +345,45 @@ func (l *WSListener) Accept() (Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	if l.config == nil {
+	ws, err := l.upgrade(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, err
+}
 
+// upgrade performs the TLS handshake and the WebSocket upgrade within the handshake timeout.
+func (l *WSListener) upgrade(conn net.Conn) (ws *WSConn, err error) {
+	err = l.handshaker.do(conn, func() (err error) {
+		ws, err = l.handshake(conn)
+		return
+	})
+	if err != nil {
+		l.observer.reject(err)
+		return nil, err
 	}
-	ws, err := websocket.Upgrade(conn, l.config)
+	l.observer.upgraded(ws.stream.conn)
+	ws.observe(l.observer.accept(ws.stream.conn))
+	return ws, nil
+}
+
+func (l *WSListener) handshake(conn net.Conn) (*WSConn, error) {
+	if l.config != nil {
+		tlsConn := tls.Server(conn, l.config)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		l.handshaker.observe(tlsConn)
+		conn = tlsConn
+	}
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
 	if err != nil {
 		return nil, err
 	}
-	return &WSConn{ws}, err
+	res := &response{handlerHeader: make(http.Header), conn: conn, reader: reader}
+	return l.upgrader.upgrade(res, req)
 }
 
 // Serve serves the netpoll.Handler by the netpoll.
@@ -95,10 +391,7 @@ func (l *WSListener) Serve(handler netpoll.Handler) error {
 	if handler == nil {
 		return ErrHandler
 	}
-	l.server = &netpoll.Server{
-		Handler: handler,
-	}
-	return l.server.Serve(l.l)
+	return l.serve(l.observer.handler(handler))
 }
 
 // ServeData serves the opened func and the serve func by the netpoll.
@@ -109,7 +402,7 @@ func (l *WSListener) ServeData(opened func(net.Conn) error, serve func(req []byt
 		return ErrServe
 	}
 	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
-		messages, err := websocket.Upgrade(conn, l.config)
+		messages, err := l.upgrade(conn)
 		if err != nil {
 			conn.Close()
 			return nil, err
@@ -118,7 +411,7 @@ func (l *WSListener) ServeData(opened func(net.Conn) error, serve func(req []byt
 		return messages, nil
 	}
 	Serve := func(context netpoll.Context) error {
-		ws := context.(*websocket.Conn)
+		ws := context.(*WSConn)
 		msg, err := ws.ReadMessage(nil)
 		if err != nil {
 			return err
@@ -129,10 +422,7 @@ func (l *WSListener) ServeData(opened func(net.Conn) error, serve func(req []byt
 		}
 		return ws.WriteMessage(res)
 	}
-	l.server = &netpoll.Server{
-		Handler: netpoll.NewHandler(Upgrade, Serve),
-	}
-	return l.server.Serve(l.l)
+	return l.serve(netpoll.NewHandler(Upgrade, Serve))
 }
 
 // ServeConn serves the opened func and the serve func by the netpoll.
@@ -143,7 +433,7 @@ func (l *WSListener) ServeConn(opened func(net.Conn) (Context, error), serve fun
 		return ErrServe
 	}
 	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
-		messages, err := websocket.Upgrade(conn, l.config)
+		messages, err := l.upgrade(conn)
 		if err != nil {
 			conn.Close()
 			return nil, err
@@ -153,10 +443,7 @@ func (l *WSListener) ServeConn(opened func(net.Conn) (Context, error), serve fun
 	Serve := func(context netpoll.Context) error {
 		return serve(context)
 	}
-	l.server = &netpoll.Server{
-		Handler: netpoll.NewHandler(Upgrade, Serve),
-	}
-	return l.server.Serve(l.l)
+	return l.serve(netpoll.NewHandler(Upgrade, Serve))
 }
 
 // ServeMessages serves the opened func and the serve func by the netpoll.\
@@ -167,7 +454,7 @@ func (l *WSListener) ServeMessages(opened func(Messages) (Context, error), serve
 		return ErrServe
 	}
 	Upgrade := func(conn net.Conn) (netpoll.Context, error) {
-		messages, err := websocket.Upgrade(conn, l.config)
+		messages, err := l.upgrade(conn)
 		if err != nil {
 			conn.Close()
 			return nil, err
@@ -177,16 +464,29 @@ func (l *WSListener) ServeMessages(opened func(Messages) (Context, error), serve
 	Serve := func(context netpoll.Context) error {
 		return serve(context)
 	}
-	l.server = &netpoll.Server{
-		Handler: netpoll.NewHandler(Upgrade, Serve),
+	return l.serve(netpoll.NewHandler(Upgrade, Serve))
+}
+
+// serve serves the handler by the netpoll. The server is guarded by the mutex,
+// since Close may be called by another goroutine.
+func (l *WSListener) serve(handler netpoll.Handler) error {
+	server := &netpoll.Server{
+		Handler: handler,
 	}
-	return l.server.Serve(l.l)
+	l.mu.Lock()
+	l.server = server
+	l.mu.Unlock()
+	return server.Serve(l.l)
 }
 
 // Close closes the listener.
 func (l *WSListener) Close() error {
-	if l.server != nil {
-		return l.server.Close()
+	l.mu.Lock()
+	server := l.server
+	l.mu.Unlock()
+	if server != nil {
+		defer l.observer.shutdown()
+		return server.Close()
 	}
 	return l.l.Close()
 }
@@ -0,0 +1,753 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func serveWSEcho(l Listener, wg *sync.WaitGroup, opened func(conn *WSConn)) {
+	defer wg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if e, ok := err.(*net.OpError); ok && e.Op == "accept" {
+				return
+			}
+			// The handshake is rejected.
+			continue
+		}
+		wg.Add(1)
+		go func(conn *WSConn) {
+			defer wg.Done()
+			if opened != nil {
+				opened(conn)
+			}
+			for {
+				msg, err := conn.ReadMessage(nil)
+				if err != nil {
+					break
+				}
+				conn.WriteMessage(msg)
+			}
+			conn.Close()
+		}(conn.(*WSConn))
+	}
+}
+
+func TestWSSocketOptions(t *testing.T) {
+	var addr = ":9999"
+	serverSock := &WS{
+		Path:         "/chat",
+		Subprotocols: []string{"v2", "v1"},
+		CheckOrigin: func(r *http.Request) bool {
+			return r.Header.Get("Origin") == "https://hslam.com"
+		},
+		Header: http.Header{"X-Server": {"server"}},
+	}
+	l, err := serverSock.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go serveWSEcho(l, &wg, func(conn *WSConn) {
+		if conn.Header().Get("X-Client") != "client" {
+			t.Error(conn.Header())
+		}
+		if conn.Subprotocol() != "v2" && conn.Subprotocol() != "" {
+			t.Error(conn.Subprotocol())
+		}
+	})
+	clientSock := &WS{
+		Path:         "/chat",
+		Subprotocols: []string{"v1", "v2"},
+		Origin:       "https://hslam.com",
+		Header:       http.Header{"X-Client": {"client"}},
+	}
+	conn, err := clientSock.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := conn.(*WSConn)
+	if ws.Subprotocol() != "v2" {
+		t.Error(ws.Subprotocol())
+	}
+	if ws.Header().Get("X-Server") != "server" {
+		t.Error(ws.Header())
+	}
+	str := "Hello World"
+	ws.WriteMessage([]byte(str))
+	if msg, err := ws.ReadMessage(nil); err != nil {
+		t.Error(err)
+	} else if string(msg) != str {
+		t.Errorf("error %s != %s", string(msg), str)
+	}
+	ws.Close()
+
+	clientSock.Subprotocols = []string{"v3"}
+	if conn, err := clientSock.Dial(addr); err != nil {
+		t.Error(err)
+	} else if conn.(*WSConn).Subprotocol() != "" {
+		t.Error(conn.(*WSConn).Subprotocol())
+	} else {
+		conn.Close()
+	}
+	clientSock.Path = "/other"
+	if _, err := clientSock.Dial(addr); err == nil {
+		t.Error("should be unexpected HTTP response: 404 Not Found")
+	}
+	clientSock.Path = "/chat"
+	clientSock.Origin = "https://example.com"
+	if _, err := clientSock.Dial(addr); err == nil {
+		t.Error("should be unexpected HTTP response: 403 Forbidden")
+	}
+	l.Close()
+	wg.Wait()
+}
+
+func TestWSSocketFrames(t *testing.T) {
+	var addr = ":9999"
+	l, err := NewWSSocket(nil).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go serveWSEcho(l, &wg, nil)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The handshake example of RFC 6455, followed by a single-frame masked
+	// text message "Hello" which is read ahead by the handshake.
+	io.WriteString(conn, "GET /chat HTTP/1.1\r\n"+
+		"Host: server.example.com\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Origin: http://server.example.com\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n"+
+		"\x81\x85\x37\xfa\x21\x3d\x7f\x9f\x4d\x51\x58")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "GET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Error(resp.Status)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Error(accept)
+	}
+	expect := []byte{0x82, 0x05, 'H', 'e', 'l', 'l', 'o'}
+	buf := make([]byte, len(expect))
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(buf, expect) {
+		t.Errorf("error %v != %v", buf, expect)
+	}
+	// A fragmented message with a ping in the middle.
+	key := []byte{0x01, 0x02, 0x03, 0x04}
+	frame := func(b0 byte, payload string) []byte {
+		p := []byte(payload)
+		maskWSPayload(key, p)
+		return append(append([]byte{b0, 0x80 | byte(len(p))}, key...), p...)
+	}
+	var data []byte
+	data = append(data, frame(0x01, "Hel")...)
+	data = append(data, frame(0x89, "ping")...)
+	data = append(data, frame(0x80, "lo")...)
+	conn.Write(data)
+	expect = []byte{0x8a, 0x04, 'p', 'i', 'n', 'g', 0x82, 0x05, 'H', 'e', 'l', 'l', 'o'}
+	buf = make([]byte, len(expect))
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(buf, expect) {
+		t.Errorf("error %v != %v", buf, expect)
+	}
+	// An unmasked frame from the client is a protocol error.
+	conn.Write([]byte{0x82, 0x01, 0x00})
+	expect = []byte{0x88, 0x02, 0x03, 0xea}
+	buf = make([]byte, len(expect))
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(buf, expect) {
+		t.Errorf("error %v != %v", buf, expect)
+	}
+	conn.Close()
+	l.Close()
+	wg.Wait()
+}
+
+func TestWSSocketClientMask(t *testing.T) {
+	var addr = ":9999"
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: "+acceptKey(req.Header.Get("Sec-WebSocket-Key"))+"\r\n\r\n")
+		for _, size := range []int{5, 300, 70000} {
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(reader, header); err != nil {
+				t.Error(err)
+				return
+			}
+			if header[1]&0x80 == 0 {
+				t.Error("the frame of the client is not masked")
+				return
+			}
+			length := int(header[1] & 0x7f)
+			switch length {
+			case 126:
+				header = append(header, make([]byte, 2)...)
+			case 127:
+				header = append(header, make([]byte, 8)...)
+			}
+			header = append(header, make([]byte, 4)...)
+			if _, err := io.ReadFull(reader, header[2:]); err != nil {
+				t.Error(err)
+				return
+			}
+			switch length {
+			case 126:
+				length = int(binary.BigEndian.Uint16(header[2:]))
+			case 127:
+				length = int(binary.BigEndian.Uint64(header[2:]))
+			}
+			if length != size {
+				t.Error(length, size)
+				return
+			}
+			key := header[len(header)-4:]
+			payload := make([]byte, size)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				t.Error(err)
+				return
+			}
+			for i := range payload {
+				payload[i] ^= key[i&3]
+			}
+			if !bytes.Equal(payload, bytes.Repeat([]byte{'a'}, size)) {
+				t.Error("unmask error")
+			}
+		}
+	}()
+	conn, err := NewWSSocket(nil).Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := conn.Messages()
+	for _, size := range []int{5, 300, 70000} {
+		if err := messages.WriteMessage(bytes.Repeat([]byte{'a'}, size)); err != nil {
+			t.Error(err)
+		}
+	}
+	<-done
+	messages.Close()
+	lis.Close()
+}
+
+func TestWSSocketPipelinedFrames(t *testing.T) {
+	var addr = ":9999"
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: "+acceptKey(req.Header.Get("Sec-WebSocket-Key"))+"\r\n\r\n"+
+			"\x82\x00\x82\x05Hello\x82\x05World")
+		conn.Read(make([]byte, 64))
+	}()
+	conn, err := NewWSSocket(nil).Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := conn.Messages()
+	for _, expect := range []string{"", "Hello", "World"} {
+		msg, err := messages.ReadMessage(nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(msg) != expect {
+			t.Errorf("%q %q", msg, expect)
+		}
+	}
+	messages.Close()
+	<-done
+	lis.Close()
+}
+
+func TestWSSocketSameOrigin(t *testing.T) {
+	var addr = ":9999"
+	l, err := NewWSSocket(nil).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go serveWSEcho(l, &wg, nil)
+	origins := []struct {
+		origin string
+		status int
+	}{
+		{"", http.StatusSwitchingProtocols},
+		{"Origin: http://server.example.com\r\n", http.StatusSwitchingProtocols},
+		{"Origin: https://SERVER.example.com\r\n", http.StatusSwitchingProtocols},
+		{"Origin: http://evil.example.com\r\n", http.StatusForbidden},
+		{"Origin: ://\r\n", http.StatusForbidden},
+	}
+	for _, o := range origins {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(conn, "GET /chat HTTP/1.1\r\n"+
+			"Host: server.example.com\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+			o.origin+
+			"Sec-WebSocket-Version: 13\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "GET"})
+		if err != nil {
+			t.Error(err)
+		} else if resp.StatusCode != o.status {
+			t.Error(o.origin, resp.Status)
+		}
+		conn.Close()
+	}
+	l.Close()
+	wg.Wait()
+}
+
+func TestWSSocketMaxMessageSize(t *testing.T) {
+	var addr = ":9999"
+	l, err := (&WS{MaxMessageSize: 1024}).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go serveWSEcho(l, &wg, nil)
+	key := []byte{0x01, 0x02, 0x03, 0x04}
+	frame := func(b0 byte, payload []byte) []byte {
+		p := append([]byte{}, payload...)
+		maskWSPayload(key, p)
+		var header []byte
+		if len(p) < 126 {
+			header = []byte{b0, 0x80 | byte(len(p))}
+		} else {
+			header = []byte{b0, 0x80 | 126, byte(len(p) >> 8), byte(len(p))}
+		}
+		return append(append(header, key...), p...)
+	}
+	// The length of the frame is checked before the payload is buffered.
+	huge := []byte{0x82, 0x80 | 127, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	huge = append(huge, key...)
+	payload := bytes.Repeat([]byte{'a'}, 600)
+	cases := [][]byte{
+		huge,
+		frame(0x82, append(payload, payload...)),
+		append(frame(0x02, payload), frame(0x80, payload)...),
+	}
+	for _, data := range cases {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(conn, "GET /chat HTTP/1.1\r\n"+
+			"Host: server.example.com\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+			"Sec-WebSocket-Version: 13\r\n\r\n")
+		reader := bufio.NewReader(conn)
+		if _, err := http.ReadResponse(reader, &http.Request{Method: "GET"}); err != nil {
+			t.Fatal(err)
+		}
+		// A message of the limit is echoed.
+		conn.Write(frame(0x82, payload))
+		buf := make([]byte, 4+len(payload))
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(buf[4:], payload) {
+			t.Error("echo error")
+		}
+		// The connection fails with the close code 1009 after a message over the limit,
+		// even if each of its frames is within the limit.
+		conn.Write(data)
+		expect := []byte{0x88, 0x02, 0x03, 0xf1}
+		buf = make([]byte, len(expect))
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(buf, expect) {
+			t.Errorf("error %v != %v", buf, expect)
+		}
+		conn.Close()
+	}
+	l.Close()
+	wg.Wait()
+}
+func TestWSSocketCompression(t *testing.T) {
+	var addr = ":9999"
+	options := []struct {
+		server *WSCompression
+		client *WSCompression
+	}{
+		{&WSCompression{}, &WSCompression{}},
+		{&WSCompression{ServerNoContextTakeover: true}, &WSCompression{ClientNoContextTakeover: true}},
+		{&WSCompression{ServerMaxWindowBits: 9, ClientMaxWindowBits: 10}, &WSCompression{Level: flate.BestSpeed, ServerMaxWindowBits: 12}},
+		{nil, &WSCompression{}},
+		{&WSCompression{}, nil},
+	}
+	for _, option := range options {
+		l, err := (&WS{Compression: option.server}).Listen(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed := option.server != nil && option.client != nil
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go serveWSEcho(l, &wg, func(conn *WSConn) {
+			if (conn.stream.deflate != nil) != compressed {
+				t.Error(conn.stream.deflate)
+			}
+		})
+		conn, err := (&WS{Compression: option.client}).Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws := conn.(*WSConn)
+		if (ws.stream.deflate != nil) != compressed {
+			t.Error(ws.stream.deflate)
+		}
+		messages := conn.Messages()
+		for i := 0; i < 8; i++ {
+			str := strings.Repeat(`{"id":`+strconv.Itoa(i)+`,"method":"Echo","params":["Hello World"]}`, i*128+1)
+			if err := messages.WriteMessage([]byte(str)); err != nil {
+				t.Fatal(err)
+			}
+			if msg, err := messages.ReadMessage(nil); err != nil {
+				t.Fatal(err)
+			} else if string(msg) != str {
+				t.Errorf("error %d %d != %d", i, len(msg), len(str))
+			}
+		}
+		messages.Close()
+		l.Close()
+		wg.Wait()
+	}
+}
+
+func TestWSSocketCompressionMaxMessageSize(t *testing.T) {
+	var addr = ":9999"
+	l, err := (&WS{Compression: &WSCompression{}, MaxMessageSize: 1024}).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go serveWSEcho(l, &wg, nil)
+	conn, err := (&WS{Compression: &WSCompression{}}).Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := conn.(*WSConn)
+	if err := ws.WriteMessage(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	} else if msg, err := ws.ReadMessage(nil); err != nil || len(msg) != 1024 {
+		t.Fatal(len(msg), err)
+	}
+	// The compressed message is small, while the decompressed message is too big.
+	if err := ws.WriteMessage(make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ws.ReadMessage(nil); err != io.EOF {
+		t.Error(err)
+	}
+	if code, _ := ws.CloseCode(); code != WSCloseMessageTooBig {
+		t.Error(code)
+	}
+	ws.Close()
+	l.Close()
+	wg.Wait()
+}
+
+func TestWSCompressionNegotiation(t *testing.T) {
+	header := func(ext string) http.Header {
+		return http.Header{"Sec-Websocket-Extensions": {ext}}
+	}
+	server := &WSCompression{ClientNoContextTakeover: true, ServerMaxWindowBits: 10}
+	ext, d := server.accept(header("x-webkit-deflate-frame, permessage-deflate; foo, permessage-deflate; client_max_window_bits"))
+	if ext != "permessage-deflate; client_no_context_takeover; server_max_window_bits=10" {
+		t.Error(ext)
+	}
+	if d == nil || !d.readNoContextTakeover || d.writeNoContextTakeover || d.writeWindowBits != 10 {
+		t.Error(d)
+	}
+	if ext, _ := server.accept(header("permessage-deflate; server_max_window_bits=16")); ext != "" {
+		t.Error(ext)
+	}
+	client := &WSCompression{ServerMaxWindowBits: 12}
+	if offer := client.offer(); offer != "permessage-deflate; server_max_window_bits=12; client_max_window_bits" {
+		t.Error(offer)
+	}
+	if _, err := client.confirm(header("permessage-deflate")); err == nil {
+		t.Error("should be unexpected server_max_window_bits")
+	}
+	if _, err := client.confirm(header("permessage-deflate; server_max_window_bits=10, x-foo")); err == nil {
+		t.Error("should be unexpected extensions")
+	}
+	d, err := client.confirm(header(`permessage-deflate; server_max_window_bits="11"; client_max_window_bits=9`))
+	if err != nil {
+		t.Fatal(err)
+	} else if d.writeWindowBits != 9 {
+		t.Error(d.writeWindowBits)
+	}
+}
+
+func TestWSDeflate(t *testing.T) {
+	for _, noContextTakeover := range []bool{false, true} {
+		w := &wsDeflate{writeNoContextTakeover: noContextTakeover, writeWindowBits: wsMaxWindowBits}
+		r := &wsDeflate{readNoContextTakeover: noContextTakeover}
+		msg := []byte(strings.Repeat(`{"method":"Echo"}`, 64))
+		var sizes []int
+		for i := 0; i < 3; i++ {
+			compressed, err := w.compress(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes = append(sizes, len(compressed))
+			p, err := r.decompress(append([]byte(nil), compressed...), nil, -1)
+			if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(p, msg) {
+				t.Errorf("error %s != %s", p, msg)
+			}
+		}
+		if sizes[0] >= len(msg) {
+			t.Error(sizes)
+		}
+		compressed, err := w.compress(make([]byte, 1<<20))
+		if err != nil {
+			t.Fatal(err)
+		} else if len(compressed) > 4096 {
+			t.Error(len(compressed))
+		}
+		if _, err := r.decompress(append([]byte(nil), compressed...), nil, 1<<20-1); err != ErrWSMessageTooBig {
+			t.Error(err)
+		}
+		if noContextTakeover != (sizes[1] == sizes[0]) {
+			t.Error(sizes)
+		}
+	}
+}
+
+func TestWSSocketControlFrames(t *testing.T) {
+	var addr = ":9999"
+	l, err := NewWSSocket(nil).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ws := conn.(*WSConn)
+			if i == 1 {
+				ws.WriteClose(4000, "restart")
+			}
+			for {
+				msg, err := ws.ReadMessage(nil)
+				if err != nil {
+					break
+				}
+				ws.WriteMessage(msg)
+			}
+			if code, reason := ws.CloseCode(); i == 0 && (code != WSCloseGoingAway || reason != "bye") {
+				t.Error(code, reason)
+			} else if i == 1 && code != 4000 {
+				t.Error(code, reason)
+			}
+			ws.Close()
+		}
+	}()
+	conn, err := NewWSSocket(nil).Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := conn.(*WSConn)
+	var pong []byte
+	ws.SetPongHandler(func(data []byte) error {
+		pong = data
+		return nil
+	})
+	if err := ws.Ping([]byte("ping")); err != nil {
+		t.Error(err)
+	}
+	if err := ws.Ping(make([]byte, 126)); err != ErrWSControlSize {
+		t.Error(err)
+	}
+	ws.WriteMessage([]byte("Hello World"))
+	if msg, err := ws.ReadMessage(nil); err != nil {
+		t.Error(err)
+	} else if string(msg) != "Hello World" {
+		t.Error(string(msg))
+	}
+	if string(pong) != "ping" {
+		t.Error(string(pong))
+	}
+	if err := ws.WriteClose(WSCloseNoStatusReceived, ""); err != ErrWSCloseCode {
+		t.Error(err)
+	}
+	if err := ws.CloseWithReason(WSCloseGoingAway, "bye"); err != nil {
+		t.Error(err)
+	}
+
+	conn, err = NewWSSocket(nil).Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws = conn.(*WSConn)
+	if _, err := ws.ReadMessage(nil); err != io.EOF {
+		t.Error(err)
+	}
+	if code, reason := ws.CloseCode(); code != 4000 || reason != "restart" {
+		t.Error(code, reason)
+	}
+	ws.Close()
+	<-done
+	l.Close()
+}
+
+func TestParseWSClose(t *testing.T) {
+	cases := []struct {
+		payload []byte
+		code    int
+		err     error
+	}{
+		{nil, WSCloseNoStatusReceived, nil},
+		{[]byte{0x03}, 0, errWSProtocol},
+		{[]byte{0x03, 0xe8, 'o', 'k'}, WSCloseNormalClosure, nil},
+		{[]byte{0x03, 0xed}, 0, errWSProtocol},
+		{[]byte{0x03, 0xee}, 0, errWSProtocol},
+		{[]byte{0x0b, 0xb8}, 3000, nil},
+		{[]byte{0x13, 0x88}, 0, errWSProtocol},
+		{[]byte{0x03, 0xe8, 0xff}, 0, ErrWSInvalidUTF8},
+	}
+	for _, c := range cases {
+		if code, _, err := parseWSClose(c.payload); code != c.code || err != c.err {
+			t.Error(c.payload, code, err)
+		}
+	}
+}
+
+func TestWSSocketMessageType(t *testing.T) {
+	var addr = ":9999"
+	l, err := NewWSSocket(nil).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ws := conn.(*WSConn)
+		for {
+			messageType, msg, err := ws.ReadMessageWithType(nil)
+			if err != nil {
+				break
+			}
+			ws.WriteMessageWithType(messageType, msg)
+		}
+		ws.Close()
+	}()
+	conn, err := NewWSSocket(nil).Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := conn.(*WSConn)
+	for _, messageType := range []int{WSTextMessage, WSBinaryMessage} {
+		str := "Hello, 世界"
+		if err := ws.WriteMessageWithType(messageType, []byte(str)); err != nil {
+			t.Error(err)
+		}
+		if mt, msg, err := ws.ReadMessageWithType(nil); err != nil {
+			t.Error(err)
+		} else if mt != messageType || string(msg) != str {
+			t.Errorf("error %d %s != %d %s", mt, string(msg), messageType, str)
+		}
+	}
+	if err := ws.WriteMessageWithType(WSTextMessage, []byte{0xff}); err != ErrWSInvalidUTF8 {
+		t.Error(err)
+	}
+	if err := ws.WriteMessageWithType(wsPingFrame, nil); err != ErrWSMessageType {
+		t.Error(err)
+	}
+	ws.stream.writing.Lock()
+	ws.stream.writeFrame(wsTextFrame, []byte{0xff})
+	ws.stream.writing.Unlock()
+	if _, err := ws.ReadMessage(nil); err != io.EOF {
+		t.Error(err)
+	}
+	if code, _ := ws.CloseCode(); code != WSCloseInvalidPayloadData {
+		t.Error(code)
+	}
+	ws.Close()
+	<-done
+	l.Close()
+}
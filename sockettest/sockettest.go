@@ -0,0 +1,719 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+// Package sockettest implements a conformance test suite for the socket.Socket implementations.
+package sockettest
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hslam/netpoll"
+	"github.com/hslam/socket"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DefaultAddress is the default address of the conformance test suite.
+const DefaultAddress = ":9999"
+
+// Timeout is the maximum duration of a blocking operation of the conformance test suite.
+var Timeout = time.Second * 10
+
+// Config is the configuration of the conformance test suite.
+type Config struct {
+	// NewSockets returns a new server socket and a new client socket for each test.
+	NewSockets func() (server, client socket.Socket)
+	// TLS reports whether the connections of the sockets are secured by TLS.
+	TLS bool
+	// Address is the address to listen on. It is DefaultAddress if it is empty.
+	Address string
+	// LargeFrameSize is the size of the large frames. Zero means 4MB.
+	LargeFrameSize int
+}
+
+// Run runs the conformance test suite of the sockets as the subtests of t.
+func Run(t *testing.T, config Config) {
+	if config.NewSockets == nil {
+		t.Fatal("sockettest: NewSockets is nil")
+	}
+	if config.Address == "" {
+		config.Address = DefaultAddress
+	}
+	if config.LargeFrameSize == 0 {
+		config.LargeFrameSize = 1024 * 1024 * 4
+	}
+	tests := []struct {
+		name string
+		test func(t *testing.T, config Config)
+	}{
+		{"DialAccept", testDialAccept},
+		{"Serve", testServe},
+		{"ServeData", testServeData},
+		{"ServeConn", testServeConn},
+		{"ServeMessages", testServeMessages},
+		{"TLS", testTLS},
+		{"ConcurrentMessages", testConcurrentMessages},
+		{"ConcurrentConns", testConcurrentConns},
+		{"LargeFrame", testLargeFrame},
+		{"ServeLargeFrame", testServeLargeFrame},
+		{"Close", testClose},
+		{"Deadline", testDeadline},
+		{"Errors", testErrors},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, config)
+		})
+	}
+}
+
+// echo accepts the connections and echoes their messages until the listener is closed.
+func echo(l socket.Listener) (wait func()) {
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func(conn socket.Conn) {
+				defer wg.Done()
+				messages := conn.Messages()
+				for {
+					msg, err := messages.ReadMessage(nil)
+					if err != nil {
+						break
+					}
+					if messages.WriteMessage(msg) != nil {
+						break
+					}
+				}
+				messages.Close()
+			}(conn)
+		}
+	}()
+	return wg.Wait
+}
+
+// waitTimeout calls wait and fails the test if it does not return in the Timeout.
+func waitTimeout(t *testing.T, name string, wait func()) {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(Timeout):
+		t.Fatalf("%s does not return in %v", name, Timeout)
+	}
+}
+
+func listen(t *testing.T, s socket.Socket, address string) socket.Listener {
+	l, err := s.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func dial(t *testing.T, s socket.Socket, address string) socket.Conn {
+	conn, err := s.Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// roundTrip writes the message and reads it back.
+func roundTrip(messages socket.Messages, msg []byte) error {
+	if err := messages.WriteMessage(msg); err != nil {
+		return err
+	}
+	p, err := messages.ReadMessage(nil)
+	if err != nil {
+		return err
+	} else if !bytes.Equal(p, msg) {
+		return fmt.Errorf("message of %d bytes != message of %d bytes", len(p), len(msg))
+	}
+	return nil
+}
+
+func testDialAccept(t *testing.T, config Config) {
+	server, client := config.NewSockets()
+	if server.Scheme() == "" || server.Scheme() != client.Scheme() {
+		t.Errorf("schemes %q and %q", server.Scheme(), client.Scheme())
+	}
+	if conn, err := client.Dial(config.Address); err == nil {
+		conn.Close()
+		t.Error("Dial should be refused without a listener")
+	}
+	l := listen(t, server, config.Address)
+	wait := echo(l)
+	if l.Addr() == nil {
+		t.Error("Addr is nil")
+	}
+	conn := dial(t, client, config.Address)
+	netConn := conn.Connection()
+	if netConn == nil {
+		t.Fatal("Connection is nil")
+	}
+	if netConn.LocalAddr() == nil || netConn.RemoteAddr() == nil {
+		t.Error("LocalAddr or RemoteAddr is nil")
+	}
+	messages := conn.Messages()
+	if err := roundTrip(messages, []byte(strings.Repeat("Hello World", 50))); err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(messages, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	messages.Close()
+	l.Close()
+	waitTimeout(t, "Accept", wait)
+}
+
+func testServe(t *testing.T, config Config) {
+	server, client := config.NewSockets()
+	l := listen(t, server, config.Address)
+	defer l.Close()
+	if err := l.Serve(nil); err != socket.ErrHandler {
+		t.Errorf("Serve(nil) returns %v, not %v", err, socket.ErrHandler)
+	}
+	// The handler closes the raw connections, which have not been handshaked or upgraded,
+	// so that the handshakes of Dial fail.
+	upgraded := make(chan struct{}, 1)
+	handler := netpoll.NewHandler(func(conn net.Conn) (netpoll.Context, error) {
+		select {
+		case upgraded <- struct{}{}:
+		default:
+		}
+		conn.Close()
+		return nil, io.EOF
+	}, func(context netpoll.Context) error {
+		return nil
+	})
+	served := make(chan error, 1)
+	go func() {
+		served <- l.Serve(handler)
+	}()
+	// The listener is closed once it serves a connection, since the netpoll.Server
+	// can not be closed while Serve is starting.
+	dialed := make(chan struct{})
+	go func() {
+		defer close(dialed)
+		if conn, err := client.Dial(config.Address); err == nil {
+			conn.Close()
+		}
+	}()
+	select {
+	case <-upgraded:
+	case <-time.After(Timeout):
+		t.Fatalf("Serve does not serve a connection in %v", Timeout)
+	}
+	l.Close()
+	select {
+	case <-served:
+	case <-time.After(Timeout):
+		t.Fatalf("Serve does not return in %v after Close", Timeout)
+	}
+	waitTimeout(t, "Dial", func() { <-dialed })
+	if conn, err := client.Dial(config.Address); err == nil {
+		conn.Close()
+		t.Error("Dial should be refused after Close")
+	}
+}
+
+// testWriteRead writes the data to the conn and reads it back.
+func testWriteRead(t *testing.T, conn net.Conn, data []byte) {
+	conn.SetDeadline(time.Now().Add(Timeout))
+	defer conn.SetDeadline(time.Time{})
+	if n, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	} else if n != len(data) {
+		t.Fatalf("wrote %d bytes, not %d", n, len(data))
+	}
+	buf := make([]byte, len(data))
+	for n := 0; n < len(buf); {
+		m, err := conn.Read(buf[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += m
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatalf("%q != %q", buf, data)
+	}
+}
+
+func testServeData(t *testing.T, config Config) {
+	server, client := config.NewSockets()
+	l := listen(t, server, config.Address)
+	defer l.Close()
+	if err := l.ServeData(nil, nil); err != socket.ErrServe && err != socket.ErrOpened {
+		t.Errorf("ServeData(nil, nil) returns %v", err)
+	}
+	if err := l.ServeData(func(conn net.Conn) error {
+		return nil
+	}, nil); err != socket.ErrServe {
+		t.Errorf("ServeData with a nil serve returns %v, not %v", err, socket.ErrServe)
+	}
+	opened := make(chan net.Conn, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- l.ServeData(func(conn net.Conn) error {
+			opened <- conn
+			return nil
+		}, func(req []byte) (res []byte) {
+			return req
+		})
+	}()
+	conn := dial(t, client, config.Address)
+	testWriteRead(t, conn, []byte(strings.Repeat("Hello World", 50)))
+	select {
+	case c := <-opened:
+		if (socket.TLSConnOf(c) != nil) != config.TLS {
+			t.Errorf("TLSConnOf of the opened conn is %v", socket.TLSConnOf(c))
+		}
+	case <-time.After(Timeout):
+		t.Error("opened is not called")
+	}
+	conn.Close()
+	l.Close()
+	select {
+	case <-served:
+	case <-time.After(Timeout):
+		t.Fatalf("ServeData does not return in %v after Close", Timeout)
+	}
+}
+
+func testServeConn(t *testing.T, config Config) {
+	server, client := config.NewSockets()
+	l := listen(t, server, config.Address)
+	defer l.Close()
+	if err := l.ServeConn(nil, nil); err != socket.ErrServe && err != socket.ErrOpened {
+		t.Errorf("ServeConn(nil, nil) returns %v", err)
+	}
+	if err := l.ServeConn(func(conn net.Conn) (socket.Context, error) {
+		return conn, nil
+	}, nil); err != socket.ErrServe {
+		t.Errorf("ServeConn with a nil serve returns %v, not %v", err, socket.ErrServe)
+	}
+	type context struct {
+		conn net.Conn
+		buf  []byte
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- l.ServeConn(func(conn net.Conn) (socket.Context, error) {
+			return &context{conn: conn, buf: make([]byte, 1024*64)}, nil
+		}, func(ctx socket.Context) error {
+			c := ctx.(*context)
+			n, err := c.conn.Read(c.buf)
+			if err != nil {
+				return err
+			}
+			_, err = c.conn.Write(c.buf[:n])
+			return err
+		})
+	}()
+	conn := dial(t, client, config.Address)
+	testWriteRead(t, conn, []byte(strings.Repeat("Hello World", 50)))
+	conn.Close()
+	l.Close()
+	select {
+	case <-served:
+	case <-time.After(Timeout):
+		t.Fatalf("ServeConn does not return in %v after Close", Timeout)
+	}
+}
+
+func testServeMessages(t *testing.T, config Config) {
+	server, client := config.NewSockets()
+	l := listen(t, server, config.Address)
+	defer l.Close()
+	if err := l.ServeMessages(nil, nil); err != socket.ErrServe && err != socket.ErrOpened {
+		t.Errorf("ServeMessages(nil, nil) returns %v", err)
+	}
+	if err := l.ServeMessages(func(messages socket.Messages) (socket.Context, error) {
+		return messages, nil
+	}, nil); err != socket.ErrServe {
+		t.Errorf("ServeMessages with a nil serve returns %v, not %v", err, socket.ErrServe)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- l.ServeMessages(func(messages socket.Messages) (socket.Context, error) {
+			return messages, nil
+		}, func(context socket.Context) error {
+			messages := context.(socket.Messages)
+			msg, err := messages.ReadMessage(nil)
+			if err != nil {
+				return err
+			}
+			return messages.WriteMessage(msg)
+		})
+	}()
+	conn := dial(t, client, config.Address)
+	messages := conn.Messages()
+	for i := 0; i < 16; i++ {
+		if err := roundTrip(messages, []byte(strings.Repeat("Hello World", i*10))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages.Close()
+	l.Close()
+	select {
+	case <-served:
+	case <-time.After(Timeout):
+		t.Fatalf("ServeMessages does not return in %v after Close", Timeout)
+	}
+}
+
+func testTLS(t *testing.T, config Config) {
+	server, client := config.NewSockets()
+	l := listen(t, server, config.Address)
+	accepted := make(chan socket.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	conn := dial(t, client, config.Address)
+	if (socket.TLSConnOf(conn) != nil) != config.TLS {
+		t.Errorf("TLSConnOf of the dialed conn is %v", socket.TLSConnOf(conn))
+	}
+	select {
+	case c, ok := <-accepted:
+		if !ok {
+			t.Fatal("Accept fails")
+		}
+		if (socket.TLSConnOf(c) != nil) != config.TLS {
+			t.Errorf("TLSConnOf of the accepted conn is %v", socket.TLSConnOf(c))
+		}
+		if config.TLS {
+			if state := socket.TLSConnOf(c).ConnectionState(); !state.HandshakeComplete {
+				t.Error("handshake is not complete")
+			}
+		}
+		// The peer reads the close notify alert, which blocks the Close on the unbuffered transports.
+		go func() {
+			c.Read(make([]byte, 64))
+			c.Close()
+		}()
+	case <-time.After(Timeout):
+		t.Fatalf("Accept does not return in %v", Timeout)
+	}
+	conn.Close()
+	l.Close()
+}
+
+func testConcurrentMessages(t *testing.T, config Config) {
+	server, client := config.NewSockets()
+	l := listen(t, server, config.Address)
+	wait := echo(l)
+	conn := dial(t, client, config.Address)
+	messages := conn.Messages()
+	const writers, count = 8, 64
+	var expected []string
+	wg := sync.WaitGroup{}
+	for i := 0; i < writers; i++ {
+		for j := 0; j < count; j++ {
+			expected = append(expected, strings.Repeat(string(rune('a'+i)), j+1))
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				if err := messages.WriteMessage([]byte(strings.Repeat(string(rune('a'+i)), j+1))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	received := make(chan []string, 1)
+	go func() {
+		var msgs []string
+		for len(msgs) < writers*count {
+			msg, err := messages.ReadMessage(nil)
+			if err != nil {
+				t.Error(err)
+				break
+			}
+			msgs = append(msgs, string(msg))
+		}
+		received <- msgs
+	}()
+	waitTimeout(t, "WriteMessage", wg.Wait)
+	select {
+	case msgs := <-received:
+		sort.Strings(expected)
+		sort.Strings(msgs)
+		if strings.Join(msgs, ",") != strings.Join(expected, ",") {
+			t.Errorf("received %d messages, the concurrent messages are interleaved", len(msgs))
+		}
+	case <-time.After(Timeout):
+		t.Fatalf("ReadMessage does not return in %v", Timeout)
+	}
+	messages.Close()
+	l.Close()
+	waitTimeout(t, "Accept", wait)
+}
+
+func testConcurrentConns(t *testing.T, config Config) {
+	server, client := config.NewSockets()
+	l := listen(t, server, config.Address)
+	wait := echo(l)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := client.Dial(config.Address)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			messages := conn.Messages()
+			defer messages.Close()
+			for j := 0; j < 16; j++ {
+				msg := []byte(strings.Repeat(string(rune('a'+i)), j+1))
+				if err := messages.WriteMessage(msg); err != nil {
+					t.Error(err)
+					return
+				}
+				if p, err := messages.ReadMessage(nil); err != nil || !bytes.Equal(p, msg) {
+					t.Errorf("%q != %q, %v", p, msg, err)
+					return
+				}
+			}
+		}(i)
+	}
+	waitTimeout(t, "the concurrent connections", wg.Wait)
+	l.Close()
+	waitTimeout(t, "Accept", wait)
+}
+
+func testLargeFrame(t *testing.T, config Config) {
+	server, client := config.NewSockets()
+	l := listen(t, server, config.Address)
+	wait := echo(l)
+	conn := dial(t, client, config.Address)
+	messages := conn.Messages()
+	large := make([]byte, config.LargeFrameSize)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, msg := range [][]byte{large, []byte("Hello World"), large[:len(large)/2+1]} {
+			if err := roundTrip(messages, msg); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(Timeout):
+		t.Fatalf("large frames do not round trip in %v", Timeout)
+	}
+	messages.Close()
+	l.Close()
+	waitTimeout(t, "Accept", wait)
+}
+
+// testServeLargeFrame round trips the large frames over ServeMessages, whose reads
+// return EAGAIN in the middle of the frames if the listener serves by the netpoll.
+func testServeLargeFrame(t *testing.T, config Config) {
+	server, client := config.NewSockets()
+	l := listen(t, server, config.Address)
+	served := make(chan error, 1)
+	go func() {
+		served <- l.ServeMessages(func(messages socket.Messages) (socket.Context, error) {
+			return messages, nil
+		}, func(context socket.Context) error {
+			messages := context.(socket.Messages)
+			msg, err := messages.ReadMessage(nil)
+			if err != nil {
+				return err
+			}
+			return messages.WriteMessage(msg)
+		})
+	}()
+	conn := dial(t, client, config.Address)
+	messages := conn.Messages()
+	large := make([]byte, config.LargeFrameSize)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, msg := range [][]byte{large, []byte("Hello World"), large[:len(large)/2+1], large} {
+			if err := roundTrip(messages, msg); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(Timeout):
+		t.Fatalf("large frames do not round trip over ServeMessages in %v", Timeout)
+	}
+	messages.Close()
+	l.Close()
+	select {
+	case <-served:
+	case <-time.After(Timeout):
+		t.Fatalf("ServeMessages does not return in %v after Close", Timeout)
+	}
+}
+
+func testClose(t *testing.T, config Config) {
+	server, client := config.NewSockets()
+	l := listen(t, server, config.Address)
+	accepted := make(chan socket.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	conn := dial(t, client, config.Address)
+	var peer socket.Conn
+	select {
+	case c, ok := <-accepted:
+		if !ok {
+			t.Fatal("Accept fails")
+		}
+		peer = c
+	case <-time.After(Timeout):
+		t.Fatalf("Accept does not return in %v", Timeout)
+	}
+	peerMessages := peer.Messages()
+	read := make(chan error, 1)
+	go func() {
+		_, err := peerMessages.ReadMessage(nil)
+		read <- err
+	}()
+	messages := conn.Messages()
+	if err := messages.Close(); err != nil {
+		t.Error(err)
+	}
+	messages.Close()
+	if err := messages.WriteMessage([]byte("Hello World")); err == nil {
+		t.Error("WriteMessage should fail after Close")
+	}
+	if _, err := messages.ReadMessage(nil); err == nil {
+		t.Error("ReadMessage should fail after Close")
+	}
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Error("ReadMessage of the peer should fail after Close")
+		}
+	case <-time.After(Timeout):
+		t.Errorf("ReadMessage of the peer does not return in %v after Close", Timeout)
+	}
+	peerMessages.Close()
+
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		blocked <- err
+	}()
+	time.Sleep(time.Millisecond * 10)
+	l.Close()
+	select {
+	case err := <-blocked:
+		if err == nil {
+			t.Error("Accept should fail after Close")
+		}
+	case <-time.After(Timeout):
+		t.Errorf("Accept does not return in %v after Close", Timeout)
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Error("Accept should fail after Close")
+	}
+	if conn, err := client.Dial(config.Address); err == nil {
+		conn.Close()
+		t.Error("Dial should be refused after Close")
+	}
+}
+
+func testDeadline(t *testing.T, config Config) {
+	server, client := config.NewSockets()
+	l := listen(t, server, config.Address)
+	wait := echo(l)
+	defer waitTimeout(t, "Accept", wait)
+	defer l.Close()
+	conn := dial(t, client, config.Address)
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond * 50)); err != nil {
+		t.Skip("SetReadDeadline is not supported:", err)
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 64))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Fatal("Read should time out")
+		} else if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			t.Errorf("Read returns %v, not a timeout", err)
+		}
+	case <-time.After(Timeout):
+		t.Fatalf("Read does not time out in %v", Timeout)
+	}
+	conn.SetDeadline(time.Time{})
+	conn.SetWriteDeadline(time.Now().Add(Timeout))
+	conn.SetReadDeadline(time.Now().Add(Timeout))
+	messages := conn.Messages()
+	if err := roundTrip(messages, []byte("Hello World")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testErrors(t *testing.T, config Config) {
+	server, client := config.NewSockets()
+	if _, err := client.Dial(config.Address); err == nil {
+		t.Error("Dial should be refused without a listener")
+	}
+	for i := 0; i < 2; i++ {
+		l := listen(t, server, config.Address)
+		wait := echo(l)
+		conn := dial(t, client, config.Address)
+		messages := conn.Messages()
+		if err := roundTrip(messages, []byte("Hello World")); err != nil {
+			t.Error(err)
+		}
+		messages.Close()
+		if err := roundTrip(messages, []byte("Hello World")); err == nil {
+			t.Error("messages should be closed")
+		}
+		l.Close()
+		waitTimeout(t, "Accept", wait)
+		if _, err := client.Dial(config.Address); err == nil {
+			t.Error("Dial should be refused after Close")
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package sockettest
+
+import (
+	"crypto/tls"
+	"github.com/hslam/socket"
+	"testing"
+)
+
+// The tests of the package socket listen on :9999.
+const address = ":9998"
+
+func TestSockets(t *testing.T) {
+	sockets := []struct {
+		network string
+		tls     bool
+	}{
+		{"tcp", false},
+		{"unix", false},
+		{"http", false},
+		{"ws", false},
+		{"inproc", false},
+		{"sim", false},
+		{"tcps", true},
+		{"unixs", true},
+		{"https", true},
+		{"wss", true},
+		{"inprocs", true},
+		{"sims", true},
+	}
+	for _, s := range sockets {
+		s := s
+		t.Run(s.network, func(t *testing.T) {
+			Run(t, Config{
+				NewSockets: func() (server, client socket.Socket) {
+					var serverConfig, clientConfig *tls.Config
+					if s.tls {
+						serverConfig, clientConfig = socket.DefalutServerTLSConfig(), socket.SkipVerifyTLSConfig()
+					}
+					server, _ = socket.NewSocket(s.network, serverConfig)
+					client, _ = socket.NewSocket(s.network, clientConfig)
+					return
+				},
+				TLS:     s.tls,
+				Address: address,
+			})
+		})
+	}
+}
+
+func TestPSK(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	for _, network := range []string{"tcp+psk", "unix+psk", "inproc+psk"} {
+		network := network
+		t.Run(network, func(t *testing.T) {
+			Run(t, Config{
+				NewSockets: func() (server, client socket.Socket) {
+					server, _ = socket.NewSocket(network, nil)
+					client, _ = socket.NewSocket(network, nil)
+					server.(*socket.PSK).Key = key
+					client.(*socket.PSK).Key = key
+					return
+				},
+				Address: address,
+			})
+		})
+	}
+}
@@ -4,10 +4,16 @@
 package socket
 
 import (
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
+	"strings"
+	"sync"
+	"time"
 )
 
 func parseHost(address string) string {
@@ -18,6 +24,95 @@ func parseHost(address string) string {
 	return serverName
 }
 
+// clientTLSConfig returns the TLS config to dial the address, or nil if there is none.
+// The config is copied with the host of the address as the ServerName if it has no
+// ServerName, with the nextProtos if they are not empty, or with the session cache
+// of the socket if it has no ClientSessionCache, so that the shared config is never modified.
+func clientTLSConfig(config *tls.Config, configForAddress func(address string) *tls.Config, address string, nextProtos []string, sessions *sessionCache) *tls.Config {
+	if configForAddress != nil {
+		if c := configForAddress(address); c != nil {
+			config = c
+		}
+	}
+	if config == nil {
+		return nil
+	}
+	if config.ServerName == "" || len(nextProtos) > 0 || (config.ClientSessionCache == nil && sessions != nil) {
+		config = config.Clone()
+		if config.ServerName == "" {
+			config.ServerName = parseHost(address)
+		}
+		if len(nextProtos) > 0 {
+			config.NextProtos = nextProtos
+		}
+		if config.ClientSessionCache == nil && sessions != nil {
+			config.ClientSessionCache = sessions.get()
+		}
+	}
+	return config
+}
+
+// sessionCache is the TLS session cache of a socket, which is used by Dial
+// if the TLS config has no ClientSessionCache.
+type sessionCache struct {
+	once  sync.Once
+	cache tls.ClientSessionCache
+}
+
+func (s *sessionCache) get() tls.ClientSessionCache {
+	s.once.Do(func() {
+		s.cache = tls.NewLRUClientSessionCache(0)
+	})
+	return s.cache
+}
+
+// serverTLSConfig returns a copy of the TLS config with the nextProtos if they are not empty.
+// The configs returned by its GetConfigForClient take the nextProtos as well, since they
+// replace the config for the handshakes, like the configs of a CertificateManager
+// with the client CAs.
+func serverTLSConfig(config *tls.Config, nextProtos []string) *tls.Config {
+	if config == nil || len(nextProtos) == 0 {
+		return config
+	}
+	config = config.Clone()
+	config.NextProtos = nextProtos
+	if getConfigForClient := config.GetConfigForClient; getConfigForClient != nil {
+		var mu sync.Mutex
+		var last, current *tls.Config
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := getConfigForClient(hello)
+			if c == nil || err != nil {
+				return c, err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			// The copy is made once per config returned by GetConfigForClient.
+			if c != last {
+				last = c
+				current = c.Clone()
+				current.NextProtos = nextProtos
+			}
+			return current, nil
+		}
+	}
+	return config
+}
+
+// handshakeTLSClient runs the TLS handshake of Dial, then counts it and verifies the pins.
+func handshakeTLSClient(tlsConn *tls.Conn, stats *HandshakeStats, pins *PinSet, m *observer) error {
+	start := time.Now()
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	m.stage("tls", start)
+	stats.observe(tlsConn)
+	m.handshake("client", tlsConn)
+	return verifyPins(pins, tlsConn)
+}
+
+// ErrNoCertificates is the error when the PEM data contains no certificates.
+var ErrNoCertificates = errors.New("failed to append certificates")
+
 // LoadServerTLSConfig returns a server TLS config by loading the certificate file and the key file.
 func LoadServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
 	certPEMBlock, err := ioutil.ReadFile(certFile)
@@ -28,7 +123,7 @@ func LoadServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	return ServerTLSConfig(certPEMBlock, keyPEMBlock), nil
+	return NewServerTLSConfig(certPEMBlock, keyPEMBlock)
 }
 
 // LoadClientTLSConfig returns a client TLS config by loading the root certificate file.
@@ -37,10 +132,37 @@ func LoadClientTLSConfig(rootCertFile, serverName string) (*tls.Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	return ClientTLSConfig(rootCertPEM, serverName), nil
+	return NewClientTLSConfig(rootCertPEM, serverName)
+}
+
+// NewServerTLSConfig returns a server TLS config by the certificate data and the key data.
+func NewServerTLSConfig(certPEM []byte, keyPEM []byte) (*tls.Config, error) {
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate or key: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{tlsCert}}, nil
+}
+
+// NewClientTLSConfig returns a client TLS config by the root certificate data.
+func NewClientTLSConfig(rootCertPEM []byte, serverName string) (*tls.Config, error) {
+	certPool, err := newCertPool(rootCertPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid root certificates: %w", err)
+	}
+	return &tls.Config{RootCAs: certPool, ServerName: serverName}, nil
+}
+
+func newCertPool(certPEM []byte) (*x509.CertPool, error) {
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(certPEM) {
+		return nil, ErrNoCertificates
+	}
+	return certPool, nil
 }
 
 // ServerTLSConfig returns a server TLS config by the certificate data and the key data.
+// It panics if the data is invalid, while NewServerTLSConfig returns the error.
 func ServerTLSConfig(certPEM []byte, keyPEM []byte) *tls.Config {
 	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
 	if err != nil {
@@ -50,6 +172,7 @@ func ServerTLSConfig(certPEM []byte, keyPEM []byte) *tls.Config {
 }
 
 // ClientTLSConfig returns a client TLS config by the root certificate data.
+// It panics if the data is invalid, while NewClientTLSConfig returns the error.
 func ClientTLSConfig(rootCertPEM []byte, serverName string) *tls.Config {
 	certPool := x509.NewCertPool()
 	if !certPool.AppendCertsFromPEM(rootCertPEM) {
@@ -58,6 +181,218 @@ func ClientTLSConfig(rootCertPEM []byte, serverName string) *tls.Config {
 	return &tls.Config{RootCAs: certPool, ServerName: serverName}
 }
 
+// LoadMutualServerTLSConfig returns a server TLS config which verifies the client
+// certificates by loading the certificate file, the key file and the client CA file.
+func LoadMutualServerTLSConfig(certFile, keyFile, clientCAFile string, clientAuth tls.ClientAuthType) (*tls.Config, error) {
+	certPEMBlock, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEMBlock, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	clientCAPEM, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewMutualServerTLSConfig(certPEMBlock, keyPEMBlock, clientCAPEM, clientAuth)
+}
+
+// LoadMutualClientTLSConfig returns a client TLS config with a client certificate
+// by loading the root certificate file, the certificate file and the key file.
+func LoadMutualClientTLSConfig(rootCertFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	rootCertPEM, err := ioutil.ReadFile(rootCertFile)
+	if err != nil {
+		return nil, err
+	}
+	certPEMBlock, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEMBlock, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewMutualClientTLSConfig(rootCertPEM, certPEMBlock, keyPEMBlock, serverName)
+}
+
+// NewMutualServerTLSConfig returns a server TLS config by the certificate data and the key data,
+// which verifies the client certificates by the client CA data. The clientAuth is usually
+// tls.RequireAndVerifyClientCert or tls.VerifyClientCertIfGiven.
+func NewMutualServerTLSConfig(certPEM, keyPEM, clientCAPEM []byte, clientAuth tls.ClientAuthType) (*tls.Config, error) {
+	config, err := NewServerTLSConfig(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	certPool, err := newCertPool(clientCAPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client CA certificates: %w", err)
+	}
+	config.ClientCAs = certPool
+	config.ClientAuth = clientAuth
+	return config, nil
+}
+
+// NewMutualClientTLSConfig returns a client TLS config by the root certificate data,
+// which presents the client certificate of the certificate data and the key data.
+func NewMutualClientTLSConfig(rootCertPEM, certPEM, keyPEM []byte, serverName string) (*tls.Config, error) {
+	config, err := NewClientTLSConfig(rootCertPEM, serverName)
+	if err != nil {
+		return nil, err
+	}
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate or key: %w", err)
+	}
+	config.Certificates = []tls.Certificate{tlsCert}
+	return config, nil
+}
+
+// MutualServerTLSConfig returns a server TLS config like NewMutualServerTLSConfig,
+// but panics if the data is invalid.
+func MutualServerTLSConfig(certPEM, keyPEM, clientCAPEM []byte, clientAuth tls.ClientAuthType) *tls.Config {
+	config, err := NewMutualServerTLSConfig(certPEM, keyPEM, clientCAPEM, clientAuth)
+	if err != nil {
+		panic(err)
+	}
+	return config
+}
+
+// MutualClientTLSConfig returns a client TLS config like NewMutualClientTLSConfig,
+// but panics if the data is invalid.
+func MutualClientTLSConfig(rootCertPEM, certPEM, keyPEM []byte, serverName string) *tls.Config {
+	config, err := NewMutualClientTLSConfig(rootCertPEM, certPEM, keyPEM, serverName)
+	if err != nil {
+		panic(err)
+	}
+	return config
+}
+
+// TLSPolicy is the policy checked by ValidateTLSConfig.
+type TLSPolicy struct {
+	// MinVersion is the minimum TLS version. Zero means tls.VersionTLS12.
+	MinVersion uint16
+	// CipherSuites are the allowed TLS 1.0-1.2 cipher suites.
+	// Nil means the secure cipher suites of tls.CipherSuites.
+	CipherSuites []uint16
+	// MinValidity is the minimum remaining validity of the certificates.
+	MinValidity time.Duration
+	// AllowInsecureSkipVerify allows the config to skip the verification of the peer.
+	AllowInsecureSkipVerify bool
+}
+
+// TLSConfigError is the error of ValidateTLSConfig, which lists all the problems found.
+type TLSConfigError struct {
+	Problems []string
+}
+
+// Error implements the error interface.
+func (e *TLSConfigError) Error() string {
+	return "invalid tls config: " + strings.Join(e.Problems, "; ")
+}
+
+// ValidateTLSConfig checks that the private keys match the certificates, the certificates
+// are valid now and for the minimum validity of the policy, a certificate covers the server
+// name if it is not empty, and the versions and the cipher suites comply with the policy.
+// A nil policy means the default policy, and a zero MinVersion of the config means TLS 1.2,
+// the default of crypto/tls. It returns a *TLSConfigError if there are problems.
+func ValidateTLSConfig(config *tls.Config, serverName string, policy *TLSPolicy) error {
+	if config == nil {
+		return &TLSConfigError{Problems: []string{"config is nil"}}
+	}
+	if policy == nil {
+		policy = &TLSPolicy{}
+	}
+	var problems []string
+	now := time.Now()
+	covered := false
+	for i, cert := range config.Certificates {
+		if len(cert.Certificate) == 0 {
+			problems = append(problems, fmt.Sprintf("certificate %d is empty", i))
+			continue
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("certificate %d can not be parsed: %v", i, err))
+			continue
+		}
+		name := fmt.Sprintf("certificate %d (%s)", i, leaf.Subject.CommonName)
+		if signer, ok := cert.PrivateKey.(crypto.Signer); !ok {
+			problems = append(problems, name+" has no private key")
+		} else if pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(leaf.PublicKey) {
+			problems = append(problems, name+": private key does not match public key")
+		}
+		if now.Before(leaf.NotBefore) {
+			problems = append(problems, fmt.Sprintf("%s is not valid until %s", name, leaf.NotBefore.Format(time.RFC3339)))
+		} else if now.After(leaf.NotAfter) {
+			problems = append(problems, fmt.Sprintf("%s expired at %s", name, leaf.NotAfter.Format(time.RFC3339)))
+		} else if policy.MinValidity > 0 && now.Add(policy.MinValidity).After(leaf.NotAfter) {
+			problems = append(problems, fmt.Sprintf("%s expires at %s within %s", name, leaf.NotAfter.Format(time.RFC3339), policy.MinValidity))
+		}
+		if serverName != "" && leaf.VerifyHostname(serverName) == nil {
+			covered = true
+		}
+	}
+	if serverName != "" && !covered {
+		if len(config.Certificates) == 0 && config.GetCertificate == nil {
+			problems = append(problems, fmt.Sprintf("no certificate for server name %q", serverName))
+		} else if len(config.Certificates) > 0 {
+			problems = append(problems, fmt.Sprintf("no certificate covers server name %q", serverName))
+		}
+	}
+	minVersion := policy.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	version := config.MinVersion
+	if version == 0 {
+		version = tls.VersionTLS12
+	}
+	if version < minVersion {
+		problems = append(problems, fmt.Sprintf("MinVersion %s is lower than %s", tlsVersionName(version), tlsVersionName(minVersion)))
+	}
+	if config.MaxVersion != 0 && config.MaxVersion < minVersion {
+		problems = append(problems, fmt.Sprintf("MaxVersion %s is lower than %s", tlsVersionName(config.MaxVersion), tlsVersionName(minVersion)))
+	}
+	allowed := make(map[uint16]bool)
+	if policy.CipherSuites != nil {
+		for _, id := range policy.CipherSuites {
+			allowed[id] = true
+		}
+	} else {
+		for _, suite := range tls.CipherSuites() {
+			allowed[suite.ID] = true
+		}
+	}
+	for _, id := range config.CipherSuites {
+		if !allowed[id] {
+			problems = append(problems, fmt.Sprintf("cipher suite %s is not allowed", tls.CipherSuiteName(id)))
+		}
+	}
+	if config.InsecureSkipVerify && !policy.AllowInsecureSkipVerify {
+		problems = append(problems, "InsecureSkipVerify is set")
+	}
+	if len(problems) > 0 {
+		return &TLSConfigError{Problems: problems}
+	}
+	return nil
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
 // DefalutServerTLSConfig returns a default server TLS config.
 func DefalutServerTLSConfig() *tls.Config {
 	return ServerTLSConfig(DefaultServerCertPEM, DefaultServerKeyPEM)
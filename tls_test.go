@@ -4,8 +4,15 @@
 package socket
 
 import (
+	"crypto/tls"
+	"errors"
+	"net"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLoadTLSConfig(t *testing.T) {
@@ -83,3 +90,286 @@ func TestParseHost(t *testing.T) {
 		}
 	}
 }
+
+func TestMutualTLSConfig(t *testing.T) {
+	config := MutualServerTLSConfig(DefaultServerCertPEM, DefaultServerKeyPEM, DefaultRootCertPEM, tls.VerifyClientCertIfGiven)
+	if config.ClientCAs == nil || config.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Error(config)
+	}
+	config = MutualClientTLSConfig(DefaultRootCertPEM, DefaultServerCertPEM, DefaultServerKeyPEM, "")
+	if len(config.Certificates) != 1 || config.RootCAs == nil {
+		t.Error(config)
+	}
+	if _, err := LoadMutualServerTLSConfig("", "", "", tls.RequireAndVerifyClientCert); err == nil {
+		t.Error("should be no such file or directory")
+	}
+	if _, err := LoadMutualClientTLSConfig("", "", "", ""); err == nil {
+		t.Error("should be no such file or directory")
+	}
+}
+
+func TestClientTLSConfigForAddress(t *testing.T) {
+	config := ClientTLSConfig(DefaultRootCertPEM, "")
+	if c := clientTLSConfig(config, nil, "hello.hslam.com:9999", nil, nil); c == config || c.ServerName != "hello.hslam.com" {
+		t.Error(c.ServerName)
+	}
+	if config.ServerName != "" {
+		t.Error(config.ServerName)
+	}
+	named := DefalutClientTLSConfig()
+	if c := clientTLSConfig(named, nil, "localhost:9999", nil, nil); c != named {
+		t.Error("should not be copied")
+	}
+	configForAddress := func(address string) *tls.Config {
+		if address == "127.0.0.1:9999" {
+			return named
+		}
+		return nil
+	}
+	if c := clientTLSConfig(config, configForAddress, "127.0.0.1:9999", nil, nil); c != named {
+		t.Error("should be overridden")
+	}
+	if c := clientTLSConfig(nil, configForAddress, "localhost:9999", nil, nil); c != nil {
+		t.Error("should be nil")
+	}
+	var sessions sessionCache
+	c := clientTLSConfig(named, nil, "localhost:9999", nil, &sessions)
+	if c == named || named.ClientSessionCache != nil || c.ClientSessionCache == nil || c.ClientSessionCache != sessions.get() {
+		t.Error("should be copied with the session cache of the socket")
+	}
+	cached := named.Clone()
+	cached.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	if c := clientTLSConfig(cached, nil, "localhost:9999", nil, &sessions); c != cached {
+		t.Error("should not be copied")
+	}
+}
+
+func TestDialTLSConfig(t *testing.T) {
+	var addr = "127.0.0.1:9999"
+	l, err := NewTCPSocket(DefalutServerTLSConfig()).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if e, ok := err.(*net.OpError); ok && e.Op == "accept" {
+					return
+				}
+				continue
+			}
+			conn.Close()
+		}
+	}()
+	config := ClientTLSConfig(DefaultRootCertPEM, "")
+	clientSock := &TCP{Config: config}
+	if _, err := clientSock.Dial(addr); err == nil {
+		t.Error("should be certificate is not valid for 127.0.0.1")
+	}
+	if config.ServerName != "" {
+		t.Error(config.ServerName)
+	}
+	clientSock.ConfigForAddress = func(address string) *tls.Config {
+		if address == addr {
+			return DefalutClientTLSConfig()
+		}
+		return nil
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := clientSock.Dial(addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+	if config.ServerName != "" {
+		t.Error(config.ServerName)
+	}
+	l.Close()
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	if _, err := NewServerTLSConfig(DefaultServerCertPEM, []byte{}); err == nil {
+		t.Error("should be invalid certificate or key")
+	}
+	if _, err := NewClientTLSConfig([]byte{}, ""); !errors.Is(err, ErrNoCertificates) {
+		t.Error(err)
+	}
+	if _, err := NewMutualServerTLSConfig(DefaultServerCertPEM, DefaultServerKeyPEM, []byte{}, tls.RequireAndVerifyClientCert); !errors.Is(err, ErrNoCertificates) {
+		t.Error(err)
+	}
+	if _, err := NewMutualClientTLSConfig(DefaultRootCertPEM, DefaultServerCertPEM, []byte{}, ""); err == nil {
+		t.Error("should be invalid client certificate or key")
+	}
+	config, err := NewServerTLSConfig(DefaultServerCertPEM, DefaultServerKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateTLSConfig(config, "hello.hslam.com", nil); err != nil {
+		t.Error(err)
+	}
+	legacy := ServerTLSConfig(DefaultServerCertPEM, DefaultServerKeyPEM)
+	if !reflect.DeepEqual(config, legacy) {
+		t.Error("should be equivalent to ServerTLSConfig")
+	}
+}
+
+func TestValidateTLSConfig(t *testing.T) {
+	ca, err := NewCA(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredCertPEM, expiredKeyPEM, err := ca.IssueServerCertificate(&CertificateOptions{
+		CommonName: "expired",
+		NotBefore:  time.Now().Add(-time.Hour * 2),
+		Validity:   time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _ := tls.X509KeyPair(expiredCertPEM, expiredKeyPEM)
+	shortCertPEM, shortKeyPEM, err := ca.IssueServerCertificate(&CertificateOptions{
+		CommonName: "short",
+		Validity:   time.Hour * 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, _ := tls.X509KeyPair(shortCertPEM, shortKeyPEM)
+	config := ServerTLSConfig(DefaultServerCertPEM, DefaultServerKeyPEM)
+	mismatched := config.Certificates[0]
+	mismatched.PrivateKey = expired.PrivateKey
+	config = &tls.Config{
+		Certificates:       []tls.Certificate{expired, mismatched, short},
+		MinVersion:         tls.VersionTLS10,
+		CipherSuites:       []uint16{tls.TLS_RSA_WITH_RC4_128_SHA, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		InsecureSkipVerify: true,
+	}
+	err = ValidateTLSConfig(config, "localhost", &TLSPolicy{MinValidity: time.Hour * 24})
+	e, ok := err.(*TLSConfigError)
+	if !ok {
+		t.Fatal(err)
+	}
+	expects := []string{
+		"certificate 0 (expired) expired at",
+		"certificate 1 (servername): private key does not match public key",
+		"certificate 2 (short) expires at",
+		`no certificate covers server name "localhost"`,
+		"MinVersion TLS 1.0 is lower than TLS 1.2",
+		"cipher suite TLS_RSA_WITH_RC4_128_SHA is not allowed",
+		"InsecureSkipVerify is set",
+	}
+	if len(e.Problems) != len(expects) {
+		t.Fatal(e)
+	}
+	for i, expect := range expects {
+		if !strings.HasPrefix(e.Problems[i], expect) {
+			t.Errorf("error %s != %s", e.Problems[i], expect)
+		}
+	}
+	if err := ValidateTLSConfig(SkipVerifyTLSConfig(), "", &TLSPolicy{MinVersion: tls.VersionTLS10, AllowInsecureSkipVerify: true}); err != nil {
+		t.Error(err)
+	}
+	if err := ValidateTLSConfig(nil, "", nil); err == nil {
+		t.Error("should be config is nil")
+	}
+}
+
+func TestSessionResumption(t *testing.T) {
+	newServerSocket := []func(stats *HandshakeStats) Socket{
+		func(stats *HandshakeStats) Socket {
+			return &TCP{Config: DefalutServerTLSConfig(), Options: Options{NextProtos: []string{"a", "b"}, HandshakeStats: stats}}
+		},
+		func(stats *HandshakeStats) Socket {
+			return &HTTP{Config: DefalutServerTLSConfig(), Options: Options{NextProtos: []string{"a", "b"}, HandshakeStats: stats}}
+		},
+		func(stats *HandshakeStats) Socket {
+			return &WS{Config: DefalutServerTLSConfig(), Options: Options{NextProtos: []string{"a", "b"}, HandshakeStats: stats}}
+		},
+	}
+	newClientSocket := []func(stats *HandshakeStats) Socket{
+		func(stats *HandshakeStats) Socket {
+			return &TCP{Config: DefalutClientTLSConfig(), Options: Options{NextProtos: []string{"b"}, HandshakeStats: stats}}
+		},
+		func(stats *HandshakeStats) Socket {
+			return &HTTP{Config: DefalutClientTLSConfig(), Options: Options{NextProtos: []string{"b"}, HandshakeStats: stats}}
+		},
+		func(stats *HandshakeStats) Socket {
+			return &WS{Config: DefalutClientTLSConfig(), Options: Options{NextProtos: []string{"b"}, HandshakeStats: stats}}
+		},
+	}
+	for i := range newServerSocket {
+		serverStats, clientStats := &HandshakeStats{}, &HandshakeStats{}
+		testSessionResumption(newServerSocket[i](serverStats), newClientSocket[i](clientStats), serverStats, clientStats, t)
+	}
+}
+
+func testSessionResumption(serverSock, clientSock Socket, serverStats, clientStats *HandshakeStats, t *testing.T) {
+	var addr = ":9999"
+	l, err := serverSock.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protos := make(chan string, 8)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if e, ok := err.(*net.OpError); ok && e.Op == "accept" {
+					return
+				}
+				continue
+			}
+			protos <- NegotiatedProtocolOf(conn)
+			go func(conn Conn) {
+				messages := conn.Messages()
+				for {
+					msg, err := messages.ReadMessage(nil)
+					if err != nil {
+						break
+					}
+					messages.WriteMessage(msg)
+				}
+				messages.Close()
+			}(conn)
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		conn, err := clientSock.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proto := conn.(ProtocolNegotiator).NegotiatedProtocol(); proto != "b" {
+			t.Error(proto)
+		}
+		if proto := <-protos; proto != "b" {
+			t.Error(proto)
+		}
+		messages := conn.Messages()
+		// The session tickets of TLS 1.3 are received with the first reads.
+		if err := messages.WriteMessage([]byte("Hello World")); err != nil {
+			t.Error(err)
+		}
+		if msg, err := messages.ReadMessage(nil); err != nil {
+			t.Error(err)
+		} else if string(msg) != "Hello World" {
+			t.Error(string(msg))
+		}
+		messages.Close()
+	}
+	if clientStats.Full() != 1 || clientStats.Resumed() != 2 {
+		t.Error(clientStats.Full(), clientStats.Resumed())
+	}
+	if serverStats.Full() != 1 || serverStats.Resumed() != 2 {
+		t.Error(serverStats.Full(), serverStats.Resumed())
+	}
+	l.Close()
+}
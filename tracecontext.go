@@ -0,0 +1,96 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"context"
+	"strings"
+)
+
+// The metadata keys of the W3C Trace Context and Baggage.
+const (
+	TraceParentKey = "traceparent"
+	TraceStateKey  = "tracestate"
+	BaggageKey     = "baggage"
+)
+
+// TraceContext is the W3C trace context of a message.
+type TraceContext struct {
+	// TraceParent is the traceparent, such as
+	// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+	TraceParent string
+	// TraceState is the tracestate.
+	TraceState string
+	// Baggage is the W3C baggage.
+	Baggage string
+}
+
+type traceContextKey struct{}
+
+// WithTraceContext returns a copy of ctx with the trace context.
+func WithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceContextOf returns the trace context of ctx.
+func TraceContextOf(ctx context.Context) (tc TraceContext, ok bool) {
+	tc, ok = ctx.Value(traceContextKey{}).(TraceContext)
+	return
+}
+
+// TraceContextPropagator propagates the TraceContext by the traceparent, tracestate
+// and baggage metadata. An invalid traceparent is not propagated.
+type TraceContextPropagator struct{}
+
+// Inject sets the trace context of ctx into the metadata.
+func (TraceContextPropagator) Inject(ctx context.Context, md Metadata) {
+	tc, ok := TraceContextOf(ctx)
+	if !ok || !validTraceParent(tc.TraceParent) {
+		return
+	}
+	md.Set(TraceParentKey, tc.TraceParent)
+	if tc.TraceState != "" {
+		md.Set(TraceStateKey, tc.TraceState)
+	}
+	if tc.Baggage != "" {
+		md.Set(BaggageKey, tc.Baggage)
+	}
+}
+
+// Extract returns a copy of ctx with the trace context of the metadata.
+func (TraceContextPropagator) Extract(ctx context.Context, md Metadata) context.Context {
+	traceParent := md.Get(TraceParentKey)
+	if !validTraceParent(traceParent) {
+		return ctx
+	}
+	return WithTraceContext(ctx, TraceContext{
+		TraceParent: traceParent,
+		TraceState:  md.Get(TraceStateKey),
+		Baggage:     md.Get(BaggageKey),
+	})
+}
+
+// validTraceParent reports whether s is a traceparent of the version 00
+// with a nonzero trace id and a nonzero parent id.
+func validTraceParent(s string) bool {
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return false
+	}
+	for i, size := range []int{2, 32, 16, 2} {
+		if len(parts[i]) != size || !isLowerHex(parts[i]) {
+			return false
+		}
+	}
+	return strings.Trim(parts[1], "0") != "" && strings.Trim(parts[2], "0") != ""
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,876 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"bufio"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/hslam/buffer"
+	"github.com/hslam/writer"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+const (
+	wsContinuationFrame = 0x0
+	wsTextFrame         = 0x1
+	wsBinaryFrame       = 0x2
+	wsCloseFrame        = 0x8
+	wsPingFrame         = 0x9
+	wsPongFrame         = 0xA
+)
+
+// The message types of the WebSocket.
+const (
+	// WSTextMessage denotes a text message of UTF-8 encoded text.
+	WSTextMessage = wsTextFrame
+	// WSBinaryMessage denotes a binary message.
+	WSBinaryMessage = wsBinaryFrame
+)
+
+const (
+	wsGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsVersion        = "13"
+	wsMaxHeaderBytes = 14
+	wsMaxControlSize = 125
+)
+
+// The close codes defined by RFC 6455.
+const (
+	WSCloseNormalClosure      = 1000
+	WSCloseGoingAway          = 1001
+	WSCloseProtocolError      = 1002
+	WSCloseUnsupportedData    = 1003
+	WSCloseNoStatusReceived   = 1005
+	WSCloseAbnormalClosure    = 1006
+	WSCloseInvalidPayloadData = 1007
+	WSClosePolicyViolation    = 1008
+	WSCloseMessageTooBig      = 1009
+	WSCloseMandatoryExtension = 1010
+	WSCloseInternalServerErr  = 1011
+)
+
+// DefaultWSMaxMessageSize is the default maximum size of a received WebSocket message.
+const DefaultWSMaxMessageSize = 32 << 20
+
+var errWSProtocol = errors.New("websocket: protocol error")
+
+// ErrWSInvalidUTF8 is the error when a text message is not valid UTF-8.
+var ErrWSInvalidUTF8 = errors.New("websocket: invalid UTF-8")
+
+// ErrWSMessageType is the error when the message type is neither WSTextMessage nor WSBinaryMessage.
+var ErrWSMessageType = errors.New("websocket: invalid message type")
+
+// ErrWSControlSize is the error when the payload of a control frame is longer than 125 bytes.
+var ErrWSControlSize = errors.New("websocket: control frame payload is too long")
+
+// ErrWSMessageTooBig is the error when a received message is larger than the maximum message size.
+var ErrWSMessageTooBig = errors.New("websocket: message is too big")
+
+// ErrWSCloseCode is the error when a close code can not be sent.
+var ErrWSCloseCode = errors.New("websocket: invalid close code")
+
+// wsUpgrader upgrades the HTTP requests to the WebSocket protocol.
+type wsUpgrader struct {
+	path           string
+	subprotocols   []string
+	checkOrigin    func(r *http.Request) bool
+	header         http.Header
+	authenticator  Authenticator
+	compression    *WSCompression
+	maxMessageSize int64
+	shared         bool
+}
+
+// upgrade checks the WebSocket handshake request and replies to it.
+func (u *wsUpgrader) upgrade(w http.ResponseWriter, r *http.Request) (*WSConn, error) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must GET\n")
+		return nil, errors.New("405 must GET")
+	}
+	if !headerContainsToken(r.Header, "Upgrade", "websocket") || !headerContainsToken(r.Header, "Connection", "upgrade") {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "400 not websocket protocol\n")
+		return nil, errors.New("400 not websocket protocol")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != wsVersion {
+		w.Header().Set("Sec-WebSocket-Version", wsVersion)
+		w.WriteHeader(http.StatusUpgradeRequired)
+		io.WriteString(w, "426 unsupported version\n")
+		return nil, errors.New("426 unsupported version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "400 bad Key\n")
+		return nil, errors.New("400 bad Key")
+	}
+	if !matchHTTPRoute("", u.path, r) {
+		notFoundHTTP(w)
+		return nil, errors.New("404 not found")
+	}
+	checkOrigin := u.checkOrigin
+	if checkOrigin == nil {
+		checkOrigin = checkSameOrigin
+	}
+	if !checkOrigin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "403 origin not allowed\n")
+		return nil, errors.New("403 origin not allowed")
+	}
+	identity, err := authenticate(u.authenticator, w, r)
+	if err != nil {
+		return nil, err
+	}
+	subprotocol := selectSubprotocol(u.subprotocols, headerTokens(r.Header, "Sec-WebSocket-Protocol"))
+	var extension string
+	var deflate *wsDeflate
+	if u.compression != nil {
+		extension, deflate = u.compression.accept(r.Header)
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "500 can not hijack the connection", http.StatusInternalServerError)
+		return nil, errors.New("500 can not hijack the connection")
+	}
+	netConn, rw, err := hj.Hijack()
+	if err != nil {
+		if netConn != nil {
+			netConn.Close()
+		}
+		return nil, err
+	}
+	h := make([]byte, 0, 256)
+	h = append(h, "HTTP/1.1 101 Switching Protocols\r\n"...)
+	h = append(h, "Upgrade: websocket\r\n"...)
+	h = append(h, "Connection: Upgrade\r\n"...)
+	h = append(h, "Sec-WebSocket-Accept: "+acceptKey(key)+"\r\n"...)
+	if subprotocol != "" {
+		h = append(h, "Sec-WebSocket-Protocol: "+subprotocol+"\r\n"...)
+	}
+	if extension != "" {
+		h = append(h, "Sec-WebSocket-Extensions: "+extension+"\r\n"...)
+	}
+	h = appendHeader(h, u.header)
+	h = append(h, "\r\n"...)
+	if _, err = netConn.Write(h); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	c := newWSConn(netConn, false, u.shared, u.maxMessageSize)
+	c.stream.deflate = deflate
+	c.subprotocol = subprotocol
+	c.header = r.Header
+	c.identity = identity
+	c.stream.retain(rw.Reader)
+	return c, nil
+}
+
+// clientHandshake sends the WebSocket handshake request and checks the response.
+func (t *WS) clientHandshake(conn net.Conn, address string) (*WSConn, error) {
+	path := t.Path
+	if path == "" {
+		path = WSPath
+	}
+	key := challengeKey()
+	header := make(http.Header)
+	for k, v := range t.Header {
+		header[k] = v
+	}
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Key", key)
+	header.Set("Sec-WebSocket-Version", wsVersion)
+	if t.Origin != "" {
+		header.Set("Origin", t.Origin)
+	}
+	if len(t.Subprotocols) > 0 {
+		header.Set("Sec-WebSocket-Protocol", strings.Join(t.Subprotocols, ", "))
+	}
+	if t.Compression != nil {
+		header.Set("Sec-WebSocket-Extensions", t.Compression.offer())
+	}
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Opaque: path},
+		Host:   address,
+		Header: header,
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContainsToken(resp.Header, "Upgrade", "websocket") ||
+		!headerContainsToken(resp.Header, "Connection", "upgrade") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	subprotocol := resp.Header.Get("Sec-WebSocket-Protocol")
+	if subprotocol != "" && selectSubprotocol(t.Subprotocols, []string{subprotocol}) == "" {
+		return nil, errors.New("unexpected subprotocol: " + subprotocol)
+	}
+	var deflate *wsDeflate
+	if t.Compression != nil {
+		if deflate, err = t.Compression.confirm(resp.Header); err != nil {
+			return nil, err
+		}
+	} else if len(resp.Header.Values("Sec-WebSocket-Extensions")) > 0 {
+		return nil, errors.New("unexpected extensions: " + strings.Join(resp.Header.Values("Sec-WebSocket-Extensions"), ", "))
+	}
+	c := newWSConn(conn, true, false, t.MaxMessageSize)
+	c.stream.deflate = deflate
+	c.subprotocol = subprotocol
+	c.header = resp.Header
+	c.stream.retain(reader)
+	return c, nil
+}
+
+// wsMaxMessageSize returns the maximum message size of the option, or zero if there is no limit.
+func wsMaxMessageSize(size int64) int64 {
+	if size == 0 {
+		return DefaultWSMaxMessageSize
+	} else if size < 0 {
+		return 0
+	}
+	return size
+}
+
+// checkSameOrigin returns true if the request has no Origin header, or if the host
+// of the origin is the Host header of the request.
+func checkSameOrigin(r *http.Request) bool {
+	origin := r.Header["Origin"]
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin[0])
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func newWSStream(conn net.Conn, isClient bool, shared bool, maxMessageSize int64) *wsStream {
+	var readBuffer []byte
+	var writeBuffer []byte
+	var readPool *buffer.Pool
+	var writePool *buffer.Pool
+	if shared {
+		readPool = buffer.AssignPool(bufferSize)
+		writePool = buffer.AssignPool(bufferSize)
+	} else {
+		readBuffer = make([]byte, bufferSize)
+		writeBuffer = make([]byte, bufferSize)
+	}
+	var seed [8]byte
+	crand.Read(seed[:])
+	return &wsStream{
+		conn:            conn,
+		writer:          conn,
+		isClient:        isClient,
+		shared:          shared,
+		random:          rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:])))),
+		readBufferSize:  bufferSize,
+		writeBufferSize: bufferSize,
+		readBuffer:      readBuffer,
+		writeBuffer:     writeBuffer,
+		readPool:        readPool,
+		writePool:       writePool,
+		maxMessageSize:  wsMaxMessageSize(maxMessageSize),
+	}
+}
+
+// wsStream frames the messages of a WSConn over the conn. It reassembles the
+// fragmented messages within the maximum message size, and replies to the
+// control frames between them. The messages are compressed if the
+// permessage-deflate extension is negotiated. The partial frames and messages are kept when
+// a read of the netpoll returns EAGAIN, so that the next read resumes them.
+type wsStream struct {
+	reading           sync.Mutex
+	writing           sync.Mutex
+	conn              net.Conn
+	writer            io.Writer
+	isClient          bool
+	shared            bool
+	random            *rand.Rand
+	readBufferSize    int
+	readBuffer        []byte
+	writeBufferSize   int
+	writeBuffer       []byte
+	readPool          *buffer.Pool
+	writePool         *buffer.Pool
+	buffer            []byte
+	connBuffer        []byte
+	message           []byte
+	messageOpcode     byte
+	messageCompressed bool
+	maxMessageSize    int64
+	deflate           *wsDeflate
+	closeReceived     bool
+	closeCode         int
+	closeReason       string
+	pingHandler       func(data []byte) error
+	pongHandler       func(data []byte) error
+	closeSent         int32
+	closed            int32
+	observed          *observedConn
+}
+
+// retain keeps the bytes read ahead by the handshake.
+func (c *wsStream) retain(reader *bufio.Reader) {
+	if reader != nil && reader.Buffered() > 0 {
+		buffered, _ := reader.Peek(reader.Buffered())
+		c.buffer = append(c.buffer, buffered...)
+	}
+}
+
+// read reads the data of the messages as a stream.
+func (c *wsStream) read(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.reading.Lock()
+	if len(c.connBuffer) == 0 {
+		var p []byte
+		_, p, err = c.readMessage(c.connBuffer[:0])
+		if err != nil {
+			c.reading.Unlock()
+			return 0, err
+		}
+		c.connBuffer = p
+	}
+	n = copy(b, c.connBuffer)
+	num := copy(c.connBuffer, c.connBuffer[n:])
+	c.connBuffer = c.connBuffer[:num]
+	c.reading.Unlock()
+	return
+}
+
+// readMessage reads a data message and fails the connection if a text message
+// is not valid UTF-8. The reading lock must be held.
+func (c *wsStream) readMessage(buf []byte) (opcode byte, p []byte, err error) {
+	opcode, p, err = c.readFrames(buf)
+	if err == nil && opcode == wsTextFrame && !utf8.Valid(p) {
+		c.fail(WSCloseInvalidPayloadData)
+		return 0, nil, ErrWSInvalidUTF8
+	}
+	if err == nil {
+		c.observed.message("read", len(p))
+	}
+	return
+}
+
+// readFrames reads the frames until a data message is complete and
+// replies to the control frames in between.
+func (c *wsStream) readFrames(buf []byte) (opcode byte, p []byte, err error) {
+	if c.closeReceived {
+		return 0, nil, io.EOF
+	}
+	for {
+		for {
+			var f wsFrame
+			var size int
+			size, err = parseWSFrame(c.buffer, !c.isClient, c.deflate != nil, c.limit(), &f)
+			if err == ErrWSMessageTooBig {
+				c.fail(WSCloseMessageTooBig)
+				return 0, nil, err
+			} else if err != nil {
+				c.fail(WSCloseProtocolError)
+				return 0, nil, err
+			}
+			if size == 0 {
+				break
+			}
+			switch f.opcode {
+			case wsPingFrame:
+				payload := append([]byte(nil), f.payload...)
+				c.consume(size)
+				if c.pingHandler != nil {
+					err = c.pingHandler(payload)
+				} else {
+					err = c.writeControl(wsPongFrame, payload)
+				}
+				if err != nil {
+					return 0, nil, err
+				}
+				continue
+			case wsPongFrame:
+				payload := append([]byte(nil), f.payload...)
+				c.consume(size)
+				if c.pongHandler != nil {
+					if err = c.pongHandler(payload); err != nil {
+						return 0, nil, err
+					}
+				}
+				continue
+			case wsCloseFrame:
+				code, reason, err := parseWSClose(f.payload)
+				c.consume(size)
+				if err == ErrWSInvalidUTF8 {
+					c.fail(WSCloseInvalidPayloadData)
+					return 0, nil, err
+				} else if err != nil {
+					c.fail(WSCloseProtocolError)
+					return 0, nil, err
+				}
+				c.closeReceived = true
+				c.closeCode = code
+				c.closeReason = reason
+				c.writeClose(code, "")
+				return 0, nil, io.EOF
+			case wsContinuationFrame:
+				if c.messageOpcode == 0 {
+					c.fail(WSCloseProtocolError)
+					return 0, nil, errWSProtocol
+				}
+				c.message = append(c.message, f.payload...)
+				c.consume(size)
+				if !f.fin {
+					continue
+				}
+				opcode = c.messageOpcode
+				c.messageOpcode = 0
+				if c.messageCompressed {
+					c.messageCompressed = false
+					p, err = c.decompress(c.message, buf)
+					c.message = c.message[:0]
+					return opcode, p, err
+				}
+				p = c.message
+				if cap(buf) >= len(c.message) {
+					p = buf[:len(c.message)]
+					copy(p, c.message)
+					c.message = c.message[:0]
+				} else {
+					c.message = nil
+				}
+				return opcode, p, nil
+			default:
+				if c.messageOpcode != 0 {
+					c.fail(WSCloseProtocolError)
+					return 0, nil, errWSProtocol
+				}
+				if !f.fin {
+					c.messageOpcode = f.opcode
+					c.messageCompressed = f.rsv1
+					c.message = append(c.message[:0], f.payload...)
+					c.consume(size)
+					continue
+				}
+				if f.rsv1 {
+					p, err = c.decompress(f.payload, buf)
+					c.consume(size)
+					return f.opcode, p, err
+				}
+				if cap(buf) >= len(f.payload) {
+					p = buf[:len(f.payload)]
+				} else {
+					p = make([]byte, len(f.payload))
+				}
+				copy(p, f.payload)
+				c.consume(size)
+				return f.opcode, p, nil
+			}
+		}
+		var readBuffer []byte
+		if c.shared {
+			readBuffer = c.readPool.GetBuffer(c.readBufferSize)
+			readBuffer = readBuffer[:cap(readBuffer)]
+		} else {
+			readBuffer = c.readBuffer
+		}
+		var n int
+		n, err = c.conn.Read(readBuffer)
+		if n > 0 {
+			c.buffer = append(c.buffer, readBuffer[:n]...)
+		}
+		if c.shared {
+			c.readPool.PutBuffer(readBuffer)
+		}
+		if err != nil {
+			errMsg := err.Error()
+			if strings.Contains(errMsg, "use of closed network connection") || strings.Contains(errMsg, "connection reset by peer") {
+				err = io.EOF
+			}
+			return 0, nil, err
+		}
+	}
+}
+
+// decompress decompresses the message, or fails the connection if the message is invalid.
+// The decompressed message is bounded by the maximum message size as well.
+func (c *wsStream) decompress(message []byte, buf []byte) ([]byte, error) {
+	var limit int64 = -1
+	if c.maxMessageSize > 0 {
+		limit = c.maxMessageSize
+	}
+	p, err := c.deflate.decompress(message, buf, limit)
+	if err == ErrWSMessageTooBig {
+		c.fail(WSCloseMessageTooBig)
+		return nil, err
+	} else if err != nil {
+		c.fail(WSCloseInvalidPayloadData)
+		return nil, errWSProtocol
+	}
+	return p, nil
+}
+
+// limit returns the maximum payload size of the next data frame, so that the
+// frames of a message are not longer than the maximum message size in total.
+// It returns a negative value if there is no limit.
+func (c *wsStream) limit() int64 {
+	if c.maxMessageSize <= 0 {
+		return -1
+	}
+	return c.maxMessageSize - int64(len(c.message))
+}
+
+func (c *wsStream) consume(size int) {
+	n := copy(c.buffer, c.buffer[size:])
+	c.buffer = c.buffer[:n]
+}
+
+// writeMessage writes the data as a message of a single frame.
+func (c *wsStream) writeMessage(opcode byte, b []byte) (err error) {
+	c.writing.Lock()
+	err = c.writeFrame(opcode, b)
+	c.writing.Unlock()
+	return
+}
+
+// writeFrame writes the payload as a final frame, which is compressed if it is
+// a data frame and the compression is negotiated. The writing lock must be held.
+func (c *wsStream) writeFrame(opcode byte, payload []byte) error {
+	var rsv1 byte
+	messageSize := len(payload)
+	if c.deflate != nil && opcode&0x8 == 0 {
+		compressed, err := c.deflate.compress(payload)
+		if err != nil {
+			return err
+		}
+		payload = compressed
+		rsv1 = 0x40
+	}
+	length := len(payload)
+	size := wsMaxHeaderBytes + length
+	var writeBuffer []byte
+	var big bool
+	if c.writeBufferSize < size {
+		big = true
+		writeBuffer = buffer.GetBuffer(size)
+	} else if c.shared {
+		writeBuffer = c.writePool.GetBuffer(c.writeBufferSize)
+		writeBuffer = writeBuffer[:cap(writeBuffer)]
+	} else {
+		writeBuffer = c.writeBuffer
+	}
+	writeBuffer = writeBuffer[:size]
+	writeBuffer[0] = 0x80 | rsv1 | opcode
+	i := 2
+	if length <= 125 {
+		writeBuffer[1] = byte(length)
+	} else if length < 65536 {
+		writeBuffer[1] = 126
+		binary.BigEndian.PutUint16(writeBuffer[2:], uint16(length))
+		i += 2
+	} else {
+		writeBuffer[1] = 127
+		binary.BigEndian.PutUint64(writeBuffer[2:], uint64(length))
+		i += 8
+	}
+	if c.isClient {
+		writeBuffer[1] |= 0x80
+		key := writeBuffer[i : i+4]
+		binary.LittleEndian.PutUint32(key, c.random.Uint32())
+		i += 4
+		copy(writeBuffer[i:], payload)
+		maskWSPayload(key, writeBuffer[i:i+length])
+	} else {
+		copy(writeBuffer[i:], payload)
+	}
+	i += length
+	_, err := c.writer.Write(writeBuffer[:i])
+	if err == nil && opcode&0x8 == 0 {
+		c.observed.message("write", messageSize)
+	} else if err != nil {
+		errMsg := err.Error()
+		if strings.Contains(errMsg, "use of closed network connection") || strings.Contains(errMsg, "connection reset by peer") {
+			err = io.EOF
+		}
+	}
+	if big {
+		buffer.PutBuffer(writeBuffer)
+	} else if c.shared {
+		c.writePool.PutBuffer(writeBuffer)
+	}
+	return err
+}
+
+func (c *wsStream) writeControl(opcode byte, data []byte) error {
+	if len(data) > wsMaxControlSize {
+		return ErrWSControlSize
+	}
+	c.writing.Lock()
+	err := c.writeFrame(opcode, data)
+	c.writing.Unlock()
+	return err
+}
+
+// writeClose writes a close frame once. The close frame has no payload
+// if the code is WSCloseNoStatusReceived.
+func (c *wsStream) writeClose(code int, reason string) error {
+	if !atomic.CompareAndSwapInt32(&c.closeSent, 0, 1) {
+		return nil
+	}
+	var payload []byte
+	if code != WSCloseNoStatusReceived {
+		payload = make([]byte, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		copy(payload[2:], reason)
+	}
+	return c.writeControl(wsCloseFrame, payload)
+}
+
+// fail starts the closing handshake with the close code of the failure.
+func (c *wsStream) fail(code int) {
+	c.writeClose(code, "")
+}
+
+// close closes the conn after sending a close frame.
+func (c *wsStream) close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	c.writeClose(WSCloseNormalClosure, "")
+	c.writing.Lock()
+	if w, ok := c.writer.(*writer.Writer); ok {
+		w.Close()
+	}
+	c.writing.Unlock()
+	return c.conn.Close()
+}
+
+// setBufferedOutput sets the buffered writer with the buffer size.
+func (c *wsStream) setBufferedOutput(writeBufferSize int) {
+	c.writing.Lock()
+	if w, ok := c.writer.(*writer.Writer); ok {
+		w.Close()
+	}
+	if writeBufferSize > 0 {
+		c.writer = writer.NewWriter(c.conn, writeBufferSize)
+	} else {
+		c.writer = c.conn
+		writeBufferSize = bufferSize
+	}
+	c.writeBufferSize = writeBufferSize
+	if c.shared {
+		c.writePool = buffer.AssignPool(writeBufferSize)
+	} else {
+		c.writeBuffer = make([]byte, writeBufferSize)
+	}
+	c.writing.Unlock()
+}
+
+// setBufferedInput sets the read buffer size.
+func (c *wsStream) setBufferedInput(readBufferSize int) {
+	if readBufferSize < 1 {
+		readBufferSize = bufferSize
+	}
+	c.reading.Lock()
+	c.readBufferSize = readBufferSize
+	if c.shared {
+		c.readPool = buffer.AssignPool(readBufferSize)
+	} else {
+		c.readBuffer = make([]byte, readBufferSize)
+	}
+	c.reading.Unlock()
+}
+
+type wsFrame struct {
+	fin     bool
+	rsv1    bool
+	opcode  byte
+	payload []byte
+}
+
+// parseWSFrame parses a frame from the data and unmasks its payload in place.
+// The RSV1 bit of the first frame of a message is allowed if compressed is true.
+// The payload of a data frame must not be longer than the limit unless it is negative,
+// which is checked as soon as the length is parsed.
+// It returns the size of the frame, or zero if the data is incomplete.
+func parseWSFrame(data []byte, masked bool, compressed bool, limit int64, f *wsFrame) (int, error) {
+	if len(data) < 2 {
+		return 0, nil
+	}
+	f.fin = data[0]&0x80 != 0
+	f.rsv1 = data[0]&0x40 != 0
+	f.opcode = data[0] & 0x0f
+	if data[0]&0x30 != 0 {
+		return 0, errWSProtocol
+	}
+	switch f.opcode {
+	case wsTextFrame, wsBinaryFrame:
+		if f.rsv1 && !compressed {
+			return 0, errWSProtocol
+		}
+	case wsContinuationFrame:
+		if f.rsv1 {
+			return 0, errWSProtocol
+		}
+	case wsCloseFrame, wsPingFrame, wsPongFrame:
+		if !f.fin || f.rsv1 || data[1]&0x7f > wsMaxControlSize {
+			return 0, errWSProtocol
+		}
+	default:
+		return 0, errWSProtocol
+	}
+	if (data[1]&0x80 != 0) != masked {
+		return 0, errWSProtocol
+	}
+	offset := 2
+	length := uint64(data[1] & 0x7f)
+	if length == 126 {
+		if len(data) < offset+2 {
+			return 0, nil
+		}
+		length = uint64(binary.BigEndian.Uint16(data[offset:]))
+		offset += 2
+	} else if length == 127 {
+		if len(data) < offset+8 {
+			return 0, nil
+		}
+		length = binary.BigEndian.Uint64(data[offset:])
+		if length>>63 != 0 {
+			return 0, errWSProtocol
+		}
+		offset += 8
+	}
+	if limit >= 0 && length > uint64(limit) && f.opcode&0x8 == 0 {
+		return 0, ErrWSMessageTooBig
+	}
+	var key []byte
+	if masked {
+		if len(data) < offset+4 {
+			return 0, nil
+		}
+		key = data[offset : offset+4]
+		offset += 4
+	}
+	if uint64(len(data)-offset) < length {
+		return 0, nil
+	}
+	end := offset + int(length)
+	f.payload = data[offset:end]
+	if masked {
+		maskWSPayload(key, f.payload)
+	}
+	return end, nil
+}
+
+// parseWSClose parses the close code and the reason of a close frame.
+func parseWSClose(payload []byte) (code int, reason string, err error) {
+	if len(payload) == 0 {
+		return WSCloseNoStatusReceived, "", nil
+	} else if len(payload) == 1 {
+		return 0, "", errWSProtocol
+	}
+	code = int(binary.BigEndian.Uint16(payload))
+	if !validWSCloseCode(code) {
+		return 0, "", errWSProtocol
+	}
+	if !utf8.Valid(payload[2:]) {
+		return 0, "", ErrWSInvalidUTF8
+	}
+	return code, string(payload[2:]), nil
+}
+
+// validWSCloseCode reports whether the close code can be sent in a close frame.
+func validWSCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+func maskWSPayload(key []byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
+
+func challengeKey() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerTokens returns the comma-separated tokens of the header values.
+func headerTokens(header http.Header, name string) (tokens []string) {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, t := range headerTokens(header, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectSubprotocol returns the first of the supported subprotocols that is requested.
+func selectSubprotocol(supported, requested []string) string {
+	for _, s := range supported {
+		for _, r := range requested {
+			if s == r {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// appendHeader appends the header fields in the wire format.
+func appendHeader(h []byte, header http.Header) []byte {
+	for k, values := range header {
+		for _, v := range values {
+			h = append(h, k+": "+v+"\r\n"...)
+		}
+	}
+	return h
+}
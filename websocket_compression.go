@@ -0,0 +1,297 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package socket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	wsDeflateExtension = "permessage-deflate"
+	wsMaxWindowBits    = 15
+	wsMinWindowBits    = 8
+	wsMaxWindowSize    = 1 << wsMaxWindowBits
+)
+
+// wsDeflateTail is the tail removed from the compressed messages, followed by
+// an empty final block to terminate the stream.
+var wsDeflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// WSCompression configures the permessage-deflate extension of RFC 7692.
+type WSCompression struct {
+	// Level is the compression level of compress/flate. Zero means flate.DefaultCompression.
+	Level int
+	// ServerNoContextTakeover prevents the server from using the previous messages
+	// as the dictionary of the next one.
+	ServerNoContextTakeover bool
+	// ClientNoContextTakeover prevents the client from using the previous messages
+	// as the dictionary of the next one.
+	ClientNoContextTakeover bool
+	// ServerMaxWindowBits limits the LZ77 sliding window of the server in the range 8 to 15.
+	// Zero means 15.
+	ServerMaxWindowBits int
+	// ClientMaxWindowBits limits the LZ77 sliding window of the client in the range 8 to 15.
+	// Zero means 15.
+	ClientMaxWindowBits int
+}
+
+// wsDeflateParams are the parameters of a permessage-deflate offer or response.
+type wsDeflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	// serverMaxWindowBits is zero if absent.
+	serverMaxWindowBits int
+	// clientMaxWindowBits is zero if absent, or -1 if present without a value.
+	clientMaxWindowBits int
+}
+
+// offer returns the extension offered by the client.
+func (c *WSCompression) offer() string {
+	ext := wsDeflateExtension
+	if c.ServerNoContextTakeover {
+		ext += "; server_no_context_takeover"
+	}
+	if c.ClientNoContextTakeover {
+		ext += "; client_no_context_takeover"
+	}
+	if bits := windowBits(c.ServerMaxWindowBits); bits < wsMaxWindowBits {
+		ext += "; server_max_window_bits=" + strconv.Itoa(bits)
+	}
+	if bits := windowBits(c.ClientMaxWindowBits); bits < wsMaxWindowBits {
+		ext += "; client_max_window_bits=" + strconv.Itoa(bits)
+	} else {
+		ext += "; client_max_window_bits"
+	}
+	return ext
+}
+
+// accept returns the response to the first acceptable offer of the client,
+// or an empty string if there is none.
+func (c *WSCompression) accept(header http.Header) (string, *wsDeflate) {
+	for _, offer := range wsExtensions(header) {
+		if offer[0] != wsDeflateExtension {
+			continue
+		}
+		p, ok := parseWSDeflateParams(offer[1:])
+		if !ok {
+			continue
+		}
+		d := &wsDeflate{level: c.Level}
+		ext := wsDeflateExtension
+		if p.serverNoContextTakeover || c.ServerNoContextTakeover {
+			d.writeNoContextTakeover = true
+			ext += "; server_no_context_takeover"
+		}
+		if p.clientNoContextTakeover || c.ClientNoContextTakeover {
+			d.readNoContextTakeover = true
+			ext += "; client_no_context_takeover"
+		}
+		d.writeWindowBits = windowBits(c.ServerMaxWindowBits)
+		if p.serverMaxWindowBits > 0 && p.serverMaxWindowBits < d.writeWindowBits {
+			d.writeWindowBits = p.serverMaxWindowBits
+		}
+		if d.writeWindowBits < wsMaxWindowBits || p.serverMaxWindowBits > 0 {
+			ext += "; server_max_window_bits=" + strconv.Itoa(d.writeWindowBits)
+		}
+		if p.clientMaxWindowBits != 0 {
+			bits := windowBits(c.ClientMaxWindowBits)
+			if bits < wsMaxWindowBits && (p.clientMaxWindowBits < 0 || bits < p.clientMaxWindowBits) {
+				ext += "; client_max_window_bits=" + strconv.Itoa(bits)
+			}
+		}
+		return ext, d
+	}
+	return "", nil
+}
+
+// confirm checks the extension accepted by the server.
+func (c *WSCompression) confirm(header http.Header) (*wsDeflate, error) {
+	exts := wsExtensions(header)
+	if len(exts) == 0 {
+		return nil, nil
+	}
+	if len(exts) > 1 || exts[0][0] != wsDeflateExtension {
+		return nil, errors.New("unexpected extensions: " + strings.Join(header.Values("Sec-WebSocket-Extensions"), ", "))
+	}
+	p, ok := parseWSDeflateParams(exts[0][1:])
+	if !ok || p.clientMaxWindowBits < 0 {
+		return nil, errors.New("unexpected extension parameters: " + strings.Join(exts[0], "; "))
+	}
+	if bits := windowBits(c.ServerMaxWindowBits); bits < wsMaxWindowBits && (p.serverMaxWindowBits == 0 || p.serverMaxWindowBits > bits) {
+		return nil, errors.New("unexpected server_max_window_bits")
+	}
+	d := &wsDeflate{
+		level:                  c.Level,
+		writeNoContextTakeover: c.ClientNoContextTakeover || p.clientNoContextTakeover,
+		readNoContextTakeover:  p.serverNoContextTakeover,
+		writeWindowBits:        windowBits(c.ClientMaxWindowBits),
+	}
+	if p.clientMaxWindowBits > 0 && p.clientMaxWindowBits < d.writeWindowBits {
+		d.writeWindowBits = p.clientMaxWindowBits
+	}
+	return d, nil
+}
+
+// wsExtensions returns the extensions of the Sec-WebSocket-Extensions header,
+// each of which is the name followed by the parameters.
+func wsExtensions(header http.Header) (exts [][]string) {
+	for _, token := range headerTokens(header, "Sec-WebSocket-Extensions") {
+		var ext []string
+		for _, s := range strings.Split(token, ";") {
+			ext = append(ext, strings.TrimSpace(s))
+		}
+		exts = append(exts, ext)
+	}
+	return
+}
+
+// parseWSDeflateParams parses the parameters of permessage-deflate.
+// It returns false if any parameter is unknown, duplicated or invalid.
+func parseWSDeflateParams(params []string) (p wsDeflateParams, ok bool) {
+	seen := make(map[string]bool)
+	for _, param := range params {
+		name, value := param, ""
+		if i := strings.IndexByte(param, '='); i >= 0 {
+			name = strings.TrimSpace(param[:i])
+			value = strings.Trim(strings.TrimSpace(param[i+1:]), `"`)
+		}
+		if seen[name] {
+			return p, false
+		}
+		seen[name] = true
+		switch name {
+		case "server_no_context_takeover":
+			if value != "" {
+				return p, false
+			}
+			p.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			if value != "" {
+				return p, false
+			}
+			p.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			bits, err := strconv.Atoi(value)
+			if err != nil || bits < wsMinWindowBits || bits > wsMaxWindowBits {
+				return p, false
+			}
+			p.serverMaxWindowBits = bits
+		case "client_max_window_bits":
+			if value == "" {
+				p.clientMaxWindowBits = -1
+				continue
+			}
+			bits, err := strconv.Atoi(value)
+			if err != nil || bits < wsMinWindowBits || bits > wsMaxWindowBits {
+				return p, false
+			}
+			p.clientMaxWindowBits = bits
+		default:
+			return p, false
+		}
+	}
+	return p, true
+}
+
+func windowBits(bits int) int {
+	if bits <= 0 || bits > wsMaxWindowBits {
+		return wsMaxWindowBits
+	} else if bits < wsMinWindowBits {
+		return wsMinWindowBits
+	}
+	return bits
+}
+
+// wsDeflate compresses and decompresses the messages of a wsStream.
+type wsDeflate struct {
+	level                  int
+	writeNoContextTakeover bool
+	readNoContextTakeover  bool
+	writeWindowBits        int
+	writer                 *flate.Writer
+	compressed             bytes.Buffer
+	reader                 io.ReadCloser
+	dict                   []byte
+}
+
+// compress compresses the message. The returned slice is valid until the next call.
+func (d *wsDeflate) compress(p []byte) ([]byte, error) {
+	d.compressed.Reset()
+	if d.writer == nil {
+		level := d.level
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		if d.writeWindowBits < wsMaxWindowBits {
+			// The compressor of compress/flate always uses a window of 32KB,
+			// while Huffman-only compression refers to no previous bytes.
+			level = flate.HuffmanOnly
+		}
+		w, err := flate.NewWriter(&d.compressed, level)
+		if err != nil {
+			return nil, err
+		}
+		d.writer = w
+	} else if d.writeNoContextTakeover {
+		d.writer.Reset(&d.compressed)
+	}
+	if _, err := d.writer.Write(p); err != nil {
+		return nil, err
+	}
+	if err := d.writer.Flush(); err != nil {
+		return nil, err
+	}
+	b := d.compressed.Bytes()
+	if len(b) >= 4 && bytes.Equal(b[len(b)-4:], wsDeflateTail[:4]) {
+		b = b[:len(b)-4]
+	}
+	return b, nil
+}
+
+// decompress decompresses the message into buf. It returns ErrWSMessageTooBig if
+// the decompressed message is larger than the limit, or has no limit if the limit
+// is negative.
+func (d *wsDeflate) decompress(p []byte, buf []byte, limit int64) ([]byte, error) {
+	r := io.MultiReader(bytes.NewReader(p), bytes.NewReader(wsDeflateTail))
+	var dict []byte
+	if !d.readNoContextTakeover {
+		dict = d.dict
+	}
+	if d.reader == nil {
+		d.reader = flate.NewReaderDict(r, dict)
+	} else if err := d.reader.(flate.Resetter).Reset(r, dict); err != nil {
+		return nil, err
+	}
+	var reader io.Reader = d.reader
+	if limit >= 0 {
+		// One more byte tells the message at the limit from the larger one.
+		reader = io.LimitReader(d.reader, limit+1)
+	}
+	out := bytes.NewBuffer(buf[:0])
+	if _, err := out.ReadFrom(reader); err != nil {
+		return nil, err
+	}
+	if limit >= 0 && int64(out.Len()) > limit {
+		// The context is lost as the connection fails.
+		return nil, ErrWSMessageTooBig
+	}
+	msg := out.Bytes()
+	if !d.readNoContextTakeover {
+		if len(msg) >= wsMaxWindowSize {
+			d.dict = append(d.dict[:0], msg[len(msg)-wsMaxWindowSize:]...)
+		} else {
+			if n := len(d.dict) + len(msg) - wsMaxWindowSize; n > 0 {
+				d.dict = d.dict[:copy(d.dict, d.dict[n:])]
+			}
+			d.dict = append(d.dict, msg...)
+		}
+	}
+	return msg, nil
+}